@@ -23,14 +23,23 @@ import (
 	"compose"
 	"compose/ansible"
 	"compose/config"
+	"compose/secret"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"util"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -40,6 +49,7 @@ import (
 	"github.com/grammarly/rocker/src/rocker/dockerclient"
 	"github.com/grammarly/rocker/src/rocker/template"
 	"github.com/grammarly/rocker/src/rocker/textformatter"
+	"github.com/mitchellh/go-homedir"
 )
 
 var (
@@ -59,9 +69,16 @@ var (
 func init() {
 	log.SetOutput(os.Stdout)
 	log.SetLevel(log.InfoLevel)
+	log.AddHook(util.RedactHook{})
 	debugtrap.SetupDumpStackTrap()
 }
 
+var secretKeyFileFlag = cli.StringFlag{
+	Name:  "keyfile, k",
+	Value: secret.DefaultKeyFile,
+	Usage: "path to the secret key file",
+}
+
 func main() {
 	app := cli.NewApp()
 
@@ -101,6 +118,75 @@ func main() {
 			Name:  "demand-artifacts",
 			Usage: "fail if artifacts not found for {{ image }} helpers",
 		},
+		cli.StringFlag{
+			Name:  "secret-store",
+			Value: config.DefaultSecretStore,
+			Usage: "Directory of the local secret store, used by `store` secrets",
+		},
+		cli.StringFlag{
+			Name:  "secret-provider",
+			Usage: "Provider for {{ secret }} helper: env[:PREFIX] | file:PATH[?keyfile=KEY] | vault:URL",
+		},
+		cli.IntFlag{
+			Name:  "pull-concurrency",
+			Value: compose.DefaultPullConcurrency,
+			Usage: "Number of images to pull in parallel",
+		},
+		cli.IntFlag{
+			Name:  "pull-retries",
+			Value: 3,
+			Usage: "Number of retries of pulls failed with transient registry or network errors",
+		},
+		cli.StringSliceFlag{
+			Name:  "profile",
+			Value: &cli.StringSlice{},
+			Usage: "Activate the profile, containers tagged with other profiles are not run. Can pass multiple of this.",
+		},
+		cli.BoolFlag{
+			Name:  "no-lock",
+			Usage: "Ignore " + compose.LockFileName + " next to the manifest, pin does not write it either",
+		},
+		cli.StringSliceFlag{
+			Name:  "mirror",
+			Value: &cli.StringSlice{},
+			Usage: "Pull images from the mirror, prefix=mirror, e.g. docker.io=mirror.local. Can pass multiple of this.",
+		},
+		cli.StringFlag{
+			Name:  "mirrors-file",
+			Usage: "YAML file with mirror rules, a map of prefixes to mirrors",
+		},
+		cli.DurationFlag{
+			Name:  "lock-timeout",
+			Value: compose.DefaultDeployLockTimeout,
+			Usage: "How long to wait for the deploy lock of the namespace held by another run, 0 to fail at once",
+		},
+		cli.DurationFlag{
+			Name:  "lock-ttl",
+			Value: compose.DefaultDeployLockTTL,
+			Usage: "The deploy lock expires after this and may be taken over by other runs",
+		},
+		cli.StringFlag{
+			Name:  "history-dir",
+			Value: compose.DefaultHistoryDir,
+			Usage: "Directory where revisions of successful runs are recorded",
+		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Value: compose.DefaultStateDir,
+			Usage: "Directory where journals of deploys are kept, so that interrupted ones can be reported and resumed",
+		},
+		cli.StringFlag{
+			Name:  "events-file",
+			Usage: "Append deploy progress events to the file as JSON lines",
+		},
+		cli.IntFlag{
+			Name:  "events-fd",
+			Usage: "Write deploy progress events as JSON lines to the inherited file descriptor",
+		},
+		cli.StringFlag{
+			Name:  "notify-file",
+			Usage: "YAML file with webhooks and commands notified of outcomes of runs, in addition to the notify section of the manifest",
+		},
 	}
 
 	app.Flags = append([]cli.Flag{
@@ -141,6 +227,10 @@ func main() {
 					Name:  "pull",
 					Usage: "Do pull images before running",
 				},
+				cli.BoolFlag{
+					Name:  "build",
+					Usage: "Build images of containers having the build key before running",
+				},
 				cli.DurationFlag{
 					Name:  "wait",
 					Value: 1 * time.Second,
@@ -150,6 +240,31 @@ func main() {
 					Name:  "ansible",
 					Usage: "output json in ansible format for easy parsing",
 				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "Resume the interrupted deploy, failing if the recomputed plan does not retry its failed actions",
+				},
+				cli.StringFlag{
+					Name:  "metrics-textfile",
+					Usage: "Write metrics of the run to the file for the node_exporter textfile collector",
+				},
+				cli.StringFlag{
+					Name:  "inventory",
+					Usage: "YAML file with Docker hosts to deploy to with --hosts",
+				},
+				cli.StringFlag{
+					Name:  "hosts",
+					Usage: "Deploy to hosts of the inventory matching the patterns, comma separated, e.g. web*,db1",
+				},
+				cli.IntFlag{
+					Name:  "batch-size",
+					Value: 1,
+					Usage: "Number of hosts deployed to in parallel with --hosts",
+				},
+				cli.IntFlag{
+					Name:  "max-failures",
+					Usage: "Number of failed hosts tolerated with --hosts, the rollout halts after more of them failed",
+				},
 			}, composeFlags...),
 		},
 		{
@@ -179,6 +294,15 @@ func main() {
 					Value: 5,
 					Usage: "number of last images to keep",
 				},
+				cli.DurationFlag{
+					Name:  "older-than",
+					Usage: "remove only tags created earlier than this, e.g. 720h",
+				},
+				cli.StringSliceFlag{
+					Name:  "keep-tag",
+					Value: &cli.StringSlice{},
+					Usage: "keep tags matching the regexp or semver range, e.g. 'release-.*' or '~1.2', can be given multiple times",
+				},
 				cli.BoolFlag{
 					Name:  "ansible",
 					Usage: "output json in ansible format for easy parsing",
@@ -198,6 +322,10 @@ func main() {
 					Name:  "hub",
 					Usage: "search across images in the registry",
 				},
+				cli.BoolFlag{
+					Name:  "digest",
+					Usage: "pin images by content digest (name@sha256:...) instead of tags",
+				},
 				cli.StringFlag{
 					Name:  "type, t",
 					Value: "yaml",
@@ -208,11 +336,170 @@ func main() {
 					Value: "-",
 					Usage: "write result in a file or stdout if the value is `-`",
 				},
+				cli.StringSliceFlag{
+					Name:  "update, u",
+					Value: &cli.StringSlice{},
+					Usage: "resolve only the given container again, others keep versions from " + compose.LockFileName + ". Can pass multiple of this.",
+				},
+			}, composeFlags...),
+		},
+		{
+			Name:   "outdated",
+			Usage:  "show containers having newer versions of images available",
+			Action: outdatedCommand,
+			Flags: append([]cli.Flag{
+				cli.BoolTFlag{
+					Name:  "local, l",
+					Usage: "search across images available locally",
+				},
+				cli.BoolTFlag{
+					Name:  "hub",
+					Usage: "search across images in the registry",
+				},
+				cli.BoolFlag{
+					Name:  "all, a",
+					Usage: "show up to date containers as well",
+				},
+				cli.StringFlag{
+					Name:  "type, t",
+					Value: "table",
+					Usage: "output in specified format: table|json",
+				},
+			}, composeFlags...),
+		},
+		{
+			Name:   "history",
+			Usage:  "list revisions recorded by successful runs of the manifest",
+			Action: historyCommand,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "type, t",
+					Value: "table",
+					Usage: "output in specified format: table|json",
+				},
+			}, composeFlags...),
+		},
+		{
+			Name:   "rollback",
+			Usage:  "run the manifest and images of a previous revision",
+			Action: rollbackCommand,
+			Flags: append([]cli.Flag{
+				cli.IntFlag{
+					Name:  "to",
+					Usage: "number of the revision to roll back to, the one before the latest if not given",
+				},
+				cli.DurationFlag{
+					Name:  "wait",
+					Value: 1 * time.Second,
+					Usage: "Wait and check exit codes of launched containers",
+				},
+			}, composeFlags...),
+		},
+		{
+			Name:   "status",
+			Usage:  "show containers of the manifest and warn about an interrupted deploy",
+			Action: statusCommand,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "type, t",
+					Value: "table",
+					Usage: "output in specified format: table|json",
+				},
+			}, composeFlags...),
+		},
+		{
+			Name:   "force-unlock",
+			Usage:  "remove the deploy lock of the namespace left by a crashed or killed run",
+			Action: forceUnlockCommand,
+			Flags:  composeFlags,
+		},
+		{
+			Name:   "watch",
+			Usage:  "keep containers of the manifest running, reconcile them on Docker events and manifest changes",
+			Action: watchCommand,
+			Flags: append([]cli.Flag{
+				cli.DurationFlag{
+					Name:  "wait",
+					Value: 1 * time.Second,
+					Usage: "Wait and check exit codes of launched containers",
+				},
+				cli.DurationFlag{
+					Name:  "debounce",
+					Value: compose.DefaultWatchDebounce,
+					Usage: "Wait for more changes before reconciling",
+				},
+				cli.DurationFlag{
+					Name:  "poll-interval",
+					Value: compose.DefaultWatchPollInterval,
+					Usage: "How often the manifest, vars and lock files are checked for changes",
+				},
+				cli.DurationFlag{
+					Name:  "max-backoff",
+					Value: compose.DefaultWatchMaxBackoff,
+					Usage: "Longest delay between retries of failed reconciles",
+				},
+				cli.StringFlag{
+					Name:  "metrics-addr",
+					Usage: "Serve Prometheus metrics on the address, e.g. :9150",
+				},
+			}, composeFlags...),
+		},
+		{
+			Name:   "serve",
+			Usage:  "serve an HTTP API to render, plan and apply manifests of a directory",
+			Action: serveCommand,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "addr",
+					Value: "127.0.0.1:8080",
+					Usage: "Address to listen on, only loopback addresses are allowed without TLS",
+				},
+				cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "Serve the API over HTTPS with the certificate file",
+				},
+				cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "Private key file of the certificate given by --tls-cert",
+				},
+				cli.DurationFlag{
+					Name:  "read-timeout",
+					Value: 1 * time.Minute,
+					Usage: "How long to wait for a request to be read",
+				},
+				cli.DurationFlag{
+					Name:  "write-timeout",
+					Value: 30 * time.Minute,
+					Usage: "How long a response may take, applies and event streams are cut after it",
+				},
+				cli.StringFlag{
+					Name:  "root",
+					Usage: "Directory of manifests, every manifest is <root>/<name>/compose.yml",
+				},
+				cli.StringFlag{
+					Name:  "tokens-file",
+					Usage: "YAML file with API tokens, a map of user names to tokens",
+				},
+				cli.StringFlag{
+					Name:  "audit-log",
+					Usage: "Append records of applies to the file as JSON lines",
+				},
+				cli.DurationFlag{
+					Name:  "wait",
+					Value: 1 * time.Second,
+					Usage: "Wait and check exit codes of launched containers",
+				},
 			}, composeFlags...),
 		},
+		{
+			Name:   "ansible-module",
+			Usage:  "run as an Ansible module with arguments from the file given by Ansible, `ansible-module ARGSFILE`",
+			Action: ansibleModuleCommand,
+			Flags:  composeFlags,
+		},
 		{
 			Name:   "recover",
-			Usage:  "recover containers from machine reboot or docker daemon restart",
+			Usage:  "recover containers from machine reboot or docker daemon restart (deprecated, use watch)",
 			Action: recoverCommand,
 			Flags: []cli.Flag{
 				cli.BoolFlag{
@@ -226,6 +513,58 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "bundle",
+			Usage: "save images of the manifest to a tarball and load them on hosts without registry access",
+			Subcommands: []cli.Command{
+				{
+					Name:   "save",
+					Usage:  "resolve images of the manifest and save them to the tarball",
+					Action: bundleSaveCommand,
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "output, o",
+							Usage: "path of the tarball to write",
+						},
+					}, composeFlags...),
+				},
+				{
+					Name:   "load",
+					Usage:  "load images from the tarball made by `bundle save`",
+					Action: bundleLoadCommand,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "input, i",
+							Usage: "path of the tarball to read",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "secret",
+			Usage: "manage encrypted secrets files for the `file` secret provider",
+			Subcommands: []cli.Command{
+				{
+					Name:   "keygen",
+					Usage:  "generate a new secret key and write it to the key file",
+					Action: secretKeygenCommand,
+					Flags:  []cli.Flag{secretKeyFileFlag},
+				},
+				{
+					Name:   "encrypt",
+					Usage:  "encrypt YAML secrets from STDIN and write them to STDOUT",
+					Action: secretEncryptCommand,
+					Flags:  []cli.Flag{secretKeyFileFlag},
+				},
+				{
+					Name:   "decrypt",
+					Usage:  "decrypt secrets file from STDIN and write YAML secrets to STDOUT",
+					Action: secretDecryptCommand,
+					Flags:  []cli.Flag{secretKeyFileFlag},
+				},
+			},
+		},
 		dockerclient.InfoCommandSpec(),
 	}
 
@@ -241,11 +580,20 @@ func main() {
 }
 
 func runCommand(ctx *cli.Context) {
+	if ctx.String("hosts") != "" {
+		runHostsCommand(ctx)
+		return
+	}
+
 	ansibleResp := initAnsubleResp(ctx)
 
+	// failed runs are recorded to metrics as well
+	var metrics *compose.Metrics
+
 	// TODO: here we duplicate fatalf in both run(), pull() and clean()
 	// maybe refactor to make it cleaner
 	fatalf := func(err error) {
+		writeMetricsTextfile(ctx, metrics)
 		if ansibleResp != nil {
 			ansibleResp.Error(err).WriteTo(os.Stdout)
 		}
@@ -256,17 +604,46 @@ func runCommand(ctx *cli.Context) {
 
 	dockerCli := initDockerClient(ctx)
 	config := initComposeConfig(ctx, dockerCli)
+	applyLock(ctx, config)
 	auth := initAuthConfig(ctx)
+	mirrors := initMirrors(ctx)
+	history, revision := initHistory(ctx, config, "run")
+	events := initEvents(ctx)
+	notifier := initNotifier(ctx)
+	if ctx.String("metrics-textfile") != "" {
+		metrics = compose.NewMetrics(config.Namespace)
+	}
 
 	compose, err := compose.New(&compose.Config{
-		Manifest: config,
-		Docker:   dockerCli,
-		Force:    ctx.Bool("force"),
-		DryRun:   ctx.Bool("dry"),
-		Attach:   ctx.Bool("attach"),
-		Wait:     ctx.Duration("wait"),
-		Pull:     ctx.Bool("pull"),
-		Auth:     auth,
+		Manifest:   config,
+		Docker:     dockerCli,
+		DockerHost: dockerclient.NewConfigFromCli(ctx).Host,
+		Force:      ctx.Bool("force"),
+		DryRun:     ctx.Bool("dry"),
+		Attach:     ctx.Bool("attach"),
+		Wait:       ctx.Duration("wait"),
+		Pull:       ctx.Bool("pull"),
+		Build:      ctx.Bool("build"),
+		Auth:       auth,
+
+		PullConcurrency: ctx.Int("pull-concurrency"),
+		PullRetries:     ctx.Int("pull-retries"),
+
+		Mirrors: mirrors,
+
+		LockHolder:  compose.NewDeployLockHolder("run"),
+		LockTTL:     ctx.Duration("lock-ttl"),
+		LockTimeout: ctx.Duration("lock-timeout"),
+
+		History:  history,
+		Revision: revision,
+
+		Events:   events,
+		Metrics:  metrics,
+		Notifier: notifier,
+
+		StateDir: ctx.String("state-dir"),
+		Resume:   ctx.Bool("resume"),
 	})
 
 	if err != nil {
@@ -275,7 +652,7 @@ func runCommand(ctx *cli.Context) {
 
 	// in case of --force given, first remove all existing containers
 	if ctx.Bool("force") {
-		if err := doRemove(ctx, config, dockerCli, auth); err != nil {
+		if err := doRemove(ctx, config, dockerCli, auth, events, notifier); err != nil {
 			fatalf(err)
 		}
 	}
@@ -283,6 +660,7 @@ func runCommand(ctx *cli.Context) {
 	if err := compose.RunAction(); err != nil {
 		fatalf(err)
 	}
+	writeMetricsTextfile(ctx, metrics)
 
 	if ansibleResp != nil {
 		// ansibleResp.Success("done hehe").WriteTo(os.Stdout)
@@ -290,6 +668,116 @@ func runCommand(ctx *cli.Context) {
 	}
 }
 
+// runHostsCommand runs the manifest on hosts of the inventory in batches, the manifest
+// is rendered for every host with its vars
+func runHostsCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	if ctx.Bool("ansible") || ctx.Bool("attach") {
+		log.Fatal("--ansible and --attach cannot be used with --hosts")
+	}
+	if ctx.String("file") == "-" {
+		log.Fatal("Manifest cannot be read from STDIN with --hosts, it is rendered for every host")
+	}
+	if ctx.String("inventory") == "" {
+		log.Fatal("Inventory is not given, use --inventory")
+	}
+
+	inventory, err := compose.ReadInventory(ctx.String("inventory"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	hosts, err := inventory.Match(strings.Split(ctx.String("hosts"), ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auth := initAuthConfig(ctx)
+	mirrors := initMirrors(ctx)
+	events := initEvents(ctx)
+	notifier := initNotifier(ctx)
+
+	// the namespace of metrics is known once the manifest is rendered
+	var (
+		metrics     *compose.Metrics
+		metricsOnce sync.Once
+	)
+
+	rollout := &compose.Rollout{
+		Hosts:       hosts,
+		BatchSize:   ctx.Int("batch-size"),
+		MaxFailures: ctx.Int("max-failures"),
+		Deploy: func(host *compose.Host) ([]string, error) {
+			dockerCli, err := dockerclient.NewFromConfig(host.DockerConfig())
+			if err != nil {
+				return nil, err
+			}
+			if err := dockerclient.Ping(dockerCli, 5000); err != nil {
+				return nil, err
+			}
+
+			manifest, err := readComposeConfigVars(ctx, dockerCli, host.Vars)
+			if err != nil {
+				return nil, err
+			}
+			if err := readLock(ctx, manifest); err != nil {
+				return nil, err
+			}
+			if ctx.String("metrics-textfile") != "" {
+				metricsOnce.Do(func() { metrics = compose.NewMetrics(manifest.Namespace) })
+			}
+
+			hostEvents := events.WithHost(host.Name)
+			if ctx.Bool("force") {
+				if err := doRemove(ctx, manifest, dockerCli, auth, hostEvents, notifier); err != nil {
+					return nil, err
+				}
+			}
+
+			hostCompose, err := compose.New(&compose.Config{
+				Manifest:   manifest,
+				Docker:     dockerCli,
+				DockerHost: host.DockerConfig().Host,
+				Force:      ctx.Bool("force"),
+				DryRun:     ctx.Bool("dry"),
+				Wait:       ctx.Duration("wait"),
+				Pull:       ctx.Bool("pull"),
+				Build:      ctx.Bool("build"),
+				Auth:       auth,
+
+				PullConcurrency: ctx.Int("pull-concurrency"),
+				PullRetries:     ctx.Int("pull-retries"),
+
+				Mirrors: mirrors,
+
+				LockHolder:  compose.NewDeployLockHolder("run --hosts"),
+				LockTTL:     ctx.Duration("lock-ttl"),
+				LockTimeout: ctx.Duration("lock-timeout"),
+
+				Events:   hostEvents,
+				Metrics:  metrics,
+				Notifier: notifier,
+
+				StateDir: ctx.String("state-dir"),
+				Resume:   ctx.Bool("resume"),
+				Host:     host.Name,
+			})
+			if err != nil {
+				return nil, err
+			}
+			err = hostCompose.RunAction()
+			return hostCompose.Changes(), err
+		},
+	}
+
+	results, err := rollout.Run()
+	compose.WriteRolloutSummary(os.Stdout, results)
+	writeMetricsTextfile(ctx, metrics)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func pullCommand(ctx *cli.Context) {
 	ansibleResp := initAnsubleResp(ctx)
 
@@ -304,13 +792,23 @@ func pullCommand(ctx *cli.Context) {
 
 	dockerCli := initDockerClient(ctx)
 	config := initComposeConfig(ctx, dockerCli)
+	applyLock(ctx, config)
 	auth := initAuthConfig(ctx)
+	mirrors := initMirrors(ctx)
+	events := initEvents(ctx)
 
 	compose, err := compose.New(&compose.Config{
 		Manifest: config,
 		Docker:   dockerCli,
 		DryRun:   ctx.Bool("dry"),
 		Auth:     auth,
+
+		PullConcurrency: ctx.Int("pull-concurrency"),
+		PullRetries:     ctx.Int("pull-retries"),
+
+		Mirrors: mirrors,
+
+		Events: events,
 	})
 	if err != nil {
 		fatalf(err)
@@ -332,8 +830,10 @@ func rmCommand(ctx *cli.Context) {
 	dockerCli := initDockerClient(ctx)
 	config := initComposeConfig(ctx, dockerCli)
 	auth := initAuthConfig(ctx)
+	events := initEvents(ctx)
+	notifier := initNotifier(ctx)
 
-	if err := doRemove(ctx, config, dockerCli, auth); err != nil {
+	if err := doRemove(ctx, config, dockerCli, auth, events, notifier); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -352,8 +852,15 @@ func cleanCommand(ctx *cli.Context) {
 
 	dockerCli := initDockerClient(ctx)
 	config := initComposeConfig(ctx, dockerCli)
+	applyLock(ctx, config)
 	auth := initAuthConfig(ctx)
 
+	// untagged images recorded by revisions are kept, so that they can be rolled back to
+	history, err := compose.NewHistory(ctx.String("history-dir"), config.Namespace)
+	if err != nil {
+		fatalf(err)
+	}
+
 	compose, err := compose.New(&compose.Config{
 		Manifest:   config,
 		Docker:     dockerCli,
@@ -361,6 +868,10 @@ func cleanCommand(ctx *cli.Context) {
 		Remove:     true,
 		Auth:       auth,
 		KeepImages: ctx.Int("keep"),
+		History:    history,
+
+		CleanOlderThan: ctx.Duration("older-than"),
+		CleanKeepTags:  ctx.StringSlice("keep-tag"),
 	})
 	if err != nil {
 		fatalf(err)
@@ -386,6 +897,7 @@ func pinCommand(ctx *cli.Context) {
 		format = ctx.String("type")
 		local  = ctx.BoolT("local")
 		hub    = ctx.BoolT("hub")
+		digest = ctx.Bool("digest")
 		fd     = os.Stdout
 	)
 
@@ -396,20 +908,59 @@ func pinCommand(ctx *cli.Context) {
 	dockerCli := initDockerClient(ctx)
 	config := initComposeConfig(ctx, dockerCli)
 	auth := initAuthConfig(ctx)
+	mirrors := initMirrors(ctx)
+
+	var (
+		lockFile       string
+		manifestHash   string
+		lock, prevLock *compose.Lock
+		update         = ctx.StringSlice("update")
+		err            error
+	)
+	if file := ctx.String("file"); file != "-" && !ctx.Bool("no-lock") {
+		lockFile = compose.LockPath(file)
+		if prevLock, err = compose.ReadLock(lockFile); err != nil {
+			log.Fatal(err)
+		}
+		if manifestHash, err = compose.HashManifest(file); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(update) > 0 && prevLock == nil {
+		log.Fatalf("Cannot update %s, there is no lock file to keep versions of other containers from, run pin without --update first",
+			strings.Join(update, ", "))
+	}
+	if len(update) == 0 {
+		// resolve everything again
+		prevLock = nil
+	}
 
 	compose, err := compose.New(&compose.Config{
 		Manifest: config,
 		Docker:   dockerCli,
 		Auth:     auth,
+
+		PullConcurrency: ctx.Int("pull-concurrency"),
+		PullRetries:     ctx.Int("pull-retries"),
+
+		Mirrors: mirrors,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if vars, err = compose.PinAction(local, hub); err != nil {
+	if vars, lock, err = compose.PinAction(local, hub, digest, prevLock, update); err != nil {
 		log.Fatal(err)
 	}
 
+	if lockFile != "" {
+		lock.ManifestHash = manifestHash
+		if err := lock.WriteFile(lockFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Written lock file %s", lockFile)
+	}
+
 	if output != "-" {
 		if fd, err = os.Create(output); err != nil {
 			log.Fatal(err)
@@ -439,35 +990,714 @@ func pinCommand(ctx *cli.Context) {
 	}
 }
 
-func recoverCommand(ctx *cli.Context) {
+func outdatedCommand(ctx *cli.Context) {
 	initLogs(ctx)
 
+	format := ctx.String("type")
+	if format != "table" && format != "json" {
+		log.Fatalf("Possible types are `table` and `json`, unknown type `%s`", format)
+	}
+	if format == "json" && !ctx.GlobalIsSet("verbose") {
+		log.SetLevel(log.WarnLevel)
+	}
+
 	dockerCli := initDockerClient(ctx)
+	config := initComposeConfig(ctx, dockerCli)
 	auth := initAuthConfig(ctx)
+	mirrors := initMirrors(ctx)
 
 	compose, err := compose.New(&compose.Config{
-		Docker:  dockerCli,
-		DryRun:  ctx.Bool("dry"),
-		Wait:    ctx.Duration("wait"),
-		Recover: true,
-		Auth:    auth,
+		Manifest: config,
+		Docker:   dockerCli,
+		Auth:     auth,
+		Mirrors:  mirrors,
 	})
-
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := compose.RecoverAction(); err != nil {
+	outdated, err := compose.OutdatedAction(ctx.BoolT("local"), ctx.BoolT("hub"), ctx.Bool("all"))
+	if err != nil {
 		log.Fatal(err)
 	}
-}
 
-func initLogs(ctx *cli.Context) {
-	logger := log.StandardLogger()
+	if format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(outdated); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	if ctx.GlobalBool("verbose") {
-		logger.Level = log.DebugLevel
-	} else if ctx.Bool("print") && ctx.GlobalString("log") == "" {
+	if len(outdated) == 0 {
+		log.Infof("All containers are up to date")
+		return
+	}
+
+	orNone := func(s, none string) string {
+		if s == "" {
+			return none
+		}
+		return s
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tIMAGE\tCURRENT\tWANTED\tLATEST")
+	for _, o := range outdated {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", o.Container, o.Image,
+			orNone(o.Current, "missing"), orNone(o.Wanted, "-"), orNone(o.Latest, "-"))
+	}
+	w.Flush()
+}
+
+func bundleSaveCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	output := ctx.String("output")
+	if output == "" {
+		log.Fatal("Path of the bundle should be given with --output")
+	}
+
+	dockerCli := initDockerClient(ctx)
+	config := initComposeConfig(ctx, dockerCli)
+	applyLock(ctx, config)
+	auth := initAuthConfig(ctx)
+	mirrors := initMirrors(ctx)
+
+	compose, err := compose.New(&compose.Config{
+		Manifest: config,
+		Docker:   dockerCli,
+		Auth:     auth,
+		Mirrors:  mirrors,
+
+		PullConcurrency: ctx.Int("pull-concurrency"),
+		PullRetries:     ctx.Int("pull-retries"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// write to a temporary file first, so a failed save does not leave a broken bundle
+	tmp := output + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	index, err := compose.BundleSaveAction(fd)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, output)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Fatal(err)
+	}
+
+	log.Infof("Saved %d images to %s: %s", len(index.Images), output, strings.Join(index.Names(), ", "))
+}
+
+func bundleLoadCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	input := ctx.String("input")
+	if input == "" {
+		log.Fatal("Path of the bundle should be given with --input")
+	}
+
+	fd, err := os.Open(input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fd.Close()
+
+	compose, err := compose.New(&compose.Config{
+		Docker: initDockerClient(ctx),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	index, err := compose.BundleLoadAction(fd)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Loaded %d images of %s made at %s", len(index.Images), input, index.CreatedAt.Format(time.RFC3339))
+}
+
+func historyCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	format := ctx.String("type")
+	if format != "table" && format != "json" {
+		log.Fatalf("Possible types are `table` and `json`, unknown type `%s`", format)
+	}
+	if format == "json" && !ctx.GlobalIsSet("verbose") {
+		log.SetLevel(log.WarnLevel)
+	}
+
+	config := initComposeConfig(ctx, initDockerClient(ctx))
+
+	history, err := compose.NewHistory(ctx.String("history-dir"), config.Namespace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	revisions, err := history.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(revisions); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(revisions) == 0 {
+		log.Infof("No revisions of namespace %s are recorded", config.Namespace)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tCREATED\tUSER\tHOST\tCOMMAND\tCHANGES\tIMAGES")
+	for _, rev := range revisions {
+		images := []string{}
+		for _, image := range rev.Images {
+			images = append(images, image.Image)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\n", rev.Number, rev.CreatedAt.Format(time.RFC3339),
+			rev.User, rev.Host, rev.Command, len(rev.Plan), strings.Join(images, ", "))
+	}
+	w.Flush()
+}
+
+func statusCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	format := ctx.String("type")
+	if format != "table" && format != "json" {
+		log.Fatalf("Invalid output format %s, expected table or json", format)
+	}
+
+	dockerCli := initDockerClient(ctx)
+	manifest := initComposeConfig(ctx, dockerCli)
+
+	compose, err := compose.New(&compose.Config{
+		Manifest: manifest,
+		Docker:   dockerCli,
+		Auth:     initAuthConfig(ctx),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	status, err := compose.Status()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	journal, err := readJournal(ctx, manifest.Namespace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if journal.Interrupted() {
+		log.Warnf("Previous %s was interrupted at %s, run `rocker-compose run --resume` to continue it",
+			journal, journal.Updated.Format(time.RFC3339))
+		for _, action := range journal.Running {
+			log.Warnf("Interrupted: %s", action)
+		}
+		for _, action := range journal.Remaining() {
+			log.Warnf("Not started: %s", action)
+		}
+	} else if journal != nil && journal.Error != "" {
+		log.Warnf("Previous %s failed: %s", journal, journal.Error)
+	}
+
+	if format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(status); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tIMAGE\tSTATE")
+	for _, c := range status {
+		state := fmt.Sprintf("Up since %s", c.StartedAt.Format(time.RFC3339))
+		if !c.Running {
+			state = fmt.Sprintf("Exited (%d) at %s", c.ExitCode, c.FinishedAt.Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "%s\t%.12s\t%s\t%s\n", c.Name, c.ID, c.Image, state)
+	}
+	w.Flush()
+}
+
+// readJournal reads the journal of the last deploy of the namespace from --state-dir, nil if there is none
+func readJournal(ctx *cli.Context, namespace string) (*compose.JournalState, error) {
+	if ctx.String("state-dir") == "" {
+		return nil, nil
+	}
+	return compose.ReadJournal(ctx.String("state-dir"), namespace, "")
+}
+
+func rollbackCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	dockerCli := initDockerClient(ctx)
+	current := initComposeConfig(ctx, dockerCli)
+	auth := initAuthConfig(ctx)
+	mirrors := initMirrors(ctx)
+	events := initEvents(ctx)
+	notifier := initNotifier(ctx)
+
+	history, err := compose.NewHistory(ctx.String("history-dir"), current.Namespace)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var rev *compose.Revision
+	if ctx.IsSet("to") {
+		rev, err = history.Get(ctx.Int("to"))
+	} else {
+		rev, err = history.Previous()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	funcs, err := initTemplateFuncs(ctx, dockerCli)
+	if err != nil {
+		log.Fatal(err)
+	}
+	manifest, err := compose.RollbackManifest(rev, current.Vars, funcs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	compose, err := compose.New(&compose.Config{
+		Manifest: manifest,
+		Docker:   dockerCli,
+		DryRun:   ctx.Bool("dry"),
+		Wait:     ctx.Duration("wait"),
+		Auth:     auth,
+		Mirrors:  mirrors,
+
+		PullConcurrency: ctx.Int("pull-concurrency"),
+		PullRetries:     ctx.Int("pull-retries"),
+
+		LockHolder:  compose.NewDeployLockHolder("rollback"),
+		LockTTL:     ctx.Duration("lock-ttl"),
+		LockTimeout: ctx.Duration("lock-timeout"),
+
+		History:  history,
+		Revision: compose.NewRevision(fmt.Sprintf("rollback --to %d", rev.Number), rev.ManifestFile, rev.Source),
+
+		Events:   events,
+		Notifier: notifier,
+
+		StateDir: ctx.String("state-dir"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := compose.RollbackAction(rev); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func forceUnlockCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	dockerCli := initDockerClient(ctx)
+	config := initComposeConfig(ctx, dockerCli)
+
+	compose, err := compose.New(&compose.Config{
+		Manifest: config,
+		Docker:   dockerCli,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lock, err := compose.ForceUnlockAction()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if lock == nil {
+		log.Infof("Namespace %s is not locked", config.Namespace)
+		return
+	}
+	log.Infof("Removed deploy lock of namespace %s held by %s since %s",
+		config.Namespace, lock.Holder, lock.AcquiredAt.Format(time.RFC3339))
+}
+
+func watchCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	file := ctx.String("file")
+	if file == "-" {
+		log.Fatal("Cannot watch the manifest read from STDIN, give the file with --file")
+	}
+
+	// vars files given by patterns are matched once
+	files := []string{file}
+	for _, pattern := range ctx.StringSlice("vars") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, matches...)
+	}
+	if !ctx.Bool("no-lock") {
+		files = append(files, compose.LockPath(file))
+	}
+
+	dockerCli := initDockerClient(ctx)
+	manifest := initComposeConfig(ctx, dockerCli)
+	applyLock(ctx, manifest)
+	auth := initAuthConfig(ctx)
+	mirrors := initMirrors(ctx)
+	events := initEvents(ctx)
+	notifier := initNotifier(ctx)
+	metrics := serveMetrics(ctx, manifest)
+
+	watcher := &compose.Watcher{
+		Files: files,
+		Load: func() (*config.Config, error) {
+			manifest, err := readComposeConfig(ctx, dockerCli)
+			if err != nil {
+				return nil, err
+			}
+			if err := readLock(ctx, manifest); err != nil {
+				return nil, err
+			}
+			return manifest, nil
+		},
+		Debounce:     ctx.Duration("debounce"),
+		PollInterval: ctx.Duration("poll-interval"),
+		MaxBackoff:   ctx.Duration("max-backoff"),
+	}
+
+	compose, err := compose.New(&compose.Config{
+		Manifest: manifest,
+		Docker:   dockerCli,
+		DryRun:   ctx.Bool("dry"),
+		Wait:     ctx.Duration("wait"),
+		Recover:  true,
+		Auth:     auth,
+		Mirrors:  mirrors,
+
+		PullConcurrency: ctx.Int("pull-concurrency"),
+		PullRetries:     ctx.Int("pull-retries"),
+
+		LockHolder:  compose.NewDeployLockHolder("watch"),
+		LockTTL:     ctx.Duration("lock-ttl"),
+		LockTimeout: ctx.Duration("lock-timeout"),
+
+		Events:   events,
+		Metrics:  metrics,
+		Notifier: notifier,
+
+		StateDir: ctx.String("state-dir"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	watcher.Compose = compose
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Got %s, stopping", sig)
+		close(stop)
+	}()
+
+	if err := watcher.Run(stop); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serveCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	root := ctx.String("root")
+	if root == "" {
+		log.Fatal("Directory of manifests is not given, use --root")
+	}
+	if ctx.String("tokens-file") == "" {
+		log.Fatal("API tokens are not given, use --tokens-file")
+	}
+	addr, cert, key := ctx.String("addr"), ctx.String("tls-cert"), ctx.String("tls-key")
+	if (cert == "") != (key == "") {
+		log.Fatal("Both --tls-cert and --tls-key should be given")
+	}
+	// tokens and vars are secrets, they should not travel over the network in cleartext
+	if cert == "" && !isLoopbackAddr(addr) {
+		log.Fatalf("Refusing to serve the API on %s without TLS, use --tls-cert and --tls-key or a loopback address", addr)
+	}
+	tokens, err := compose.ReadTokensFile(ctx.String("tokens-file"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dockerCli := initDockerClient(ctx)
+	if err := dockerclient.Ping(dockerCli, 5000); err != nil {
+		log.Fatal(err)
+	}
+
+	server := compose.NewServer(root, &compose.Config{
+		Docker: dockerCli,
+		Wait:   ctx.Duration("wait"),
+		Auth:   initAuthConfig(ctx),
+
+		PullConcurrency: ctx.Int("pull-concurrency"),
+		PullRetries:     ctx.Int("pull-retries"),
+
+		Mirrors: initMirrors(ctx),
+
+		LockTTL:     ctx.Duration("lock-ttl"),
+		LockTimeout: ctx.Duration("lock-timeout"),
+
+		Notifier: initNotifier(ctx),
+	}, tokens)
+	server.HistoryDir = ctx.String("history-dir")
+	server.Funcs = func() (map[string]interface{}, error) {
+		return initTemplateFuncs(ctx, dockerCli)
+	}
+
+	if file := ctx.String("audit-log"); file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open audit log %s, error: %s", file, err)
+		}
+		defer f.Close()
+		server.Audit = f
+	}
+
+	httpServer := &http.Server{
+		Addr:         addr,
+		Handler:      server.Handler(),
+		ReadTimeout:  ctx.Duration("read-timeout"),
+		WriteTimeout: ctx.Duration("write-timeout"),
+	}
+
+	log.Infof("Serving manifests of %s on %s", root, addr)
+	if cert != "" {
+		err = httpServer.ListenAndServeTLS(cert, key)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// isLoopbackAddr tells whether the listen address is reachable from this machine only
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ansibleModuleCommand runs or removes the manifest given by arguments of the Ansible module,
+// only the JSON response is written to STDOUT
+func ansibleModuleCommand(ctx *cli.Context) {
+	resp := &ansible.Response{}
+	log.SetOutput(os.Stderr)
+
+	fatalf := func(err error) {
+		resp.Error(err).WriteTo(os.Stdout)
+		os.Exit(1)
+	}
+
+	if len(ctx.Args()) != 1 {
+		fatalf(fmt.Errorf("Expected the file of module arguments, usage: rocker-compose ansible-module ARGSFILE"))
+	}
+	args, err := ansible.ReadModuleArgs(ctx.Args().First())
+	if err != nil {
+		fatalf(err)
+	}
+	wait, err := args.WaitDuration()
+	if err != nil {
+		fatalf(err)
+	}
+
+	initLogs(ctx)
+
+	dockerCli := initDockerClient(ctx)
+	if err := dockerclient.Ping(dockerCli, 5000); err != nil {
+		fatalf(err)
+	}
+
+	secretProvider := ctx.String("secret-provider")
+	if args.SecretProvider != "" {
+		secretProvider = args.SecretProvider
+	}
+	funcs, err := templateFuncs(dockerCli, secretProvider)
+	if err != nil {
+		fatalf(err)
+	}
+
+	manifest, err := config.NewFromFile(args.File, template.Vars(args.Vars), funcs, false)
+	if err != nil {
+		fatalf(err)
+	}
+	manifest.Profiles = args.Profiles
+	if !ctx.Bool("no-lock") {
+		if err := readLockFile(args.File, manifest); err != nil {
+			fatalf(err)
+		}
+	}
+
+	compose, err := compose.New(&compose.Config{
+		Manifest: manifest,
+		Docker:   dockerCli,
+		DryRun:   args.CheckMode,
+		Remove:   args.State == ansible.StateAbsent,
+		Wait:     wait,
+		Pull:     bool(args.Pull),
+		Auth:     initAuthConfig(ctx),
+
+		PullConcurrency: ctx.Int("pull-concurrency"),
+		PullRetries:     ctx.Int("pull-retries"),
+
+		Mirrors: initMirrors(ctx),
+
+		LockHolder:  compose.NewDeployLockHolder("ansible-module"),
+		LockTTL:     ctx.Duration("lock-ttl"),
+		LockTimeout: ctx.Duration("lock-timeout"),
+
+		Events:   initEvents(ctx),
+		Notifier: initNotifier(ctx),
+
+		StateDir: ctx.String("state-dir"),
+	})
+	if err != nil {
+		fatalf(err)
+	}
+
+	if err := compose.RunAction(); err != nil {
+		fatalf(err)
+	}
+
+	compose.WritePlan(resp)
+	if args.Diff {
+		compose.WriteDiff(resp)
+	}
+	resp.WriteTo(os.Stdout)
+}
+
+func recoverCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	log.Warnf("recover is deprecated, use `rocker-compose watch` to keep containers running")
+
+	dockerCli := initDockerClient(ctx)
+	auth := initAuthConfig(ctx)
+
+	compose, err := compose.New(&compose.Config{
+		Docker:  dockerCli,
+		DryRun:  ctx.Bool("dry"),
+		Wait:    ctx.Duration("wait"),
+		Recover: true,
+		Auth:    auth,
+	})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := compose.RecoverAction(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func secretKeygenCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	keyFile, err := homedir.Expand(ctx.String("keyfile"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stat(keyFile); err == nil {
+		log.Fatalf("Key file %s already exists, remove it first if you want to replace the key", keyFile)
+	}
+
+	key, err := secret.GenerateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("Secret key is written to %s", keyFile)
+}
+
+func secretEncryptCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	key, err := secret.ReadKeyFile(ctx.String("keyfile"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// validate the input, so we do not encrypt something we cannot read later
+	if err := yaml.Unmarshal(plain, &map[string]string{}); err != nil {
+		log.Fatalf("Secrets should be a YAML map of strings, error: %s", err)
+	}
+	data, err := secret.Encrypt(key, plain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stdout.Write(data); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func secretDecryptCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	key, err := secret.ReadKeyFile(ctx.String("keyfile"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plain, err := secret.Decrypt(key, data)
+	if err != nil {
+		log.Fatalf("Failed to decrypt secrets, error: %s", err)
+	}
+	if _, err := os.Stdout.Write(plain); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func initLogs(ctx *cli.Context) {
+	logger := log.StandardLogger()
+
+	if ctx.GlobalBool("verbose") {
+		logger.Level = log.DebugLevel
+	} else if ctx.Bool("print") && ctx.GlobalString("log") == "" {
 		logger.Level = log.ErrorLevel
 	}
 
@@ -504,51 +1734,63 @@ func initLogs(ctx *cli.Context) {
 }
 
 func initComposeConfig(ctx *cli.Context, dockerCli *docker.Client) *config.Config {
+	manifest, err := readComposeConfig(ctx, dockerCli)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Check the docker connection before we actually run
+	if err := dockerclient.Ping(dockerCli, 5000); err != nil {
+		log.Fatal(err)
+	}
+
+	return manifest
+}
+
+// readComposeConfig reads and renders the manifest given by --file with variables
+// given by --var and --vars
+func readComposeConfig(ctx *cli.Context, dockerCli *docker.Client) (*config.Config, error) {
+	return readComposeConfigVars(ctx, dockerCli, nil)
+}
+
+// readComposeConfigVars renders the manifest with extra variables overriding the ones
+// given by --var and --vars, e.g. vars of the inventory host
+func readComposeConfigVars(ctx *cli.Context, dockerCli *docker.Client, extra template.Vars) (*config.Config, error) {
 	file := ctx.String("file")
 
 	if file == "" {
-		log.Fatalf("Manifest file is empty")
-		os.Exit(1)
+		return nil, fmt.Errorf("Manifest file is empty")
 	}
 
 	var (
 		manifest *config.Config
 		err      error
-		bridgeIP *string
 		print    = ctx.Bool("print")
 	)
 
 	vars, err := template.VarsFromFileMulti(ctx.StringSlice("vars"))
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	cliVars, err := template.VarsFromStrings(ctx.StringSlice("var"))
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return nil, err
 	}
 
-	vars = vars.Merge(cliVars)
+	vars = vars.Merge(cliVars, extra)
 
 	if ctx.Bool("demand-artifacts") {
 		vars["DemandArtifacts"] = true
 	}
 
-	// TODO: find better place for providing this helper
-	funcs := map[string]interface{}{
-		// lazy get bridge ip
-		"bridgeIp": func() (ip string, err error) {
-			if bridgeIP == nil {
-				ip, err = compose.GetBridgeIP(dockerCli)
-				if err != nil {
-					return "", err
-				}
-				bridgeIP = &ip
-			}
-			return *bridgeIP, nil
-		},
+	if ctx.IsSet("secret-store") {
+		vars["SecretStore"] = ctx.String("secret-store")
+	}
+
+	funcs, err := initTemplateFuncs(ctx, dockerCli)
+	if err != nil {
+		return nil, err
 	}
 
 	if file == "-" {
@@ -563,16 +1805,75 @@ func initComposeConfig(ctx *cli.Context, dockerCli *docker.Client) *config.Confi
 		manifest, err = config.NewFromFile(file, vars, funcs, print)
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Profiles = ctx.StringSlice("profile")
+
+	return manifest, nil
+}
+
+// initTemplateFuncs returns helpers for rendering manifests that need the docker client
+// or the secret provider
+func initTemplateFuncs(ctx *cli.Context, dockerCli *docker.Client) (map[string]interface{}, error) {
+	return templateFuncs(dockerCli, ctx.String("secret-provider"))
+}
+
+// templateFuncs returns helpers for rendering manifests with the secret provider given by spec
+func templateFuncs(dockerCli *docker.Client, spec string) (map[string]interface{}, error) {
+	var (
+		secretProvider secret.Provider
+		bridgeIP       *string
+		err            error
+	)
+	if spec != "" {
+		if secretProvider, err = secret.NewProvider(spec); err != nil {
+			return nil, err
+		}
+	}
+
+	// TODO: find better place for providing this helper
+	funcs := compose.ContainerHelpers(dockerCli)
+	funcs["secret"] = secret.TemplateHelper(secretProvider)
+	// lazy get bridge ip
+	funcs["bridgeIp"] = func() (ip string, err error) {
+		if bridgeIP == nil {
+			ip, err = compose.GetBridgeIP(dockerCli)
+			if err != nil {
+				return "", err
+			}
+			bridgeIP = &ip
+		}
+		return *bridgeIP, nil
+	}
+
+	return funcs, nil
+}
+
+// initHistory returns the history of the namespace and the revision to record for the command,
+// manifests read from STDIN are not recorded since they cannot be rolled back
+func initHistory(ctx *cli.Context, manifest *config.Config, command string) (*compose.History, *compose.Revision) {
+	file := ctx.String("file")
+	if file == "-" {
+		log.Debugf("Manifest is read from STDIN, the run is not recorded to the history")
+		return nil, nil
+	}
+
+	history, err := compose.NewHistory(ctx.String("history-dir"), manifest.Namespace)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Check the docker connection before we actually run
-	if err := dockerclient.Ping(dockerCli, 5000); err != nil {
+	if file, err = filepath.Abs(file); err != nil {
+		log.Fatal(err)
+	}
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	return manifest
+	return history, compose.NewRevision(command, file, string(source))
 }
 
 func initDockerClient(ctx *cli.Context) *docker.Client {
@@ -583,6 +1884,46 @@ func initDockerClient(ctx *cli.Context) *docker.Client {
 	return dockerClient
 }
 
+// applyLock makes the manifest use versions from the lock file next to it, if there is one
+func applyLock(ctx *cli.Context, manifest *config.Config) {
+	if err := readLock(ctx, manifest); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readLock(ctx *cli.Context, manifest *config.Config) error {
+	file := ctx.String("file")
+	if file == "-" || ctx.Bool("no-lock") {
+		return nil
+	}
+	return readLockFile(file, manifest)
+}
+
+// readLockFile applies versions from the lock file next to the manifest file, if there is one
+func readLockFile(file string, manifest *config.Config) error {
+	lockFile := compose.LockPath(file)
+	lock, err := compose.ReadLock(lockFile)
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		return nil
+	}
+
+	hash, err := compose.HashManifest(file)
+	if err != nil {
+		return err
+	}
+	if hash != lock.ManifestHash {
+		log.Warnf("Manifest %s has changed since %s was written at %s, run `rocker-compose pin` to update it",
+			file, lockFile, lock.ResolvedAt.Format(time.RFC3339))
+	}
+
+	log.Infof("Using versions from %s", lockFile)
+	lock.Apply(manifest)
+	return nil
+}
+
 func initAuthConfig(ctx *cli.Context) *compose.AuthConfig {
 	auth := &compose.AuthConfig{}
 	authParam := globalString(ctx, "auth")
@@ -591,10 +1932,109 @@ func initAuthConfig(ctx *cli.Context) *compose.AuthConfig {
 		userPass := strings.Split(authParam, ":")
 		auth.Username = userPass[0]
 		auth.Password = userPass[1]
+		return auth
+	}
+
+	// per-registry credentials of the docker CLI
+	configPath, err := compose.DockerConfigPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if auth.DockerConfig, err = compose.ReadDockerConfig(configPath); err != nil {
+		log.Fatal(err)
 	}
 	return auth
 }
 
+// initMirrors reads mirror rules from --mirrors-file and --mirror, the latter take precedence
+func initMirrors(ctx *cli.Context) compose.Mirrors {
+	mirrors := compose.Mirrors{}
+	if file := ctx.String("mirrors-file"); file != "" {
+		fromFile, err := compose.ReadMirrorsFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mirrors = fromFile
+	}
+	rules, err := compose.NewMirrors(ctx.StringSlice("mirror"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return mirrors.Merge(rules)
+}
+
+// initEvents opens the stream of deploy progress events given by --events-file or --events-fd,
+// it is nil if neither is given
+func initEvents(ctx *cli.Context) *compose.EventStream {
+	if file := ctx.String("events-file"); file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open events file %s, error: %s", file, err)
+		}
+		return compose.NewEventStream(f)
+	}
+	if ctx.IsSet("events-fd") {
+		fd := ctx.Int("events-fd")
+		if fd < 0 {
+			log.Fatalf("Invalid --events-fd %d", fd)
+		}
+		return compose.NewEventStream(os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)))
+	}
+	return nil
+}
+
+// initNotifier reads the global notify config given by --notify-file, it is nil if it is not given
+func initNotifier(ctx *cli.Context) *compose.Notifier {
+	file := ctx.String("notify-file")
+	if file == "" {
+		return nil
+	}
+	notify, err := compose.ReadNotifyFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return compose.NewNotifier(notify)
+}
+
+// serveMetrics serves metrics of the namespace on --metrics-addr, it is nil if the address is not given
+func serveMetrics(ctx *cli.Context, manifest *config.Config) *compose.Metrics {
+	addr := ctx.String("metrics-addr")
+	if addr == "" {
+		return nil
+	}
+
+	// listen at once, so that a busy address fails the command
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to serve metrics on %s, error: %s", addr, err)
+	}
+
+	metrics := compose.NewMetrics(manifest.Namespace)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Errorf("Failed to serve metrics on %s, error: %s", addr, err)
+		}
+	}()
+	log.Infof("Serving metrics on http://%s/metrics", listener.Addr())
+
+	return metrics
+}
+
+// writeMetricsTextfile writes metrics to --metrics-textfile, the run is done anyway,
+// so failing to write them is not fatal
+func writeMetricsTextfile(ctx *cli.Context, metrics *compose.Metrics) {
+	file := ctx.String("metrics-textfile")
+	if metrics == nil || file == "" {
+		return
+	}
+	if err := metrics.WriteTextfile(file); err != nil {
+		log.Errorf("%s", err)
+	}
+}
+
 func initAnsubleResp(ctx *cli.Context) (ansibleResp *ansible.Response) {
 	if ctx.Bool("ansible") {
 		ansibleResp = &ansible.Response{}
@@ -607,13 +2047,22 @@ func initAnsubleResp(ctx *cli.Context) (ansibleResp *ansible.Response) {
 	return
 }
 
-func doRemove(ctx *cli.Context, config *config.Config, dockerCli *docker.Client, auth *compose.AuthConfig) error {
+func doRemove(ctx *cli.Context, config *config.Config, dockerCli *docker.Client, auth *compose.AuthConfig, events *compose.EventStream, notifier *compose.Notifier) error {
 	compose, err := compose.New(&compose.Config{
 		Manifest: config,
 		Docker:   dockerCli,
 		DryRun:   ctx.Bool("dry"),
 		Remove:   true,
 		Auth:     auth,
+
+		LockHolder:  compose.NewDeployLockHolder("rm"),
+		LockTTL:     ctx.Duration("lock-ttl"),
+		LockTimeout: ctx.Duration("lock-timeout"),
+
+		Events:   events,
+		Notifier: notifier,
+
+		StateDir: ctx.String("state-dir"),
 	})
 	if err != nil {
 		return err
@@ -30,6 +30,7 @@ type Action interface {
 
 type action struct {
 	container *Container
+	reason    string
 }
 type ensureContainerExist action
 type ensureContainerState action
@@ -98,6 +99,15 @@ func NewRemoveContainerAction(c *Container) Action {
 	return &removeContainer{container: c}
 }
 
+// NewRecreateContainerActions makes actions that remove the existing container
+// and run the expected one, the reason of recreation is shown in the plan
+func NewRecreateContainerActions(actual, expected *Container, reason string) []Action {
+	return []Action{
+		&removeContainer{container: actual, reason: reason},
+		&runContainer{container: expected, reason: reason},
+	}
+}
+
 // Execute runs the step
 func (a *stepAction) Execute(client Client) (err error) {
 	if a.async {
@@ -156,6 +166,9 @@ func (a *runContainer) Execute(client Client) (err error) {
 
 // String returns the printable string representation of the runContainer action.
 func (a *runContainer) String() string {
+	if a.reason != "" {
+		return fmt.Sprintf("Creating container '%s' (%s)", a.container.Name, a.reason)
+	}
 	return fmt.Sprintf("Creating container '%s'", a.container.Name)
 }
 
@@ -167,6 +180,9 @@ func (a *removeContainer) Execute(client Client) (err error) {
 
 // String returns the printable string representation of the removeContainer action.
 func (a *removeContainer) String() string {
+	if a.reason != "" {
+		return fmt.Sprintf("Removing container '%s' (%s)", a.container.Name, a.reason)
+	}
 	return fmt.Sprintf("Removing container '%s'", a.container.Name)
 }
 
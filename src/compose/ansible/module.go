@@ -0,0 +1,113 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ansible
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Values of ModuleArgs.State
+const (
+	StatePresent = "present"
+	StateAbsent  = "absent"
+)
+
+// ModuleArgs are arguments of rocker-compose running as an Ansible module, Ansible
+// passes them in a JSON file to modules having WANT_JSON in their source
+type ModuleArgs struct {
+	File           string                 `json:"file"`            // path of the manifest
+	Vars           map[string]interface{} `json:"vars"`            // vars of the manifest
+	Profiles       []string               `json:"profiles"`        // profiles to activate
+	State          string                 `json:"state"`           // present runs the manifest, absent removes its containers
+	Pull           Bool                   `json:"pull"`            // pull images before running
+	Wait           string                 `json:"wait"`            // wait and check exit codes of launched containers, e.g. 5s
+	SecretProvider string                 `json:"secret_provider"` // provider for the {{ secret }} helper
+
+	CheckMode bool `json:"_ansible_check_mode"`
+	Diff      bool `json:"_ansible_diff"`
+}
+
+// ReadModuleArgs reads and validates module arguments from the file given by Ansible
+func ReadModuleArgs(file string) (*ModuleArgs, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read module arguments %s, error: %s", file, err)
+	}
+	args := &ModuleArgs{}
+	if err := json.Unmarshal(data, args); err != nil {
+		return nil, fmt.Errorf("Failed to parse module arguments %s, the module should have WANT_JSON in its source, error: %s", file, err)
+	}
+
+	if args.File == "" {
+		return nil, fmt.Errorf("Argument file is required")
+	}
+	if args.State == "" {
+		args.State = StatePresent
+	}
+	if args.State != StatePresent && args.State != StateAbsent {
+		return nil, fmt.Errorf("Invalid state '%s', expected %s or %s", args.State, StatePresent, StateAbsent)
+	}
+	if _, err := args.WaitDuration(); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// WaitDuration returns the wait argument, 1s if it is not given
+func (args *ModuleArgs) WaitDuration() (time.Duration, error) {
+	if args.Wait == "" {
+		return time.Second, nil
+	}
+	d, err := time.ParseDuration(args.Wait)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid wait '%s', error: %s", args.Wait, err)
+	}
+	return d, nil
+}
+
+// Bool is a boolean argument, Ansible may give it as a string, e.g. "yes"
+type Bool bool
+
+// UnmarshalJSON parses booleans and their string forms
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = Bool(v)
+		return nil
+	case string:
+		switch strings.ToLower(v) {
+		case "yes", "true", "on", "1":
+			*b = true
+			return nil
+		case "no", "false", "off", "0", "":
+			*b = false
+			return nil
+		}
+	case nil:
+		*b = false
+		return nil
+	}
+	return fmt.Errorf("Invalid boolean value %s", data)
+}
@@ -0,0 +1,87 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ansible
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeArgs(t *testing.T, dir, content string) string {
+	file := filepath.Join(dir, "args")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadModuleArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-ansible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args, err := ReadModuleArgs(writeArgs(t, dir, `{
+		"file": "/etc/app/compose.yml",
+		"vars": {"version": "1.2.3", "replicas": 2},
+		"profiles": ["web"],
+		"pull": "yes",
+		"wait": "5s",
+		"_ansible_check_mode": true,
+		"_ansible_diff": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "/etc/app/compose.yml", args.File)
+	assert.Equal(t, "1.2.3", args.Vars["version"])
+	assert.Equal(t, []string{"web"}, args.Profiles)
+	assert.Equal(t, StatePresent, args.State)
+	assert.True(t, bool(args.Pull))
+	assert.True(t, args.CheckMode)
+	assert.True(t, args.Diff)
+
+	wait, err := args.WaitDuration()
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, wait)
+}
+
+func TestReadModuleArgsInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-ansible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, content := range []string{
+		`file=compose.yml`,
+		`{"state": "present"}`,
+		`{"file": "compose.yml", "state": "stopped"}`,
+		`{"file": "compose.yml", "wait": "soon"}`,
+		`{"file": "compose.yml", "pull": "maybe"}`,
+	} {
+		_, err := ReadModuleArgs(writeArgs(t, dir, content))
+		assert.Error(t, err, content)
+	}
+}
@@ -32,12 +32,30 @@ type Response struct {
 	Created []ResponseContainer `json:"created"`
 	Pulled  []string            `json:"pulled"`
 	Cleaned []string            `json:"cleaned"`
+
+	// Cleanable are images clean would remove, listed by dry runs instead of Cleaned
+	Cleanable []string `json:"cleanable,omitempty"`
+
+	// Reclaimed is the estimated number of bytes freed by clean
+	Reclaimed int64 `json:"reclaimed,omitempty"`
+
+	// Diff shows configs of changed containers in --diff mode of Ansible
+	Diff []Diff `json:"diff,omitempty"`
+}
+
+// Diff is the change of a container, configs are given as YAML
+type Diff struct {
+	BeforeHeader string `json:"before_header"`
+	AfterHeader  string `json:"after_header"`
+	Before       string `json:"before"`
+	After        string `json:"after"`
 }
 
 // ResponseContainer describes added or removed container
 type ResponseContainer struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Reason string `json:"reason,omitempty"`
 }
 
 // Error marks response as failed and store error message
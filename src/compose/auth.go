@@ -0,0 +1,273 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/mitchellh/go-homedir"
+)
+
+// dockerHubAuthKey is the key of Docker Hub credentials in the docker config file
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// DockerConfig holds registry credentials of the docker CLI config file (~/.docker/config.json).
+// Credentials are taken either from base64 encoded `auths` entries, or from
+// `credsStore` and `credHelpers` executables, e.g. docker-credential-osxkeychain.
+type DockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+
+	mu    sync.Mutex
+	cache map[string]*AuthConfig
+}
+
+type dockerConfigAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+// DockerConfigPath returns the path of the docker CLI config file, respecting $DOCKER_CONFIG
+func DockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	return homedir.Expand("~/.docker/config.json")
+}
+
+// ReadDockerConfig reads the docker CLI config file. An empty config is returned
+// if the file does not exist.
+func ReadDockerConfig(filename string) (*DockerConfig, error) {
+	cfg := &DockerConfig{}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read docker config %s, error: %s", filename, err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("Failed to parse docker config %s, error: %s", filename, err)
+	}
+
+	return cfg, nil
+}
+
+// Credentials returns credentials for the registry host, "" is for Docker Hub.
+// Nil is returned if there are no credentials for the registry.
+func (c *DockerConfig) Credentials(registry string) (*AuthConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if auth, ok := c.cache[registry]; ok {
+		return auth, nil
+	}
+
+	auth, err := c.credentials(registry)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.cache == nil {
+		c.cache = map[string]*AuthConfig{}
+	}
+	c.cache[registry] = auth
+
+	return auth, nil
+}
+
+func (c *DockerConfig) credentials(registry string) (*AuthConfig, error) {
+	host := normalizeRegistry(registry)
+
+	serverAddress := registry
+	if host == "docker.io" {
+		serverAddress = dockerHubAuthKey
+	}
+
+	// credential helper configured for the registry takes precedence over the store
+	helper := c.CredsStore
+	for key, h := range c.CredHelpers {
+		if normalizeRegistry(key) == host {
+			helper = h
+		}
+	}
+	if helper != "" {
+		return credentialHelperGet(helper, serverAddress)
+	}
+
+	for key, entry := range c.Auths {
+		if normalizeRegistry(key) != host {
+			continue
+		}
+		auth := &AuthConfig{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			Email:         entry.Email,
+			ServerAddress: serverAddress,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decode auth of %s in docker config, error: %s", key, err)
+			}
+			userPass := strings.SplitN(string(decoded), ":", 2)
+			if len(userPass) != 2 {
+				return nil, fmt.Errorf("Invalid auth of %s in docker config, should be user:password", key)
+			}
+			auth.Username, auth.Password = userPass[0], userPass[1]
+		}
+		return auth, nil
+	}
+
+	return nil, nil
+}
+
+// credentialHelperGet runs `docker-credential-<helper> get` with the server address on STDIN
+func credentialHelperGet(helper, serverAddress string) (*AuthConfig, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// helpers report missing credentials with a message rather than a special exit code
+		if strings.Contains(stdout.String()+stderr.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to get credentials for %s from docker-credential-%s, error: %s %s",
+			serverAddress, helper, err, strings.TrimSpace(stderr.String()))
+	}
+
+	resp := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("Failed to parse response of docker-credential-%s, error: %s", helper, err)
+	}
+
+	// identity tokens are not supported by the docker client library we use
+	if resp.Username == "<token>" {
+		log.Debugf("Skipping identity token of docker-credential-%s for %s", helper, serverAddress)
+		return nil, nil
+	}
+
+	return &AuthConfig{
+		Username:      resp.Username,
+		Password:      resp.Secret,
+		ServerAddress: serverAddress,
+	}, nil
+}
+
+// normalizeRegistry strips the scheme and path of the registry address,
+// Docker Hub aliases are turned into "docker.io"
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	if i := strings.Index(registry, "/"); i >= 0 {
+		registry = registry[:i]
+	}
+	switch registry {
+	case "", "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return registry
+}
+
+// ForImage returns credentials for the registry of the given image. Credentials
+// given explicitly (--auth) are used for all registries, otherwise they are taken
+// from the docker config.
+func (a *AuthConfig) ForImage(image *imagename.ImageName) *AuthConfig {
+	if a == nil || a.Username != "" || a.DockerConfig == nil {
+		return a
+	}
+
+	auth, err := a.DockerConfig.Credentials(image.Registry)
+	if err != nil {
+		log.Warnf("%s", err)
+		return nil
+	}
+
+	return auth
+}
+
+// DockerAPIForImage is a shortcut for ForImage(image).ToDockerAPI()
+func (a *AuthConfig) DockerAPIForImage(image *imagename.ImageName) *docker.AuthConfiguration {
+	return a.ForImage(image).ToDockerAPI()
+}
+
+// ForRegistries returns credentials for the given registry hosts, keyed the way the
+// X-Registry-Config header of Docker build expects. Registries known to the docker
+// config are added, so that images of unknown registries, e.g. given by build args, are covered too.
+func (a *AuthConfig) ForRegistries(registries []string) docker.AuthConfigurations119 {
+	auths := docker.AuthConfigurations119{}
+	if a == nil {
+		return auths
+	}
+
+	if a.Username == "" && a.DockerConfig != nil {
+		for registry := range a.DockerConfig.Auths {
+			registries = append(registries, registry)
+		}
+		for registry := range a.DockerConfig.CredHelpers {
+			registries = append(registries, registry)
+		}
+	}
+
+	for _, registry := range registries {
+		key := normalizeRegistry(registry)
+		if key == "docker.io" {
+			key, registry = dockerHubAuthKey, ""
+		}
+		if _, ok := auths[key]; ok {
+			continue
+		}
+
+		auth := a
+		if a.Username == "" && a.DockerConfig != nil {
+			var err error
+			if auth, err = a.DockerConfig.Credentials(registry); err != nil {
+				log.Warnf("%s", err)
+				continue
+			}
+		}
+		if auth == nil || auth.Username == "" {
+			continue
+		}
+		auths[key] = *auth.ToDockerAPI()
+	}
+
+	return auths
+}
@@ -0,0 +1,155 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeDockerConfig(t *testing.T, dir, data string) *DockerConfig {
+	filename := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadDockerConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestDockerConfigAuths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hub := base64.StdEncoding.EncodeToString([]byte("hubuser:hubpass"))
+	quay := base64.StdEncoding.EncodeToString([]byte("quayuser:quay:pass"))
+
+	cfg := writeDockerConfig(t, dir, `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+hub+`"},
+		"https://quay.io": {"auth": "`+quay+`"}
+	}}`)
+
+	auth, err := cfg.Credentials("")
+	assert.Nil(t, err)
+	assert.Equal(t, &AuthConfig{Username: "hubuser", Password: "hubpass", ServerAddress: dockerHubAuthKey}, auth)
+
+	auth, err = cfg.Credentials("quay.io")
+	assert.Nil(t, err)
+	assert.Equal(t, &AuthConfig{Username: "quayuser", Password: "quay:pass", ServerAddress: "quay.io"}, auth)
+
+	auth, err = cfg.Credentials("registry.example.com")
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+
+	// explicit credentials are used for all registries
+	global := &AuthConfig{Username: "user", Password: "pass", DockerConfig: cfg}
+	assert.Equal(t, global, global.ForImage(imagename.NewFromString("quay.io/myapp:1.0")))
+
+	fromConfig := &AuthConfig{DockerConfig: cfg}
+	assert.Equal(t, "quayuser", fromConfig.ForImage(imagename.NewFromString("quay.io/myapp:1.0")).Username)
+	assert.Equal(t, "hubuser", fromConfig.DockerAPIForImage(imagename.NewFromString("redis:3.0")).Username)
+	assert.Equal(t, "", fromConfig.DockerAPIForImage(imagename.NewFromString("registry.example.com/app")).Username)
+}
+
+func TestDockerConfigCredHelpers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	helper := `#!/bin/sh
+read server
+if [ "$server" = "registry.example.com" ]; then
+  echo '{"ServerURL": "registry.example.com", "Username": "helperuser", "Secret": "helpersecret"}'
+else
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := writeDockerConfig(t, dir, `{"credHelpers": {"registry.example.com": "test"}, "credsStore": "missing"}`)
+
+	auth, err := cfg.Credentials("registry.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, &AuthConfig{Username: "helperuser", Password: "helpersecret", ServerAddress: "registry.example.com"}, auth)
+
+	// the store is used for all other registries
+	_, err = cfg.Credentials("quay.io")
+	assert.Contains(t, err.Error(), "docker-credential-missing")
+
+	cfg = writeDockerConfig(t, dir, `{"credsStore": "test"}`)
+	auth, err = cfg.Credentials("quay.io")
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+}
+
+func TestReadDockerConfigMissing(t *testing.T) {
+	cfg, err := ReadDockerConfig("/nonexisting/config.json")
+	assert.Nil(t, err)
+	auth, err := cfg.Credentials("quay.io")
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+}
+
+func TestAuthConfigForRegistries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hub := base64.StdEncoding.EncodeToString([]byte("hubuser:hubpass"))
+	quay := base64.StdEncoding.EncodeToString([]byte("quayuser:quaypass"))
+
+	cfg := writeDockerConfig(t, dir, `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+hub+`"},
+		"https://quay.io": {"auth": "`+quay+`"}
+	}}`)
+
+	// registries of the docker config are always included, unknown ones are skipped
+	fromConfig := &AuthConfig{DockerConfig: cfg}
+	assert.Equal(t, docker.AuthConfigurations119{
+		dockerHubAuthKey: {Username: "hubuser", Password: "hubpass", ServerAddress: dockerHubAuthKey},
+		"quay.io":        {Username: "quayuser", Password: "quaypass", ServerAddress: "https://quay.io"},
+	}, fromConfig.ForRegistries([]string{"", "registry.example.com"}))
+
+	global := &AuthConfig{Username: "user", Password: "pass", DockerConfig: cfg}
+	assert.Equal(t, docker.AuthConfigurations119{
+		"registry.example.com": {Username: "user", Password: "pass"},
+	}, global.ForRegistries([]string{"registry.example.com"}))
+
+	var none *AuthConfig
+	assert.Empty(t, none.ForRegistries([]string{""}))
+}
@@ -0,0 +1,456 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/term"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/fsouza/go-dockerclient/external/github.com/docker/docker/pkg/archive"
+	"github.com/fsouza/go-dockerclient/external/github.com/docker/docker/pkg/fileutils"
+	"github.com/grammarly/rocker/src/rocker/dockerclient"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/mitchellh/go-homedir"
+)
+
+// DefaultBuildCacheFile is where hashes of build contexts of images built
+// by `run --build` are kept, to skip builds when nothing has changed
+const DefaultBuildCacheFile = "~/.rocker-compose/builds.json"
+
+// buildCacheEntry is the hash of the context the image was built from and the resulting image id
+type buildCacheEntry struct {
+	Hash    string `json:"hash"`
+	ImageID string `json:"image_id"`
+}
+
+// BuildImages builds images of containers having the build key and tags them with the
+// image names of the containers, so they are picked up as local images afterwards.
+// The build is skipped if the context has not changed since the image was built last time.
+func (client *DockerClient) BuildImages(containers []*Container) error {
+	cacheFile := client.BuildCacheFile
+	if cacheFile == "" {
+		cacheFile = DefaultBuildCacheFile
+	}
+	cacheFile, err := homedir.Expand(cacheFile)
+	if err != nil {
+		return err
+	}
+
+	cache, err := readBuildCache(cacheFile)
+	if err != nil {
+		return err
+	}
+
+	built := map[string]struct{}{}
+	changed := false
+
+	for _, container := range containers {
+		if container.Config == nil || container.Config.Build == nil {
+			continue
+		}
+		build := container.Config.Build
+
+		image := container.Image
+		if image == nil || !image.IsStrict() || image.TagIsSha() {
+			return fmt.Errorf("Image %s of container %s should have a strict tag to be built", image, container.Name)
+		}
+
+		// the same image may be shared by several containers
+		name := image.String()
+		if _, ok := built[name]; ok {
+			continue
+		}
+		built[name] = struct{}{}
+
+		hash, err := hashBuildContext(build)
+		if err != nil {
+			return fmt.Errorf("Failed to hash build context %s of container %s, error: %s", build.Context, container.Name, err)
+		}
+
+		if entry, ok := cache[name]; ok && entry.Hash == hash {
+			if img, err := client.Docker.InspectImage(name); err == nil && img.ID == entry.ImageID {
+				log.Infof("Skipping build of image %s for container %s, context %s has not changed", name, container.Name, build.Context)
+				continue
+			}
+		}
+
+		log.Infof("Building image %s for container %s from %s", name, container.Name, build.Context)
+
+		if build.Rockerfile != "" {
+			err = buildRockerImage(image, build)
+		} else {
+			var registries []string
+			if registries, err = dockerfileRegistries(build); err == nil {
+				err = client.buildDockerImage(image, build, client.Auth.ForRegistries(registries))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to build image %s for container %s, error: %s", name, container.Name, err)
+		}
+
+		img, err := client.Docker.InspectImage(name)
+		if err != nil {
+			return fmt.Errorf("Failed to inspect image %s after build, is it tagged by the build? error: %s", name, err)
+		}
+
+		cache[name] = buildCacheEntry{Hash: hash, ImageID: img.ID}
+		changed = true
+	}
+
+	if changed {
+		return writeBuildCache(cacheFile, cache)
+	}
+
+	return nil
+}
+
+// buildDockerImage builds the image from a Dockerfile through the Docker API. The request
+// is made here, since go-dockerclient of the vendored revision cannot pass build args.
+// Credentials for pulling base images are sent as X-Registry-Config, the only auth header of /build.
+func (client *DockerClient) buildDockerImage(image *imagename.ImageName, build *config.Build, auths docker.AuthConfigurations119) error {
+	excludes, err := readDockerignore(build.Context)
+	if err != nil {
+		return err
+	}
+
+	// the Dockerfile and .dockerignore are needed by the daemon even if they are excluded
+	dockerfile := build.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	includes := []string{"."}
+	for _, file := range []string{".dockerignore", dockerfile} {
+		excluded, err := fileutils.Matches(file, excludes)
+		if err != nil {
+			return fmt.Errorf("Failed to match %s against .dockerignore, error: %s", file, err)
+		}
+		if excluded {
+			includes = append(includes, file)
+		}
+	}
+	context, err := archive.TarWithOptions(build.Context, &archive.TarOptions{
+		ExcludePatterns: excludes,
+		IncludeFiles:    includes,
+		Compression:     archive.Uncompressed,
+		NoLchown:        true,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to archive build context %s, error: %s", build.Context, err)
+	}
+	defer context.Close()
+
+	query := url.Values{}
+	query.Set("t", image.String())
+	query.Set("rm", "1")
+	if build.Dockerfile != "" {
+		query.Set("dockerfile", build.Dockerfile)
+	}
+	if len(build.Args) > 0 {
+		args, err := json.Marshal(build.Args)
+		if err != nil {
+			return err
+		}
+		query.Set("buildargs", string(args))
+	}
+
+	req, err := http.NewRequest("POST", "/build?"+query.Encode(), context)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/tar")
+	if len(auths) > 0 {
+		data, err := json.Marshal(auths)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Registry-Config", base64.URLEncoding.EncodeToString(data))
+	}
+
+	res, err := client.dockerAPIDo(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Build request failed with status %d, response: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	def := log.StandardLogger()
+	fd, isTerminal := term.GetFdInfo(def.Out)
+	out := def.Out
+
+	if !isTerminal {
+		out = def.Writer()
+	}
+
+	return jsonmessage.DisplayJSONMessagesStream(res.Body, out, fd, isTerminal)
+}
+
+// dockerfileRegistries returns registries of base images in FROM instructions of the Dockerfile.
+// Build args are substituted in image names, images that still refer to unknown args are skipped.
+func dockerfileRegistries(build *config.Build) ([]string, error) {
+	dockerfile := build.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	data, err := ioutil.ReadFile(filepath.Join(build.Context, dockerfile))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s, error: %s", dockerfile, err)
+	}
+
+	registries := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		name := fields[1]
+		for i := 2; strings.HasPrefix(name, "--") && i < len(fields); i++ {
+			name = fields[i]
+		}
+
+		known := true
+		name = os.Expand(name, func(arg string) string {
+			value, ok := build.Args[arg]
+			known = known && ok
+			return value
+		})
+		if !known || strings.HasPrefix(name, "--") || name == "scratch" {
+			continue
+		}
+		registries = append(registries, imagename.NewFromString(name).Registry)
+	}
+
+	return registries, nil
+}
+
+// dockerAPIDo sends the request, whose URL is the API path, to the Docker daemon of DockerHost.
+// Unix sockets are dialed directly, TCP endpoints are called with the TLS config of the client.
+func (client *DockerClient) dockerAPIDo(req *http.Request) (*http.Response, error) {
+	host := client.DockerHost
+	if host == "" {
+		host = dockerclient.NewConfig().Host
+	}
+	endpoint, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Docker endpoint %s, error: %s", host, err)
+	}
+
+	httpClient := client.Docker.HTTPClient
+	switch endpoint.Scheme {
+	case "unix":
+		socket := endpoint.Path
+		httpClient = &http.Client{Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}}
+		req.URL.Scheme, req.URL.Host = "http", "docker"
+	case "tcp", "http", "https":
+		req.URL.Scheme, req.URL.Host = "http", endpoint.Host
+		if client.Docker.TLSConfig != nil || endpoint.Scheme == "https" {
+			req.URL.Scheme = "https"
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported Docker endpoint %s", host)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Request to Docker %s failed, error: %s", host, err)
+	}
+	return res, nil
+}
+
+// buildRockerImage builds the image from a Rockerfile by the rocker executable, which
+// should be in PATH and connects to the Docker daemon given by the environment (DOCKER_HOST).
+// The Rockerfile is expected to TAG the resulting image with the image name of the container.
+func buildRockerImage(image *imagename.ImageName, build *config.Build) error {
+	args := []string{"build", "-f", filepath.Join(build.Context, build.Rockerfile)}
+	for _, k := range sortedKeys(build.Args) {
+		args = append(args, "--var", k+"="+build.Args[k])
+	}
+	args = append(args, build.Context)
+
+	log.Debugf("Running rocker %s", strings.Join(args, " "))
+
+	out := log.StandardLogger().Writer()
+	defer out.Close()
+
+	cmd := exec.Command("rocker", args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rocker build failed, error: %s", err)
+	}
+	return nil
+}
+
+// hashBuildContext returns sha256 of the files of the build context, excluding the ones
+// matched by .dockerignore, along with the build options
+func hashBuildContext(build *config.Build) (string, error) {
+	excludes, err := readDockerignore(build.Context)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "dockerfile:%s\nrockerfile:%s\n", build.Dockerfile, build.Rockerfile)
+	for _, k := range sortedKeys(build.Args) {
+		fmt.Fprintf(h, "arg:%s=%s\n", k, build.Args[k])
+	}
+
+	err = filepath.Walk(build.Context, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(build.Context, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		// directories are not skipped entirely, since exclusions (!pattern) may bring files back
+		if skip, err := fileutils.Matches(rel, excludes); err != nil {
+			return err
+		} else if skip {
+			return nil
+		}
+
+		fmt.Fprintf(h, "%s %s\n", filepath.ToSlash(rel), info.Mode())
+
+		switch {
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "-> %s\n", target)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readDockerignore returns exclusion patterns of .dockerignore of the build context
+func readDockerignore(dir string) ([]string, error) {
+	excludes := []string{}
+	ignore, err := ioutil.ReadFile(filepath.Join(dir, ".dockerignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, pattern := range strings.Split(string(ignore), "\n") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" && !strings.HasPrefix(pattern, "#") {
+			excludes = append(excludes, pattern)
+		}
+	}
+	return excludes, nil
+}
+
+func readBuildCache(filename string) (map[string]buildCacheEntry, error) {
+	cache := map[string]buildCacheEntry{}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read build cache %s, error: %s", filename, err)
+	}
+
+	if err := json.Unmarshal(data, &cache); err != nil {
+		// the cache only saves time, so it is fine to start over
+		log.Warnf("Failed to parse build cache %s, ignoring it, error: %s", filename, err)
+		return map[string]buildCacheEntry{}, nil
+	}
+
+	return cache, nil
+}
+
+func writeBuildCache(filename string, cache map[string]buildCacheEntry) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("Failed to create directory for build cache %s, error: %s", filename, err)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write build cache %s, error: %s", filename, err)
+	}
+	return nil
+}
+
+// splitBuiltContainers separates containers having the build key from the others
+func splitBuiltContainers(containers []*Container) (other, built []*Container) {
+	other, built = []*Container{}, []*Container{}
+	for _, container := range containers {
+		if container.Config != nil && container.Config.Build != nil {
+			built = append(built, container)
+		} else {
+			other = append(other, container)
+		}
+	}
+	return
+}
+
+func sortedKeys(m config.StringMap) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
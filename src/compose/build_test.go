@@ -0,0 +1,207 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"archive/tar"
+	"compose/config"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashBuildContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, data string) {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("Dockerfile", "FROM busybox\nCOPY . /app\n")
+	write("src/main.go", "package main\n")
+	write(".dockerignore", "# comment\nlogs\n")
+
+	build := &config.Build{Context: dir}
+	hash := func() string {
+		h, err := hashBuildContext(build)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	initial := hash()
+	assert.Equal(t, initial, hash(), "hash should be stable")
+
+	// ignored files do not matter
+	write("logs/app.log", "hello")
+	assert.Equal(t, initial, hash())
+
+	write("src/main.go", "package main\n\nfunc main() {}\n")
+	changed := hash()
+	assert.NotEqual(t, initial, changed)
+
+	build.Args = config.StringMap{"VERSION": "1"}
+	assert.NotEqual(t, changed, hash(), "build args should affect the hash")
+}
+
+func TestBuildDockerImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{
+		"Dockerfile":    "FROM busybox\nARG VERSION\n",
+		"main.go":       "package main\n",
+		"app.log":       "hello",
+		".dockerignore": "*.log\nDockerfile\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		query          url.Values
+		registryConfig string
+		files          []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/build", r.URL.Path)
+		assert.Equal(t, "application/tar", r.Header.Get("Content-Type"))
+		query = r.URL.Query()
+		registryConfig = r.Header.Get("X-Registry-Config")
+
+		archive := tar.NewReader(r.Body)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, header.Name)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"stream": "Successfully built\n"})
+	}))
+	defer server.Close()
+
+	host := "tcp://" + server.Listener.Addr().String()
+	dockerCli, err := docker.NewClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &DockerClient{Docker: dockerCli, DockerHost: host}
+
+	build := &config.Build{Context: dir, Args: config.StringMap{"VERSION": "1"}}
+	auths := docker.AuthConfigurations119{"quay.io": {Username: "user", Password: "pass"}}
+	err = client.buildDockerImage(imagename.NewFromString("myapp:dev"), build, auths)
+	assert.Nil(t, err)
+
+	data, err := base64.URLEncoding.DecodeString(registryConfig)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"quay.io":{"username":"user","password":"pass"}}`, string(data))
+
+	assert.Equal(t, "myapp:dev", query.Get("t"))
+	assert.Equal(t, `{"VERSION":"1"}`, query.Get("buildargs"))
+	assert.Contains(t, files, "main.go")
+	assert.Contains(t, files, "Dockerfile", "Dockerfile should be sent even if ignored")
+	assert.NotContains(t, files, "app.log")
+}
+
+func TestDockerfileRegistries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dockerfile := `FROM quay.io/base/go:1.6 AS builder
+from --platform=linux/amd64 registry.example.com/tools
+FROM ${BASE}
+FROM ${UNKNOWN}/app
+FROM scratch
+FROM alpine:3.4
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile.app"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	build := &config.Build{Context: dir, Dockerfile: "Dockerfile.app", Args: config.StringMap{"BASE": "private.io/base"}}
+	registries, err := dockerfileRegistries(build)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"quay.io", "registry.example.com", "private.io", ""}, registries)
+
+	_, err = dockerfileRegistries(&config.Build{Context: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
+
+func TestBuildCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "cache", "builds.json")
+
+	cache, err := readBuildCache(filename)
+	assert.Nil(t, err)
+	assert.Empty(t, cache)
+
+	cache["myapp:dev"] = buildCacheEntry{Hash: "sha256:abc", ImageID: "sha256:def"}
+	if err := writeBuildCache(filename, cache); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readBuildCache(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, cache, read)
+}
+
+func TestSplitBuiltContainers(t *testing.T) {
+	app := &Container{Config: &config.Container{Build: &config.Build{Context: "."}}}
+	redis := &Container{Config: &config.Container{}}
+
+	other, built := splitBuiltContainers([]*Container{app, redis})
+	assert.Equal(t, []*Container{redis}, other)
+	assert.Equal(t, []*Container{app}, built)
+}
@@ -0,0 +1,234 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// BundleIndexFile is the name of the bundle index inside of the archive,
+// `docker load` ignores it
+const BundleIndexFile = "rocker-compose-bundle.json"
+
+// BundleIndex lists images stored in the bundle along with containers using them
+type BundleIndex struct {
+	Namespace string         `json:"namespace"`
+	CreatedAt time.Time      `json:"created_at"`
+	Images    []*BundleImage `json:"images"`
+}
+
+// BundleImage is an image stored in the bundle
+type BundleImage struct {
+	Name       string   `json:"name"`
+	ID         string   `json:"id"`
+	Containers []string `json:"containers"`
+}
+
+// NewBundleIndex makes the index of images of given containers, their images should
+// be fetched already. Images referred by digest cannot be bundled, since `docker load`
+// does not restore repo digests.
+func NewBundleIndex(namespace string, containers []*Container) (*BundleIndex, error) {
+	var (
+		images = map[string]*BundleImage{}
+		names  = []string{}
+	)
+	for _, container := range containers {
+		if container.Image == nil {
+			return nil, fmt.Errorf("Image is not specified for the container: %s", container.Name)
+		}
+		if container.Image.TagIsSha() {
+			return nil, fmt.Errorf("Image %s of container %s is referred by digest, it cannot be bundled, pin it by tag instead",
+				container.Image, container.Name)
+		}
+		name := container.Image.String()
+		if _, ok := images[name]; !ok {
+			images[name] = &BundleImage{Name: name, ID: container.ImageID}
+			names = append(names, name)
+		}
+		images[name].Containers = append(images[name].Containers, container.Name.String())
+	}
+
+	index := &BundleIndex{
+		Namespace: namespace,
+		CreatedAt: time.Now(),
+		Images:    []*BundleImage{},
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sort.Strings(images[name].Containers)
+		index.Images = append(index.Images, images[name])
+	}
+	return index, nil
+}
+
+// Names returns names of images in the bundle
+func (index *BundleIndex) Names() []string {
+	names := []string{}
+	for _, image := range index.Images {
+		names = append(names, image.Name)
+	}
+	return names
+}
+
+// BundleSaveAction implements 'rocker-compose bundle save'. Images of all containers
+// are resolved and fetched like for 'run', then written to w as a `docker save`
+// archive along with the bundle index.
+func (compose *Compose) BundleSaveAction(w io.Writer) (*BundleIndex, error) {
+	containers := GetContainersFromConfig(compose.Manifest)
+	if err := compose.client.FetchImages(containers, compose.Manifest.Vars); err != nil {
+		return nil, fmt.Errorf("Failed to fetch images of given containers, error: %s", err)
+	}
+
+	index, err := NewBundleIndex(compose.Manifest.Namespace, containers)
+	if err != nil {
+		return nil, err
+	}
+	if err := compose.client.SaveBundle(index, w); err != nil {
+		return nil, fmt.Errorf("Failed to save bundle, error: %s", err)
+	}
+
+	return index, nil
+}
+
+// BundleLoadAction implements 'rocker-compose bundle load'. It imports images
+// of the bundle, so that 'run' finds them locally.
+func (compose *Compose) BundleLoadAction(r io.ReadSeeker) (*BundleIndex, error) {
+	index, err := compose.client.LoadBundle(r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load bundle, error: %s", err)
+	}
+	return index, nil
+}
+
+// SaveBundle exports images of the index and writes them to w along with the index
+func (client *DockerClient) SaveBundle(index *BundleIndex, w io.Writer) error {
+	pr, pw := io.Pipe()
+	go func() {
+		log.Debugf("Exporting images %s", strings.Join(index.Names(), ", "))
+		pw.CloseWithError(client.Docker.ExportImages(docker.ExportImagesOptions{
+			Names:        index.Names(),
+			OutputStream: pw,
+		}))
+	}()
+
+	err := writeBundle(w, pr, index)
+	pr.CloseWithError(err)
+	return err
+}
+
+// LoadBundle imports images of the bundle and checks they are all available afterwards
+func (client *DockerClient) LoadBundle(r io.ReadSeeker) (*BundleIndex, error) {
+	index, err := readBundleIndex(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Loading images %s", strings.Join(index.Names(), ", "))
+	if err := client.Docker.LoadImage(docker.LoadImageOptions{InputStream: r}); err != nil {
+		return nil, fmt.Errorf("Failed to load images, error: %s", err)
+	}
+
+	for _, image := range index.Images {
+		img, err := client.Docker.InspectImage(image.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Image %s is not available after loading the bundle, error: %s", image.Name, err)
+		}
+		if image.ID != "" && trimSha256(img.ID) != trimSha256(image.ID) {
+			log.Warnf("Image %s has id %s, while the bundle was made with %s", image.Name, img.ID, image.ID)
+		}
+		log.Infof("Loaded image %s", image.Name)
+	}
+
+	return index, nil
+}
+
+// writeBundle copies the `docker save` archive to w and appends the index to it
+func writeBundle(w io.Writer, exported io.Reader, index *BundleIndex) error {
+	tw := tar.NewWriter(w)
+	tr := tar.NewReader(exported)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to read exported images, error: %s", err)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    BundleIndexFile,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: index.CreatedAt,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// readBundleIndex finds the index in the bundle archive
+func readBundleIndex(r io.Reader) (*BundleIndex, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Bundle index %s is not found in the archive, is it made by `rocker-compose bundle save`?", BundleIndexFile)
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to read bundle archive, error: %s", err)
+		}
+		if hdr.Name != BundleIndexFile {
+			continue
+		}
+		index := &BundleIndex{}
+		if err := json.NewDecoder(tr).Decode(index); err != nil {
+			return nil, fmt.Errorf("Failed to parse bundle index, error: %s", err)
+		}
+		return index, nil
+	}
+}
+
+func trimSha256(id string) string {
+	return strings.TrimPrefix(id, "sha256:")
+}
@@ -0,0 +1,87 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"archive/tar"
+	"bytes"
+	"compose/config"
+	"io/ioutil"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBundleIndex(t *testing.T) {
+	containers := []*Container{
+		{Name: config.NewContainerName("app", "web"), Image: imagename.NewFromString("nginx:1.9"), ImageID: "123"},
+		{Name: config.NewContainerName("app", "redis"), Image: imagename.NewFromString("redis:3.0"), ImageID: "456"},
+		{Name: config.NewContainerName("app", "api"), Image: imagename.NewFromString("nginx:1.9"), ImageID: "123"},
+	}
+
+	index, err := NewBundleIndex("app", containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "app", index.Namespace)
+	assert.Equal(t, []string{"nginx:1.9", "redis:3.0"}, index.Names())
+	assert.Equal(t, "123", index.Images[0].ID)
+	assert.Equal(t, []string{"app.api", "app.web"}, index.Images[0].Containers)
+
+	containers[1].Image = imagename.NewFromString("redis@sha256:ea9c2e3a4d7d4d3ec76c6b1df6e1c8de5df8d1fc0e4e0a0e37a1a0bdd2db8c0f")
+	_, err = NewBundleIndex("app", containers)
+	assert.Error(t, err)
+}
+
+func TestWriteBundle(t *testing.T) {
+	exported := &bytes.Buffer{}
+	tw := tar.NewWriter(exported)
+	tw.WriteHeader(&tar.Header{Name: "repositories", Mode: 0644, Size: 2})
+	tw.Write([]byte("{}"))
+	tw.Close()
+
+	index := &BundleIndex{
+		Namespace: "app",
+		Images:    []*BundleImage{{Name: "redis:3.0", ID: "456", Containers: []string{"app.redis"}}},
+	}
+
+	bundle := &bytes.Buffer{}
+	if err := writeBundle(bundle, exported, index); err != nil {
+		t.Fatal(err)
+	}
+
+	// the original entries are kept
+	tr := tar.NewReader(bytes.NewReader(bundle.Bytes()))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "repositories", hdr.Name)
+	data, _ := ioutil.ReadAll(tr)
+	assert.Equal(t, "{}", string(data))
+
+	read, err := readBundleIndex(bytes.NewReader(bundle.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, index.Images, read.Images)
+
+	_, err = readBundleIndex(bytes.NewReader(exported.Bytes()))
+	assert.Error(t, err)
+}
@@ -0,0 +1,382 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/units"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/wmark/semver"
+)
+
+// DefaultKeepImages is the number of newest tags of every image kept by clean, if not specified
+const DefaultKeepImages = 5
+
+// cleanPolicy decides which tags of an image are obsolete
+type cleanPolicy struct {
+	keep      int
+	olderThan time.Duration
+	keepTags  []tagMatcher
+}
+
+// tagMatcher matches image tags either by a semver range or by a regular expression
+type tagMatcher struct {
+	pattern string
+	version *semver.Range
+	regexp  *regexp.Regexp
+}
+
+// cleanCandidate is an image tag, or an untagged image, that clean removes
+type cleanCandidate struct {
+	name   *imagename.ImageName // nil for untagged images
+	id     string
+	reason string
+}
+
+// String returns the name of the tag or the short ID of the untagged image
+func (c *cleanCandidate) String() string {
+	if c.name != nil {
+		return c.name.String()
+	}
+	return shortImageID(c.id)
+}
+
+// newCleanPolicy makes the clean policy. Every keep tag pattern is treated as a semver
+// range (e.g. "~1.2", ">=1.0 <2.0") if it parses as one, or as a regular expression
+// that should match the whole tag (e.g. "release-.*") otherwise.
+func newCleanPolicy(keep int, olderThan time.Duration, keepTags []string) (*cleanPolicy, error) {
+	if keep <= 0 {
+		keep = DefaultKeepImages
+	}
+
+	policy := &cleanPolicy{keep: keep, olderThan: olderThan}
+
+	for _, pattern := range keepTags {
+		matcher := tagMatcher{pattern: pattern}
+		if r, err := semver.NewRange(pattern); err == nil && r != nil {
+			matcher.version = r
+		} else if matcher.regexp, err = regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			return nil, fmt.Errorf("Failed to parse keep tag pattern %q, should be a regexp or a semver range, error: %s", pattern, err)
+		}
+		policy.keepTags = append(policy.keepTags, matcher)
+	}
+
+	return policy, nil
+}
+
+// match returns true if the tag satisfies the pattern
+func (m tagMatcher) match(tag imagename.ImageName) bool {
+	if m.version != nil {
+		return tag.HasVersion() && m.version.IsSatisfiedBy(tag.TagAsVersion())
+	}
+	return m.regexp.MatchString(tag.GetTag())
+}
+
+// obsolete returns tags of the image that should be removed, along with the reasons.
+// Tags of the spec image and pinned tags are never removed.
+func (p *cleanPolicy) obsolete(spec imagename.ImageName, tags *imagename.Tags, pinned map[string]struct{}, now time.Time) []*cleanCandidate {
+	// newest first
+	sort.Sort(tags)
+
+	result := []*cleanCandidate{}
+	for i, tag := range tags.Items {
+		if i < p.keep {
+			continue
+		}
+
+		name := tag.Name
+		created := time.Unix(tag.Created, 0)
+		age := now.Sub(created)
+
+		if spec.GetTag() == name.GetTag() {
+			log.Infof("Cleanup: keeping %s because it is in the spec", name)
+			continue
+		}
+		if _, ok := pinned[name.String()]; ok {
+			log.Infof("Cleanup: keeping %s because it is pinned by digest in the spec", name)
+			continue
+		}
+		if p.olderThan > 0 && age < p.olderThan {
+			log.Debugf("Cleanup: keeping %s because it is created %s ago, not older than %s", name, formatAge(age), p.olderThan)
+			continue
+		}
+		if m, ok := p.keepMatch(name); ok {
+			log.Infof("Cleanup: keeping %s because it matches %q", name, m.pattern)
+			continue
+		}
+
+		reason := fmt.Sprintf("not among %d newest tags", p.keep)
+		if p.olderThan > 0 {
+			reason += fmt.Sprintf(", created %s ago", formatAge(age))
+		}
+
+		removed := name
+		result = append(result, &cleanCandidate{name: &removed, id: tag.ID, reason: reason})
+	}
+
+	return result
+}
+
+func (p *cleanPolicy) keepMatch(tag imagename.ImageName) (tagMatcher, bool) {
+	for _, m := range p.keepTags {
+		if m.match(tag) {
+			return m, true
+		}
+	}
+	return tagMatcher{}, false
+}
+
+// findDanglingImages returns untagged images of the given repositories, e.g. left behind
+// when a tag was moved to a newer image. Images pinned by digest are skipped, as well as
+// recorded ones, which revisions of the history may be rolled back to.
+func findDanglingImages(specImages []imagename.ImageName, all []docker.APIImages, recorded map[string]struct{}) []*cleanCandidate {
+	result := []*cleanCandidate{}
+
+	for _, image := range all {
+		if !isUntagged(image) {
+			continue
+		}
+		if _, ok := recorded[image.ID]; ok {
+			log.Infof("Cleanup: keeping untagged image %s because it is recorded in the history, rollback may need it", shortImageID(image.ID))
+			continue
+		}
+		// any spec may pin the image, so all of them are checked before removing it
+		var (
+			repo   *imagename.ImageName
+			pinned bool
+		)
+		for i, spec := range specImages {
+			digest := findRepoDigest(&spec, image.RepoDigests)
+			if digest == "" {
+				continue
+			}
+			if spec.TagIsSha() && spec.GetTag() == digest {
+				pinned = true
+				break
+			}
+			if repo == nil {
+				repo = &specImages[i]
+			}
+		}
+		if pinned {
+			log.Infof("Cleanup: keeping untagged image %s because it is pinned by digest in the spec", shortImageID(image.ID))
+			continue
+		}
+		if repo != nil {
+			result = append(result, &cleanCandidate{
+				id:     image.ID,
+				reason: fmt.Sprintf("untagged image of %s", repo.NameWithRegistry()),
+			})
+		}
+	}
+
+	return result
+}
+
+// isUntagged returns true if the image has no tags
+func isUntagged(image docker.APIImages) bool {
+	for _, repoTag := range image.RepoTags {
+		if repoTag != "<none>:<none>" {
+			return false
+		}
+	}
+	return true
+}
+
+// reclaimedSpace estimates the disk space freed by removing the candidates: the size of
+// an image only counts if all of its tags are removed. Layers shared with other images
+// are counted as well, so this is an upper bound.
+func reclaimedSpace(candidates []*cleanCandidate, all []docker.APIImages) int64 {
+	removed := map[string]struct{}{}
+	for _, c := range candidates {
+		if c.name != nil {
+			removed[c.name.String()] = struct{}{}
+		} else {
+			removed[c.id] = struct{}{}
+		}
+	}
+
+	var total int64
+	for _, image := range all {
+		if _, ok := removed[image.ID]; ok {
+			total += image.VirtualSize
+			continue
+		}
+		if isUntagged(image) {
+			continue
+		}
+		allRemoved := true
+		for _, repoTag := range image.RepoTags {
+			if _, ok := removed[imagename.NewFromString(repoTag).String()]; !ok {
+				allRemoved = false
+				break
+			}
+		}
+		if allRemoved {
+			total += image.VirtualSize
+		}
+	}
+
+	return total
+}
+
+// formatAge formats the duration in days for long periods, e.g. "45d"
+func formatAge(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+	return d.String()
+}
+
+// Clean finds the obsolete image tags from container specs that exist in docker daemon
+// and deletes them, along with untagged images of the same repositories. Newest tags
+// (keep_images, default 5), tags created recently (CleanOlderThan) and tags matching
+// CleanKeepTags are kept. Untagged images with recorded IDs are kept too. If dryRun is true,
+// tags are only listed.
+func (client *DockerClient) Clean(config *config.Config, recorded []string, dryRun bool) error {
+	policy, err := newCleanPolicy(client.KeepImages, client.CleanOlderThan, client.CleanKeepTags)
+	if err != nil {
+		return err
+	}
+
+	// do not pull same image twice
+	images := map[imagename.ImageName]*imagename.Tags{}
+
+	for _, container := range GetContainersFromConfig(config) {
+		if container.Image == nil {
+			continue
+		}
+		images[*container.Image] = &imagename.Tags{}
+	}
+
+	if len(images) == 0 {
+		return nil
+	}
+
+	// Go through every image and list existing tags
+	all, err := client.Docker.ListImages(docker.ListImagesOptions{All: false, Digests: true})
+	if err != nil {
+		return fmt.Errorf("Failed to list all images, error: %s", err)
+	}
+
+	// tags of images that are referred by digest in the spec, they should not be removed
+	pinned := map[string]struct{}{}
+	for _, image := range all {
+		for img := range images {
+			if img.TagIsSha() && findRepoDigest(&img, image.RepoDigests) == img.GetTag() {
+				for _, repoTag := range image.RepoTags {
+					pinned[repoTag] = struct{}{}
+				}
+			}
+		}
+	}
+
+	// collect tags for every image
+	specImages := []imagename.ImageName{}
+	for img := range images {
+		specImages = append(specImages, img)
+	}
+	for _, image := range all {
+		for _, repoTag := range image.RepoTags {
+			imageName := imagename.NewFromString(repoTag)
+			for _, img := range specImages {
+				if img.IsSameKind(*imageName) {
+					images[img].Items = append(images[img].Items, &imagename.Tag{
+						ID:      image.ID,
+						Name:    *imageName,
+						Created: image.Created,
+					})
+				}
+			}
+		}
+	}
+
+	// for every image, find obsolete tags, then untagged images of the same repositories
+	sort.Sort(imageNamesByString(specImages))
+	candidates := []*cleanCandidate{}
+	now := time.Now()
+	for _, name := range specImages {
+		candidates = append(candidates, policy.obsolete(name, images[name], pinned, now)...)
+	}
+	keep := map[string]struct{}{}
+	for _, id := range recorded {
+		keep[id] = struct{}{}
+	}
+	candidates = append(candidates, findDanglingImages(specImages, all, keep)...)
+
+	prefix := "Cleanup:"
+	if dryRun {
+		prefix = "Cleanup (dry run):"
+	}
+
+	removed := []*cleanCandidate{}
+	for _, c := range candidates {
+		log.Infof("%s remove %s (%s)", prefix, c, c.reason)
+		if dryRun {
+			removed = append(removed, c)
+			continue
+		}
+
+		ref := c.id
+		if c.name != nil {
+			ref = c.name.String()
+		}
+		if err := client.Docker.RemoveImageExtended(ref, docker.RemoveImageOptions{Force: false}); err != nil {
+			// 409 is conflict, which means there is a container exists running under this image
+			if e, ok := err.(*docker.Error); ok && e.Status == 409 {
+				log.Infof("Cleanup: skip %s because there is an existing container using it", c)
+				continue
+			}
+			return err
+		}
+		removed = append(removed, c)
+	}
+
+	// images of a dry run are not removed, so they are reported separately
+	for _, c := range removed {
+		name := c.name
+		if name == nil {
+			name = imagename.NewFromString(c.id)
+		}
+		if dryRun {
+			client.cleanableImages = append(client.cleanableImages, name)
+		} else {
+			client.removedImages = append(client.removedImages, name)
+		}
+	}
+	client.reclaimedSpace = reclaimedSpace(removed, all)
+
+	if len(removed) > 0 {
+		log.Infof("%s removed %d images, reclaimed %s", prefix, len(removed), units.HumanSize(float64(client.reclaimedSpace)))
+	}
+
+	return nil
+}
+
+// imageNamesByString sorts image names alphabetically, to make the output of clean stable
+type imageNamesByString []imagename.ImageName
+
+func (a imageNamesByString) Len() int           { return len(a) }
+func (a imageNamesByString) Less(i, j int) bool { return a[i].String() < a[j].String() }
+func (a imageNamesByString) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,159 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCleanTags(now time.Time, tags map[string]time.Duration) *imagename.Tags {
+	result := &imagename.Tags{}
+	for tag, age := range tags {
+		result.Items = append(result.Items, &imagename.Tag{
+			ID:      "id-" + tag,
+			Name:    *imagename.NewFromString("myapp:" + tag),
+			Created: now.Add(-age).Unix(),
+		})
+	}
+	return result
+}
+
+func candidateNames(candidates []*cleanCandidate) []string {
+	names := []string{}
+	for _, c := range candidates {
+		names = append(names, c.String())
+	}
+	return names
+}
+
+func TestCleanPolicyObsolete(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	tags := newCleanTags(now, map[string]time.Duration{
+		"1.0.0":       50 * day,
+		"1.1.0":       40 * day,
+		"1.2.0":       35 * day,
+		"2.0.0":       20 * day,
+		"2.1.0":       10 * day,
+		"release-old": 60 * day,
+		"3.0.0":       1 * day,
+	})
+
+	policy, err := newCleanPolicy(2, 30*day, []string{"~1.1", "release-.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := map[string]struct{}{"myapp:1.0.0": struct{}{}}
+	obsolete := policy.obsolete(*imagename.NewFromString("myapp:2.0.0"), tags, pinned, now)
+
+	// 3.0.0 and 2.1.0 are the newest, 2.0.0 is in the spec, 1.1.0 and release-old match
+	// the keep patterns, 1.0.0 is pinned
+	assert.Equal(t, []string{"myapp:1.2.0"}, candidateNames(obsolete))
+	assert.Equal(t, "not among 2 newest tags, created 35d ago", obsolete[0].reason)
+	assert.Equal(t, "id-1.2.0", obsolete[0].id)
+
+	// without age limit, everything but the newest ones goes
+	policy, _ = newCleanPolicy(2, 0, nil)
+	obsolete = policy.obsolete(*imagename.NewFromString("myapp:2.0.0"), tags, map[string]struct{}{}, now)
+	assert.Equal(t, []string{"myapp:1.2.0", "myapp:1.1.0", "myapp:1.0.0", "myapp:release-old"}, candidateNames(obsolete))
+	assert.Equal(t, "not among 2 newest tags", obsolete[0].reason)
+}
+
+func TestNewCleanPolicy(t *testing.T) {
+	policy, err := newCleanPolicy(0, 0, []string{"latest", ">=1.0 <2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, DefaultKeepImages, policy.keep)
+
+	_, ok := policy.keepMatch(*imagename.NewFromString("myapp:latest"))
+	assert.True(t, ok)
+	_, ok = policy.keepMatch(*imagename.NewFromString("myapp:latest-1"))
+	assert.False(t, ok, "regexp should match the whole tag")
+	_, ok = policy.keepMatch(*imagename.NewFromString("myapp:1.5.0"))
+	assert.True(t, ok)
+	_, ok = policy.keepMatch(*imagename.NewFromString("myapp:2.0.1"))
+	assert.False(t, ok)
+
+	_, err = newCleanPolicy(0, 0, []string{"release-(.*"})
+	assert.Contains(t, err.Error(), "Failed to parse keep tag pattern")
+}
+
+func TestFindDanglingImagesAndReclaimedSpace(t *testing.T) {
+	pinnedDigest := "sha256:bc8813ea7b3603864987522f02a76101c17ad122e1c46d790efc0fca78ca7bfb"
+
+	all := []docker.APIImages{
+		{ID: "sha256:aaa", RepoTags: []string{"myapp:1.0", "myapp:stable"}, VirtualSize: 100},
+		{ID: "sha256:bbb", RepoTags: []string{"myapp:2.0"}, VirtualSize: 200},
+		{ID: "sha256:ccc", RepoTags: []string{"<none>:<none>"}, RepoDigests: []string{"myapp@sha256:0000"}, VirtualSize: 50},
+		{ID: "sha256:ddd", RepoTags: []string{"<none>:<none>"}, RepoDigests: []string{"redis@" + pinnedDigest}, VirtualSize: 70},
+		{ID: "sha256:eee", RepoTags: []string{"<none>:<none>"}, RepoDigests: []string{"other@sha256:1111"}, VirtualSize: 30},
+	}
+
+	specImages := []imagename.ImageName{
+		*imagename.NewFromString("myapp:3.0"),
+		*imagename.NewFromString("redis@" + pinnedDigest),
+	}
+
+	dangling := findDanglingImages(specImages, all, nil)
+	assert.Equal(t, 1, len(dangling))
+	assert.Equal(t, "sha256:ccc", dangling[0].id)
+	assert.Equal(t, "untagged image of myapp", dangling[0].reason)
+
+	// myapp:1.0 image is still tagged as stable, so only 2.0 and the untagged image count
+	candidates := append(dangling,
+		&cleanCandidate{name: imagename.NewFromString("myapp:1.0"), id: "sha256:aaa"},
+		&cleanCandidate{name: imagename.NewFromString("myapp:2.0"), id: "sha256:bbb"},
+	)
+	assert.Equal(t, int64(250), reclaimedSpace(candidates, all))
+}
+
+func TestFindDanglingImagesPinnedBySecondSpec(t *testing.T) {
+	pinnedDigest := "sha256:bc8813ea7b3603864987522f02a76101c17ad122e1c46d790efc0fca78ca7bfb"
+
+	all := []docker.APIImages{
+		{ID: "sha256:aaa", RepoTags: []string{"<none>:<none>"}, RepoDigests: []string{"myapp@" + pinnedDigest}},
+	}
+
+	// the tagged spec of the same repository comes first
+	specImages := []imagename.ImageName{
+		*imagename.NewFromString("myapp:3.0"),
+		*imagename.NewFromString("myapp@" + pinnedDigest),
+	}
+
+	assert.Empty(t, findDanglingImages(specImages, all, nil))
+}
+
+func TestFindDanglingImagesRecorded(t *testing.T) {
+	all := []docker.APIImages{
+		{ID: "sha256:aaa", RepoTags: []string{"<none>:<none>"}, RepoDigests: []string{"myapp@sha256:0000"}},
+		{ID: "sha256:bbb", RepoTags: []string{"<none>:<none>"}, RepoDigests: []string{"myapp@sha256:1111"}},
+	}
+	specImages := []imagename.ImageName{*imagename.NewFromString("myapp:3.0")}
+
+	// images recorded in the history are kept for rollback
+	dangling := findDanglingImages(specImages, all, map[string]struct{}{"sha256:aaa": {}})
+	assert.Equal(t, 1, len(dangling))
+	assert.Equal(t, "sha256:bbb", dangling[0].id)
+}
@@ -17,8 +17,13 @@
 package compose
 
 import (
+	"archive/tar"
+	"bytes"
 	"compose/config"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"time"
 	"util"
 
@@ -39,14 +44,30 @@ type Client interface {
 	EnsureContainerExist(name *Container) error
 	EnsureContainerState(name *Container) error
 	PullAll(containers []*Container, vars template.Vars) error
-	Clean(config *config.Config) error
+	Clean(config *config.Config, recorded []string, dryRun bool) error
 	AttachToContainers(container []*Container) error
 	AttachToContainer(container *Container) error
 	FetchImages(containers []*Container, vars template.Vars) error
+	ResolveImages(containers []*Container, hub bool, vars template.Vars) error
 	WaitForContainer(container *Container) error
 	GetPulledImages() []*imagename.ImageName
 	GetRemovedImages() []*imagename.ImageName
+	GetCleanableImages() []*imagename.ImageName
+	GetReclaimedSpace() int64
+	GetRecoveredContainers() []*Container
 	Pin(local, hub bool, vars template.Vars, containers []*Container) error
+	PinDigests(containers []*Container, localOnly bool) error
+	ListImageTags(image *imagename.ImageName, local, hub bool) ([]*imagename.ImageName, error)
+	BuildImages(containers []*Container) error
+	SaveBundle(index *BundleIndex, w io.Writer) error
+	LoadBundle(r io.ReadSeeker) (*BundleIndex, error)
+	AddEventListener(ch chan *docker.APIEvents) error
+	RemoveEventListener(ch chan *docker.APIEvents) error
+	AcquireDeployLock(namespace, holder string, ttl, timeout time.Duration) (*DeployLock, error)
+	ReleaseDeployLock(lock *DeployLock) error
+	GetDeployLock(namespace string) (*DeployLock, error)
+	ForceUnlock(namespace string) (*DeployLock, error)
+	GetImageDigests(containers []*Container) (map[string]string, error)
 }
 
 // DockerClient is an implementation of Client interface that do operations to a given docker client
@@ -58,8 +79,27 @@ type DockerClient struct {
 	KeepImages int
 	Recover    bool
 
-	pulledImages  []*imagename.ImageName
-	removedImages []*imagename.ImageName
+	PullConcurrency int // number of images pulled in parallel, DefaultPullConcurrency if zero
+	PullRetries     int // number of retries of pulls failed with transient errors
+
+	CleanOlderThan time.Duration // clean removes only tags created earlier, any age if zero
+	CleanKeepTags  []string      // clean keeps tags matching these regexps or semver ranges
+
+	BuildCacheFile string // where hashes of build contexts are kept, DefaultBuildCacheFile if empty
+	DockerHost     string // endpoint of the Docker daemon builds are sent to, DOCKER_HOST or the default one if empty
+
+	Mirrors Mirrors // registries to pull images from instead of the original ones
+
+	Events  *EventStream // pulled images are reported to it, if given
+	Metrics *Metrics     // pulls are recorded to it, if given
+
+	pulledImages    []*imagename.ImageName
+	removedImages   []*imagename.ImageName
+	cleanableImages []*imagename.ImageName
+	reclaimedSpace  int64
+
+	recoveredMu         sync.Mutex
+	recoveredContainers []*Container
 }
 
 // ErrContainerBadState is an error that describes state inconsistency
@@ -89,6 +129,9 @@ type AuthConfig struct {
 	Password      string
 	Email         string
 	ServerAddress string
+
+	// DockerConfig provides per-registry credentials if no Username is given, see auth.go
+	DockerConfig *DockerConfig
 }
 
 // ToDockerAPI converts AuthConfig to be eatable by go-dockerclient
@@ -114,6 +157,20 @@ func NewClient(initialClient *DockerClient) (*DockerClient, error) {
 		Auth:       initialClient.Auth,
 		KeepImages: initialClient.KeepImages,
 		Recover:    initialClient.Recover,
+
+		PullConcurrency: initialClient.PullConcurrency,
+		PullRetries:     initialClient.PullRetries,
+
+		CleanOlderThan: initialClient.CleanOlderThan,
+		CleanKeepTags:  initialClient.CleanKeepTags,
+
+		BuildCacheFile: initialClient.BuildCacheFile,
+		DockerHost:     initialClient.DockerHost,
+
+		Mirrors: initialClient.Mirrors,
+
+		Events:  initialClient.Events,
+		Metrics: initialClient.Metrics,
 	}
 	return client, nil
 }
@@ -213,6 +270,11 @@ func (client *DockerClient) RunContainer(container *Container) error {
 	if err != nil {
 		return fmt.Errorf("Failed to initialize container options, error: %s", err)
 	}
+	if client.runsByImageID(container) {
+		// the image is known by the mirror name only, keep the original one in the label
+		opts.Config.Image = container.ImageID
+		opts.Config.Labels[imageNameLabel] = container.Image.String()
+	}
 	log.Debugf("Creating container with opts: %# v", pretty.Formatter(opts))
 
 	apiContainer, err := client.Docker.CreateContainer(*opts)
@@ -221,6 +283,10 @@ func (client *DockerClient) RunContainer(container *Container) error {
 	}
 	container.ID = apiContainer.ID
 
+	if err := client.uploadSecrets(container); err != nil {
+		return err
+	}
+
 	if container.State.Running || container.Config.State.IsRan() {
 		if client.Attach {
 			if err := client.AttachToContainer(container); err != nil {
@@ -271,6 +337,7 @@ func (client *DockerClient) StartContainer(container *Container) error {
 			}
 			return err
 		}
+		container.healthy = true
 	}
 	return nil
 }
@@ -304,7 +371,13 @@ func (client *DockerClient) EnsureContainerState(container *Container) error {
 	log.Debugf("Container state for %s: %# v", container.Name, inspect.State)
 
 	if client.Recover && !inspect.State.Running && container.State.Running {
-		return client.StartContainer(container)
+		if err := client.StartContainer(container); err != nil {
+			return err
+		}
+		client.recoveredMu.Lock()
+		client.recoveredContainers = append(client.recoveredContainers, container)
+		client.recoveredMu.Unlock()
+		return nil
 	}
 	if inspect.State.ExitCode != 0 {
 		return err
@@ -317,89 +390,6 @@ func (client *DockerClient) PullAll(containers []*Container, vars template.Vars)
 	return client.pullImageForContainers(true, vars, containers...)
 }
 
-// Clean finds the obsolete image tags from container specs that exist in docker daemon,
-// skipping topN images that we want to keep (keep_images, default 5) and deletes them.
-func (client *DockerClient) Clean(config *config.Config) error {
-	// do not pull same image twice
-	images := map[imagename.ImageName]*imagename.Tags{}
-	keep := client.KeepImages
-
-	// keep 5 latest images by default
-	if keep == 0 {
-		keep = 5
-	}
-
-	for _, container := range GetContainersFromConfig(config) {
-		if container.Image == nil {
-			continue
-		}
-		images[*container.Image] = &imagename.Tags{}
-	}
-
-	if len(images) == 0 {
-		return nil
-	}
-
-	// Go through every image and list existing tags
-	all, err := client.Docker.ListImages(docker.ListImagesOptions{})
-	if err != nil {
-		return fmt.Errorf("Failed to list all images, error: %s", err)
-	}
-
-	// collect tags for every image
-	for _, image := range all {
-		for _, repoTag := range image.RepoTags {
-			imageName := imagename.NewFromString(repoTag)
-			for img := range images {
-				if img.IsSameKind(*imageName) {
-					images[img].Items = append(images[img].Items, &imagename.Tag{
-						ID:      image.ID,
-						Name:    *imageName,
-						Created: image.Created,
-					})
-				}
-			}
-		}
-	}
-
-	// for every image, delete obsolete tags
-	for name, tags := range images {
-		toDelete := tags.GetOld(keep)
-		if len(toDelete) == 0 {
-			continue
-		}
-
-		log.Infof("Cleanup: removing %d tags of image %s", len(toDelete), name.NameWithRegistry())
-		for _, n := range toDelete {
-			if name.GetTag() == n.GetTag() {
-				log.Infof("Cleanup: skipping %s because it is in the spec", n)
-				continue
-			}
-
-			wasRemoved := true
-
-			log.Infof("Cleanup: remove %s", n)
-			if err := client.Docker.RemoveImageExtended(n.String(), docker.RemoveImageOptions{Force: false}); err != nil {
-				// 409 is conflict, which means there is a container exists running under this image
-				if e, ok := err.(*docker.Error); ok && e.Status == 409 {
-					log.Infof("Cleanup: skip %s because there is an existing container using it", n)
-					wasRemoved = false
-				} else {
-					return err
-				}
-			}
-
-			// cannot refer to &n because of for loop
-			if wasRemoved {
-				removed := n
-				client.removedImages = append(client.removedImages, &removed)
-			}
-		}
-	}
-
-	return nil
-}
-
 // AttachToContainer attaches to a running container and redirects its streams to log
 func (client *DockerClient) AttachToContainer(container *Container) error {
 	success := make(chan struct{})
@@ -495,7 +485,31 @@ func (client *DockerClient) FetchImages(containers []*Container, vars template.V
 	return client.pullImageForContainers(false, vars, containers...)
 }
 
-// GetPulledImages returns the list of images pulled by a recent run
+// ResolveImages resolves images of containers as FetchImages does, among local images
+// and, if hub is true, tags in registries, but never pulls them. IDs are taken from
+// local images; containers of images missing locally are left without one.
+func (client *DockerClient) ResolveImages(containers []*Container, hub bool, vars template.Vars) error {
+	if err := client.resolveVersions(true, hub, vars, containers); err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if container.Image == nil {
+			return fmt.Errorf("Cannot find image for container %s", container.Name)
+		}
+		img, err := client.inspectImage(container.Image)
+		if err == docker.ErrNoSuchImage {
+			log.Infof("Image %s for %s is not pulled", container.Image, container.Name)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Failed to inspect image %s for container %s, error: %s", container.Image, container.Name, err)
+		}
+		container.ImageID = img.ID
+	}
+	return nil
+}
+
+// GetPulledImages returns the list of images pulled by a recent run, images pulled
+// again with the same ID are not listed
 func (client *DockerClient) GetPulledImages() []*imagename.ImageName {
 	return client.pulledImages
 }
@@ -505,11 +519,120 @@ func (client *DockerClient) GetRemovedImages() []*imagename.ImageName {
 	return client.removedImages
 }
 
+// GetCleanableImages returns the list of images a recent dry run of clean would remove
+func (client *DockerClient) GetCleanableImages() []*imagename.ImageName {
+	return client.cleanableImages
+}
+
+// GetReclaimedSpace returns the estimated number of bytes freed by a recent clean
+func (client *DockerClient) GetReclaimedSpace() int64 {
+	return client.reclaimedSpace
+}
+
+// GetRecoveredContainers returns the list of containers that were found stopped
+// and started again in recover mode
+func (client *DockerClient) GetRecoveredContainers() []*Container {
+	client.recoveredMu.Lock()
+	defer client.recoveredMu.Unlock()
+	return client.recoveredContainers
+}
+
+// AddEventListener subscribes the channel to Docker events
+func (client *DockerClient) AddEventListener(ch chan *docker.APIEvents) error {
+	return client.Docker.AddEventListener(ch)
+}
+
+// RemoveEventListener unsubscribes the channel from Docker events
+func (client *DockerClient) RemoveEventListener(ch chan *docker.APIEvents) error {
+	return client.Docker.RemoveEventListener(ch)
+}
+
 // Pin resolves versions for given containers
 func (client *DockerClient) Pin(local, hub bool, vars template.Vars, containers []*Container) error {
 	return client.resolveVersions(local, hub, vars, containers)
 }
 
+// PinDigests replaces tags of images of given containers with content digests of
+// their registry manifests, e.g. "redis:3.0.5" becomes "redis@sha256:...".
+// Images that are not available locally are pulled first. With localOnly nothing is pulled,
+// images that are not local or have no registry digest are left as they are with a warning.
+func (client *DockerClient) PinDigests(containers []*Container, localOnly bool) error {
+	// repo digests are only available in the list of images, so fetch it lazily
+	var all []docker.APIImages
+	getRepoDigests := func(id string) ([]string, error) {
+		if all == nil {
+			var err error
+			if all, err = client.Docker.ListImages(docker.ListImagesOptions{Digests: true}); err != nil {
+				return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+			}
+		}
+		for _, image := range all {
+			if image.ID == id {
+				return image.RepoDigests, nil
+			}
+		}
+		return nil, nil
+	}
+
+	for _, container := range containers {
+		if container.Image == nil {
+			return fmt.Errorf("Image is not specified for the container: %s", container.Name)
+		}
+		// image names may be shared between containers, so can be already pinned
+		if container.Image.TagIsSha() {
+			continue
+		}
+
+		pulled := false
+		img, err := client.Docker.InspectImage(container.Image.String())
+		if err == docker.ErrNoSuchImage && localOnly {
+			log.Warnf("Image %s for container %s is not pulled, its digest is not known", container.Image, container.Name)
+			continue
+		}
+		if err == docker.ErrNoSuchImage {
+			log.Infof("Pulling image: %s for %s", container.Image, container.Name)
+			source := client.Mirrors.Rewrite(container.Image)
+			if img, err = PullDockerImage(client.Docker, source, client.Auth.DockerAPIForImage(source)); err == nil && source != container.Image {
+				if err = tagMirroredImage(client.Docker, source, container.Image); err == nil {
+					img, err = client.Docker.InspectImage(container.Image.String())
+				}
+			}
+			pulled = true
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to inspect image %s for container %s, error: %s", container.Image, container.Name, err)
+		}
+		if pulled {
+			// list images again to get digests of the pulled one
+			all = nil
+		}
+
+		repoDigests, err := getRepoDigests(img.ID)
+		if err != nil {
+			return err
+		}
+
+		digest := findRepoDigest(container.Image, repoDigests)
+		if digest == "" {
+			// the image may be pulled from the mirror, which keeps the same digests
+			digest = findRepoDigest(client.Mirrors.Rewrite(container.Image), repoDigests)
+		}
+		if digest == "" && localOnly {
+			log.Warnf("Image %s for container %s has no registry digest, e.g. it is built locally", container.Image, container.Name)
+			continue
+		}
+		if digest == "" {
+			return fmt.Errorf("Image %s for container %s has no registry digest, it should be pushed to or pulled from a registry first",
+				container.Image, container.Name)
+		}
+
+		log.Infof("Pin %s --> %s", container.Image, digest)
+		container.Image.SetTag(digest)
+	}
+
+	return nil
+}
+
 // Internal
 
 func (client *DockerClient) listenReAttach(containers []*Container) {
@@ -618,48 +741,108 @@ func (client *DockerClient) flushContainerLogs(container *Container) {
 	}
 }
 
+// uploadSecrets puts secrets that have a target path as files to a created container,
+// this way their values appear neither in the label nor in `docker inspect`
+func (client *DockerClient) uploadSecrets(container *Container) error {
+	var (
+		buf bytes.Buffer
+		n   int
+		tw  = tar.NewWriter(&buf)
+	)
+
+	for _, secret := range container.Config.Secrets {
+		if secret.Target == "" {
+			continue
+		}
+		value := secret.Value()
+		hdr := &tar.Header{
+			Name:    strings.TrimPrefix(secret.Target, "/"),
+			Mode:    0444,
+			Size:    int64(len(value)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("Failed to write secret %s for container %s, error: %s", secret.Name, container.Name, err)
+		}
+		if _, err := tw.Write([]byte(value)); err != nil {
+			return fmt.Errorf("Failed to write secret %s for container %s, error: %s", secret.Name, container.Name, err)
+		}
+		n++
+	}
+
+	if n == 0 {
+		return nil
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("Uploading %d secret(s) to container %s", n, container.Name)
+
+	if err := client.Docker.UploadToContainer(container.ID, docker.UploadToContainerOptions{
+		InputStream: &buf,
+		Path:        "/",
+	}); err != nil {
+		return fmt.Errorf("Failed to upload secrets to container %s, error: %s", container.Name, err)
+	}
+
+	return nil
+}
+
 // pullImageForContainers goes through all containers and inspects their images
 // it pulls images if they cannot be found locally or forceUpdate flag is set to true
-func (client *DockerClient) pullImageForContainers(forceUpdate bool, vars template.Vars, containers ...*Container) (err error) {
+func (client *DockerClient) pullImageForContainers(forceUpdate bool, vars template.Vars, containers ...*Container) error {
 
 	if err := client.resolveVersions(true, forceUpdate, vars, containers); err != nil {
 		return err
 	}
 
 	var (
-		img    *docker.Image
-		pulled = map[string]*docker.Image{}
+		images   = map[string]*docker.Image{}
+		requests = []*pullRequest{}
 	)
 
-	// check images for each container
+	// check images for each container, collect the ones that should be pulled
 	for _, container := range containers {
 		if container.Image == nil {
-			err = fmt.Errorf("Cannot find image for container %s", container.Name)
-			return
+			return fmt.Errorf("Cannot find image for container %s", container.Name)
 		}
-		// already pulled it for other container, skip
-		if img, ok := pulled[container.Image.String()]; ok {
-			container.ImageID = img.ID
+		name := container.Image.String()
+
+		// already checked it for other container, skip
+		if _, ok := images[name]; ok {
 			continue
 		}
 
-		if img, err = client.Docker.InspectImage(container.Image.String()); err == docker.ErrNoSuchImage || forceUpdate {
-			log.Infof("Pulling image: %s for %s", container.Image, container.Name)
-			if img, err = PullDockerImage(client.Docker, container.Image, client.Auth.ToDockerAPI()); err != nil {
-				err = fmt.Errorf("Failed to pull image %s for container %s, error: %s", container.Image, container.Name, err)
-				return
-			}
-			client.pulledImages = append(client.pulledImages, container.Image)
+		img, err := client.inspectImage(container.Image)
+		if err == docker.ErrNoSuchImage || forceUpdate {
+			requests = append(requests, &pullRequest{image: container.Image, container: container})
+		} else if err != nil {
+			return fmt.Errorf("Failed to inspect image %s for container %s, error: %s", container.Image, container.Name, err)
 		}
+		images[name] = img
+	}
+
+	if len(requests) > 0 {
+		pulled, err := client.pullImages(requests)
 		if err != nil {
-			return
+			return err
+		}
+		for _, req := range requests {
+			name := req.image.String()
+			// forced pulls often fetch the image we already have, it is not a change
+			if prev := images[name]; prev == nil || pulled[name] == nil || prev.ID != pulled[name].ID {
+				client.pulledImages = append(client.pulledImages, req.image)
+			}
+			images[name] = pulled[name]
 		}
+	}
 
-		container.ImageID = img.ID
-		pulled[container.Image.String()] = img
+	for _, container := range containers {
+		container.ImageID = images[container.Image.String()].ID
 	}
 
-	return
+	return nil
 }
 
 // resolveVersions walks through the list of images and resolves their tags in case they are not strict
@@ -739,7 +922,7 @@ func (client *DockerClient) resolveVersions(local, hub bool, vars template.Vars,
 			log.Debugf("Getting list of tags for %s from the registry", container.Image)
 
 			var remote []*imagename.ImageName
-			if remote, err = imagename.RegistryListTags(container.Image); err != nil {
+			if remote, err = client.listRegistryTags(container.Image); err != nil {
 				return fmt.Errorf("Failed to list tags of image %s for container %s from the remote registry, error: %s",
 					container.Image, container.Name, err)
 			}
@@ -761,3 +944,83 @@ func (client *DockerClient) resolveVersions(local, hub bool, vars template.Vars,
 
 	return
 }
+
+// ListImageTags returns tags of the image available locally and/or in the registry
+func (client *DockerClient) ListImageTags(image *imagename.ImageName, local, hub bool) ([]*imagename.ImageName, error) {
+	tags := []*imagename.ImageName{}
+
+	if local {
+		dockerImages, err := client.Docker.ListImages(docker.ListImagesOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+		}
+		for _, dockerImage := range dockerImages {
+			for _, repoTag := range dockerImage.RepoTags {
+				if candidate := imagename.NewFromString(repoTag); image.IsSameKind(*candidate) {
+					tags = append(tags, candidate)
+				}
+			}
+		}
+	}
+
+	if hub {
+		// list all tags rather than the ones matching the image tag
+		all := imagename.New(image.NameWithRegistry(), "")
+		remote, err := client.listRegistryTags(all)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list tags of image %s from the remote registry, error: %s", image.NameWithRegistry(), err)
+		}
+		tags = append(tags, remote...)
+	}
+
+	return tags, nil
+}
+
+// GetImageDigests returns registry digests of images of given containers by image names,
+// images that were not pulled from a registry have no digests
+func (client *DockerClient) GetImageDigests(containers []*Container) (map[string]string, error) {
+	all, err := client.Docker.ListImages(docker.ListImagesOptions{Digests: true})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+	}
+
+	digests := map[string]string{}
+	for _, container := range containers {
+		if container.Image == nil {
+			continue
+		}
+		if container.Image.TagIsSha() {
+			digests[container.Image.String()] = container.Image.GetTag()
+			continue
+		}
+		for _, image := range all {
+			if image.ID == container.ImageID {
+				if digest := findRepoDigest(container.Image, image.RepoDigests); digest != "" {
+					digests[container.Image.String()] = digest
+				}
+			}
+		}
+	}
+	return digests, nil
+}
+
+// findRepoDigest returns the digest of the given image among the "name@sha256:..."
+// references, or an empty string if there is no such image
+func findRepoDigest(image *imagename.ImageName, repoDigests []string) string {
+	for _, ref := range repoDigests {
+		candidate := imagename.NewFromString(ref)
+		if candidate.TagIsSha() && normalizeImageName(candidate) == normalizeImageName(image) {
+			return candidate.GetTag()
+		}
+	}
+	return ""
+}
+
+// normalizeImageName strips default registry and namespace of Docker Hub images,
+// which may or may not be present in references given by Docker
+func normalizeImageName(image *imagename.ImageName) string {
+	name := image.NameWithRegistry()
+	name = strings.TrimPrefix(name, "docker.io/")
+	name = strings.TrimPrefix(name, "library/")
+	return name
+}
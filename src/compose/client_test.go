@@ -180,7 +180,7 @@ containers:
 		t.Fatal(err)
 	}
 
-	if err := cli.Clean(config); err != nil {
+	if err := cli.Clean(config, nil, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -241,3 +241,15 @@ func TestClientResolveVersions(t *testing.T) {
 
 	pretty.Println(containers)
 }
+
+func TestFindRepoDigest(t *testing.T) {
+	digest := "sha256:bc8813ea7b3603864987522f02a76101c17ad122e1c46d790efc0fca78ca7bfb"
+	repoDigests := []string{
+		"quay.io/myapp@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		"docker.io/library/redis@" + digest,
+	}
+
+	assert.Equal(t, digest, findRepoDigest(imagename.NewFromString("redis:3.0.5"), repoDigests))
+	assert.Equal(t, "", findRepoDigest(imagename.NewFromString("myapp:1.0"), repoDigests))
+	assert.Equal(t, "", findRepoDigest(imagename.NewFromString("redis:3.0.5"), []string{"redis:3.0.5"}))
+}
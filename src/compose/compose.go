@@ -24,11 +24,13 @@ import (
 	"compose/ansible"
 	"compose/config"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
 	"github.com/grammarly/rocker/src/rocker/template"
 	"github.com/kr/pretty"
 )
@@ -38,15 +40,40 @@ import (
 type Config struct {
 	Manifest   *config.Config
 	Docker     *docker.Client
+	DockerHost string
 	Force      bool
 	DryRun     bool
 	Attach     bool
 	Pull       bool
+	Build      bool
 	Remove     bool
 	Recover    bool
 	Wait       time.Duration
 	Auth       *AuthConfig
 	KeepImages int
+
+	PullConcurrency int
+	PullRetries     int
+
+	CleanOlderThan time.Duration
+	CleanKeepTags  []string
+
+	Mirrors Mirrors
+
+	LockHolder  string
+	LockTTL     time.Duration
+	LockTimeout time.Duration
+
+	History  *History
+	Revision *Revision
+
+	Events   *EventStream
+	Metrics  *Metrics
+	Notifier *Notifier
+
+	StateDir string
+	Resume   bool
+	Host     string
 }
 
 // Compose is the main object that executes actions and holds runtime information.
@@ -55,13 +82,31 @@ type Compose struct {
 	DryRun   bool
 	Attach   bool
 	Pull     bool
+	Build    bool
 	Remove   bool
 	Wait     time.Duration
 
+	LockHolder  string        // describes this run in the deploy lock
+	LockTTL     time.Duration // deploy lock expires after it, DefaultDeployLockTTL if zero
+	LockTimeout time.Duration // how long to wait for the deploy lock held by another run
+
+	History  *History  // successful runs are recorded to it, if given
+	Revision *Revision // what is recorded, completed with results of the run
+
+	Events   *EventStream // progress of the deploy is written to it, if given
+	Metrics  *Metrics     // metrics of the deploy are recorded to it, if given
+	Notifier *Notifier    // outcomes of runs are sent to it and to the notify section of the manifest
+
+	StateDir string // journals of deploys are kept in it, if given
+	Resume   bool   // reconcile the plan with the journal of the interrupted deploy
+	Host     string // inventory host deployed to by run --hosts, its journal is kept apart
+
 	client             Client
 	chErrors           chan error
 	attachedContainers map[string]struct{}
 	executionPlan      []Action
+	recorded           *Revision
+	rollbackImages     map[string]*RevisionImage // images of the revision rolled back to, by container name
 }
 
 // New makes a new Compose object
@@ -71,8 +116,24 @@ func New(config *Config) (*Compose, error) {
 		DryRun:   config.DryRun,
 		Attach:   config.Attach,
 		Pull:     config.Pull,
+		Build:    config.Build,
 		Wait:     config.Wait,
 		Remove:   config.Remove,
+
+		LockHolder:  config.LockHolder,
+		LockTTL:     config.LockTTL,
+		LockTimeout: config.LockTimeout,
+
+		History:  config.History,
+		Revision: config.Revision,
+
+		Events:   config.Events,
+		Metrics:  config.Metrics,
+		Notifier: config.Notifier,
+
+		StateDir: config.StateDir,
+		Resume:   config.Resume,
+		Host:     config.Host,
 	}
 
 	cliConf := &DockerClient{
@@ -82,6 +143,18 @@ func New(config *Config) (*Compose, error) {
 		Auth:       config.Auth,
 		KeepImages: config.KeepImages,
 		Recover:    config.Recover,
+		DockerHost: config.DockerHost,
+
+		PullConcurrency: config.PullConcurrency,
+		PullRetries:     config.PullRetries,
+
+		CleanOlderThan: config.CleanOlderThan,
+		CleanKeepTags:  config.CleanKeepTags,
+
+		Mirrors: config.Mirrors,
+
+		Events:  config.Events,
+		Metrics: config.Metrics,
 	}
 
 	cli, err := NewClient(cliConf)
@@ -96,27 +169,130 @@ func New(config *Config) (*Compose, error) {
 }
 
 // RunAction implements 'rocker-compose run'
-func (compose *Compose) RunAction() error {
+func (compose *Compose) RunAction() (err error) {
+	start := time.Now()
+
+	// the compose may be run again, e.g. by watch, results of the previous run should not be reported
+	compose.executionPlan = nil
+	compose.recorded = nil
+
+	stage := "lock" // the reason of the failure for metrics
+	defer func() {
+		finished := &Event{
+			Type:      EventFinished,
+			Namespace: compose.Manifest.Namespace,
+			Duration:  time.Since(start).Seconds(),
+		}
+		if err != nil {
+			finished.Error = err.Error()
+			compose.Metrics.ObserveFailure(stage)
+		} else if !compose.DryRun {
+			compose.Metrics.SetLastReconcile(time.Now())
+		}
+		compose.Events.Emit(finished)
+
+		// the lock is released by now, slow deliveries do not hold it
+		if !compose.DryRun {
+			compose.notify(err, time.Since(start))
+		}
+	}()
+
+	expected, err := compose.deploy(&stage)
+	if err != nil {
+		return err
+	}
+
+	// if --attach was specified
+	if compose.Attach {
+		stage = "attach"
+		log.Debugf("Attaching to containers...")
+		if err := compose.client.AttachToContainers(expected); err != nil {
+			return fmt.Errorf("Cannot attach to containers, error: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// deploy brings containers of the manifest to the expected state under the deploy lock
+// and returns them; the lock is released on return, so attaching does not hold it.
+// The stage is updated to report the reason of a failure.
+func (compose *Compose) deploy(stage *string) (expected []*Container, err error) {
+	// concurrent runs against the namespace would interleave removes and creates
+	if !compose.DryRun {
+		lock, err := compose.client.AcquireDeployLock(compose.Manifest.Namespace, compose.LockHolder, compose.LockTTL, compose.LockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := compose.client.ReleaseDeployLock(lock); err != nil {
+				log.Errorf("%s", err)
+			}
+		}()
+	}
+
+	// the journal is read and replaced under the lock, and finished before the lock is released
+	previous, err := compose.readJournal()
+	if err != nil {
+		return nil, err
+	}
+
 	// get the actual list of existing containers from docker client
+	*stage = "inspect"
 	actual, err := compose.client.GetContainers(compose.Manifest.HasExternalRefs())
 	if err != nil {
-		return fmt.Errorf("GetContainers failed with error, error: %s", err)
+		return nil, fmt.Errorf("GetContainers failed with error, error: %s", err)
 	}
 
-	expected := []*Container{}
+	expected = []*Container{}
+	keep := []config.ContainerName{}
 
 	// if --remove was specified, pretend we expect to have an empty list of containers
 	if !compose.Remove {
 		expected = GetContainersFromConfig(compose.Manifest)
+		// containers of inactive profiles are not run, but should not be removed either
+		keep = GetInactiveContainerNames(compose.Manifest)
+	}
+
+	// with --build, images of containers having the build key are built and then
+	// taken as local images, they are never pulled
+	toPull, toFetch := expected, []*Container{}
+	if compose.Build {
+		*stage = "build"
+		if err := compose.client.BuildImages(expected); err != nil {
+			return nil, fmt.Errorf("Failed to build images, error: %s", err)
+		}
+		toPull, toFetch = splitBuiltContainers(expected)
 	}
 
 	// if --pull is specified PullAll, otherwise Fetch required
-	if compose.Pull {
-		if err := compose.client.PullAll(expected, compose.Manifest.Vars); err != nil {
-			return err
+	*stage = "pull"
+	switch {
+	case compose.DryRun:
+		// dry runs never pull, so that they do not change the host, e.g. in Ansible check mode
+		if err := compose.client.ResolveImages(toPull, compose.Pull, compose.Manifest.Vars); err != nil {
+			return nil, fmt.Errorf("Failed to resolve images of given containers, error: %s", err)
+		}
+		if len(toFetch) > 0 {
+			if err := compose.client.ResolveImages(toFetch, false, compose.Manifest.Vars); err != nil {
+				return nil, fmt.Errorf("Failed to resolve images of given containers, error: %s", err)
+			}
+		}
+		toFetch = nil
+	case compose.Pull:
+		if err := compose.client.PullAll(toPull, compose.Manifest.Vars); err != nil {
+			return nil, err
+		}
+	default:
+		toFetch = expected
+	}
+	if len(toFetch) > 0 {
+		if err := compose.client.FetchImages(toFetch, compose.Manifest.Vars); err != nil {
+			return nil, fmt.Errorf("Failed to fetch images of given containers, error: %s", err)
 		}
-	} else if err := compose.client.FetchImages(expected, compose.Manifest.Vars); err != nil {
-		return fmt.Errorf("Failed to fetch images of given containers, error: %s", err)
+	}
+	if err := compose.checkRollbackImages(expected); err != nil {
+		return nil, err
 	}
 
 	// Assign IDs of existing containers
@@ -128,21 +304,48 @@ func (compose *Compose) RunAction() error {
 		}
 	}
 
-	executionPlan, err := NewDiff(compose.Manifest.Namespace).Diff(expected, actual)
+	*stage = "diff"
+	executionPlan, err := NewDiff(compose.Manifest.Namespace, keep...).Diff(expected, actual)
 	if err != nil {
-		return fmt.Errorf("Diff of configuration failed, error: %s", err)
+		return nil, fmt.Errorf("Diff of configuration failed, error: %s", err)
 	}
 	compose.executionPlan = executionPlan
 
+	plan := []string{}
+	WalkActions(executionPlan, func(action Action) {
+		if action != NoAction {
+			plan = append(plan, action.String())
+		}
+	})
+
+	if compose.Resume {
+		if err := resumeJournal(previous, plan); err != nil {
+			return nil, err
+		}
+	} else if previous.Interrupted() {
+		log.Warnf("Previous %s was interrupted, run with --resume to check the plan against it", previous)
+	}
+
+	// the journal of the interrupted deploy is kept until the plan is going to be executed
+	journal, err := compose.createJournal()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { journal.Finish(err) }()
+
+	events := compose.Events.Tee(journal.Events())
+	events.Emit(&Event{Type: EventPlan, Namespace: compose.Manifest.Namespace, Plan: plan})
+
 	var runner Runner
 	if compose.DryRun {
 		runner = NewDryRunner()
 	} else {
-		runner = NewDockerClientRunner(compose.client)
+		runner = &dockerClientRunner{client: compose.client, events: events, metrics: compose.Metrics}
 	}
 
+	*stage = "execute"
 	if err := runner.Run(executionPlan); err != nil {
-		return fmt.Errorf("Execution failed with, error: %s", err)
+		return nil, fmt.Errorf("Execution failed with, error: %s", err)
 	}
 
 	strContainers := []string{}
@@ -158,15 +361,14 @@ func (compose *Compose) RunAction() error {
 		log.Infof("Nothing is running")
 	}
 
-	// if --attach was specified
-	if compose.Attach {
-		log.Debugf("Attaching to containers...")
-		if err := compose.client.AttachToContainers(expected); err != nil {
-			return fmt.Errorf("Cannot attach to containers, error: %s", err)
+	// the deploy succeeded anyway, so failing to record it is not fatal
+	if compose.History != nil && compose.Revision != nil && !compose.DryRun {
+		if err := compose.recordRevision(expected); err != nil {
+			log.Errorf("Failed to record the revision, error: %s", err)
 		}
 	}
 
-	return nil
+	return expected, nil
 }
 
 // RecoverAction implements 'rocker-compose recover'
@@ -223,6 +425,12 @@ func (compose *Compose) RecoverAction() error {
 	return nil
 }
 
+// ForceUnlockAction implements 'rocker-compose force-unlock', it removes the deploy lock
+// of the namespace and returns it, or nil if the namespace is not locked
+func (compose *Compose) ForceUnlockAction() (*DeployLock, error) {
+	return compose.client.ForceUnlock(compose.Manifest.Namespace)
+}
+
 // PullAction implements 'rocker-compose pull'
 func (compose *Compose) PullAction() error {
 	containers := GetContainersFromConfig(compose.Manifest)
@@ -233,29 +441,152 @@ func (compose *Compose) PullAction() error {
 	return nil
 }
 
-// CleanAction implements 'rocker-compose clean'
+// CleanAction implements 'rocker-compose clean'. With --dry, it only lists
+// the images that would be removed.
 func (compose *Compose) CleanAction() error {
-	if err := compose.client.Clean(compose.Manifest); err != nil {
+	recorded, err := compose.recordedImageIDs()
+	if err != nil {
+		return err
+	}
+	if err := compose.client.Clean(compose.Manifest, recorded, compose.DryRun); err != nil {
 		return fmt.Errorf("Failed to clean old images, error: %s", err)
 	}
 
 	return nil
 }
 
-// PinAction implements 'rocker-compose pin'
-func (compose *Compose) PinAction(local, hub bool) (template.Vars, error) {
+// PinAction implements 'rocker-compose pin'. If digest is true, images are pinned
+// by content digests of their registry manifests instead of tags. If the previous lock
+// is given, containers other than the ones to update keep their locked versions.
+// Returns the variables with resolved versions and the new lock.
+func (compose *Compose) PinAction(local, hub, digest bool, prev *Lock, update []string) (template.Vars, *Lock, error) {
+	for _, name := range update {
+		if _, ok := compose.Manifest.Containers[name]; !ok {
+			return nil, nil, fmt.Errorf("Cannot update container %s, it is not found in the manifest", name)
+		}
+	}
+
+	if prev != nil {
+		prev.Apply(compose.Manifest, update...)
+	}
+
 	containers := GetContainersFromConfig(compose.Manifest)
 	if err := compose.client.Pin(local, hub, compose.Manifest.Vars, containers); err != nil {
-		return nil, fmt.Errorf("Failed to pin, error: %s", err)
+		return nil, nil, fmt.Errorf("Failed to pin, error: %s", err)
+	}
+
+	lock := &Lock{
+		ResolvedAt: time.Now().UTC().Truncate(time.Second),
+		Containers: map[string]*LockEntry{},
+	}
+	for _, c := range containers {
+		entry := &LockEntry{Image: *c.Config.Image}
+		if c.Image.TagIsSha() {
+			entry.Digest = c.Image.GetTag()
+		} else {
+			entry.Tag = c.Image.GetTag()
+		}
+		if !digest {
+			entry.Pin = LockPinTag
+		}
+		lock.Containers[c.Name.Name] = entry
 	}
 
+	// digests are recorded whenever they are known locally, --digest makes runs use them
+	// and pulls images to get them
+	if err := compose.client.PinDigests(containers, !digest); err != nil {
+		return nil, nil, fmt.Errorf("Failed to pin digests, error: %s", err)
+	}
+	for _, c := range containers {
+		if c.Image.TagIsSha() {
+			lock.Containers[c.Name.Name].Digest = c.Image.GetTag()
+		}
+	}
+
+	lock.inherit(prev)
+
 	// Populate versions to the variables
 	vars := compose.Manifest.Vars
 	for _, c := range containers {
-		vars[fmt.Sprintf("v_container_%s", c.Name.Name)] = c.Image.GetTag()
+		vars[fmt.Sprintf("v_container_%s", c.Name.Name)] = lock.Containers[c.Name.Name].Version()
+	}
+
+	return vars, lock, nil
+}
+
+// Changes returns descriptions of containers created and removed by the last run
+func (compose *Compose) Changes() []string {
+	changes := []string{}
+	WalkActions(compose.executionPlan, func(action Action) {
+		switch action.(type) {
+		case *removeContainer, *runContainer:
+			changes = append(changes, action.String())
+		}
+	})
+	return changes
+}
+
+// changedContainers returns names of containers removed or run by the last RunAction,
+// a recreated container is counted once
+func (compose *Compose) changedContainers() map[string]struct{} {
+	names := map[string]struct{}{}
+	WalkActions(compose.executionPlan, func(action Action) {
+		switch a := action.(type) {
+		case *removeContainer:
+			names[a.container.Name.String()] = struct{}{}
+		case *runContainer:
+			names[a.container.Name.String()] = struct{}{}
+		}
+	})
+	return names
+}
+
+// Status returns containers of the namespace and their state, sorted by name
+func (compose *Compose) Status() ([]*ServerContainer, error) {
+	containers, err := compose.client.GetContainers(false)
+	if err != nil {
+		return nil, err
+	}
+
+	status := []*ServerContainer{}
+	for _, container := range containers {
+		if container.Name.Namespace != compose.Manifest.Namespace {
+			continue
+		}
+		c := &ServerContainer{
+			Name: container.Name.String(),
+			ID:   container.ID,
+		}
+		if container.Image != nil {
+			c.Image = container.Image.String()
+		}
+		if container.State != nil {
+			c.Running = container.State.Running
+			c.ExitCode = container.State.ExitCode
+			c.StartedAt = container.State.StartedAt
+			c.FinishedAt = container.State.FinishedAt
+		}
+		status = append(status, c)
 	}
+	sort.Sort(serverContainersByName(status))
 
-	return vars, nil
+	return status, nil
+}
+
+// readJournal reads the journal of the previous deploy, nil without the state dir
+func (compose *Compose) readJournal() (*JournalState, error) {
+	if compose.StateDir == "" {
+		return nil, nil
+	}
+	return ReadJournal(compose.StateDir, compose.Manifest.Namespace, compose.Host)
+}
+
+// createJournal replaces the journal of the namespace, dry runs keep it
+func (compose *Compose) createJournal() (*Journal, error) {
+	if compose.StateDir == "" || compose.DryRun {
+		return nil, nil
+	}
+	return CreateJournal(compose.StateDir, compose.Manifest.Namespace, compose.Host)
 }
 
 // WritePlan saves various rocker-compose change information to the ansible.Response object
@@ -270,19 +601,20 @@ func (compose *Compose) WritePlan(resp *ansible.Response) *ansible.Response {
 	WalkActions(compose.executionPlan, func(action Action) {
 		if a, ok := action.(*removeContainer); ok {
 			resp.Removed = append(resp.Removed, ansible.ResponseContainer{
-				ID:   a.container.ID,
-				Name: a.container.Name.String(),
+				ID:     a.container.ID,
+				Name:   a.container.Name.String(),
+				Reason: a.reason,
 			})
 		}
 		if a, ok := action.(*runContainer); ok {
 			resp.Created = append(resp.Created, ansible.ResponseContainer{
-				ID:   a.container.ID,
-				Name: a.container.Name.String(),
+				ID:     a.container.ID,
+				Name:   a.container.Name.String(),
+				Reason: a.reason,
 			})
 		}
 	})
 
-	// TODO: images are pulled but may not be changed
 	for _, imageName := range compose.client.GetPulledImages() {
 		resp.Pulled = append(resp.Pulled, imageName.String())
 	}
@@ -290,7 +622,62 @@ func (compose *Compose) WritePlan(resp *ansible.Response) *ansible.Response {
 	for _, imageName := range compose.client.GetRemovedImages() {
 		resp.Cleaned = append(resp.Cleaned, imageName.String())
 	}
+	for _, imageName := range compose.client.GetCleanableImages() {
+		resp.Cleanable = append(resp.Cleanable, imageName.String())
+	}
+	resp.Reclaimed = compose.client.GetReclaimedSpace()
+
+	resp.Changed = len(resp.Removed)+len(resp.Created)+len(resp.Pulled)+len(resp.Cleaned) > 0
+	return resp
+}
+
+// WriteDiff saves configs of containers changed by the recent run to the ansible.Response
+// object, before is the config of the live container and after is the desired one
+func (compose *Compose) WriteDiff(resp *ansible.Response) *ansible.Response {
+	var (
+		diffs = map[string]*ansible.Diff{}
+		names = []string{}
+	)
+
+	diff := func(container *Container) *ansible.Diff {
+		name := container.Name.String()
+		if _, ok := diffs[name]; !ok {
+			diffs[name] = &ansible.Diff{BeforeHeader: name, AfterHeader: name}
+			names = append(names, name)
+		}
+		return diffs[name]
+	}
+
+	WalkActions(compose.executionPlan, func(action Action) {
+		if a, ok := action.(*removeContainer); ok {
+			diff(a.container).Before = containerYaml(a.container)
+		}
+		if a, ok := action.(*runContainer); ok {
+			diff(a.container).After = containerYaml(a.container)
+		}
+	})
 
-	resp.Changed = len(resp.Removed)+len(resp.Created)+len(resp.Pulled) > 0
+	resp.Diff = []ansible.Diff{}
+	for _, name := range names {
+		resp.Diff = append(resp.Diff, *diffs[name])
+	}
 	return resp
 }
+
+// containerYaml returns the config of a container as YAML, with the image it runs
+func containerYaml(container *Container) string {
+	if container.Config == nil {
+		return ""
+	}
+	cfg := *container.Config
+	if cfg.Image == nil && container.Image != nil {
+		image := container.Image.String()
+		cfg.Image = &image
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		log.Debugf("Failed to marshal config of container %s, error: %s", container.Name, err)
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,123 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/ansible"
+	"compose/config"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestComposeWritePlanNoChanges(t *testing.T) {
+	client := &clientMock{}
+	client.On("GetPulledImages").Return(nil)
+	client.On("GetRemovedImages").Return(nil)
+	client.On("GetCleanableImages").Return(nil)
+	client.On("GetReclaimedSpace").Return(nil)
+
+	compose := &Compose{
+		client:        client,
+		executionPlan: []Action{NewStepAction(false, NoAction)},
+	}
+
+	resp := compose.WritePlan(&ansible.Response{})
+	assert.False(t, resp.Changed)
+	assert.Empty(t, resp.Created)
+	assert.Empty(t, resp.Removed)
+}
+
+func TestComposeWritePlanCleanDryRun(t *testing.T) {
+	client := &clientMock{}
+	client.On("GetPulledImages").Return(nil)
+	client.On("GetRemovedImages").Return(nil)
+	client.On("GetCleanableImages").Return([]*imagename.ImageName{imagename.NewFromString("myapp:1.0")})
+	client.On("GetReclaimedSpace").Return(nil)
+
+	compose := &Compose{client: client, DryRun: true}
+
+	resp := compose.WritePlan(&ansible.Response{})
+	assert.False(t, resp.Changed)
+	assert.Empty(t, resp.Cleaned)
+	assert.Equal(t, []string{"myapp:1.0"}, resp.Cleanable)
+}
+
+func TestComposeWriteDiff(t *testing.T) {
+	oldImage, newImage := "app:1", "app:2"
+	live := &Container{
+		ID:     "123",
+		Name:   config.NewContainerName("app", "web"),
+		Config: &config.Container{Image: &oldImage},
+	}
+	desired := &Container{
+		Name:   config.NewContainerName("app", "web"),
+		Config: &config.Container{Image: &newImage},
+	}
+	added := &Container{
+		Name:   config.NewContainerName("app", "db"),
+		Config: &config.Container{Image: &newImage},
+	}
+
+	compose := &Compose{
+		executionPlan: []Action{
+			NewStepAction(false, &removeContainer{container: live}),
+			NewStepAction(true, &runContainer{container: desired}, &runContainer{container: added}),
+		},
+	}
+
+	resp := compose.WriteDiff(&ansible.Response{})
+	assert.Equal(t, []ansible.Diff{
+		{BeforeHeader: "app.web", AfterHeader: "app.web", Before: "image: app:1\n", After: "image: app:2\n"},
+		{BeforeHeader: "app.db", AfterHeader: "app.db", Before: "", After: "image: app:2\n"},
+	}, resp.Diff)
+}
+
+func TestComposeChangedContainers(t *testing.T) {
+	web, db := newContainer("app", "web"), newContainer("app", "db")
+
+	compose := &Compose{
+		executionPlan: []Action{
+			NewStepAction(false, NewRecreateContainerActions(web, web, "image changed")...),
+			NewStepAction(true, NewRunContainerAction(db), NewEnsureContainerStateAction(web)),
+		},
+	}
+
+	assert.Equal(t, map[string]struct{}{"app.web": {}, "app.db": {}}, compose.changedContainers())
+}
+
+func TestComposeRunActionDryRunDoesNotPull(t *testing.T) {
+	image := "myapp:1.2.3"
+	manifest := &config.Config{
+		Namespace:  "app",
+		Containers: map[string]*config.Container{"web": {Image: &image}},
+	}
+
+	client := &clientMock{}
+	client.On("GetContainers").Return(nil)
+	client.On("ResolveImages", mock.Anything, true, mock.Anything).Return(nil)
+
+	compose := &Compose{Manifest: manifest, DryRun: true, Pull: true, client: client}
+
+	assert.Nil(t, compose.RunAction())
+	assert.Equal(t, []string{"Creating container 'app.web'"}, compose.Changes())
+	client.AssertNotCalled(t, "PullAll", mock.Anything, mock.Anything)
+	client.AssertNotCalled(t, "FetchImages", mock.Anything, mock.Anything)
+	client.AssertNotCalled(t, "AcquireDeployLock", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
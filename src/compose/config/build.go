@@ -0,0 +1,69 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import "fmt"
+
+// Build describes how to build the image of the container with `run --build`.
+// The built image is tagged with the container's image name. Either a short form
+// with the context directory, or the full form can be given:
+//
+//	build: ./app
+//
+//	build:
+//	  context: ./app
+//	  dockerfile: Dockerfile.dev
+//	  args:
+//	    VERSION: 1.2.3
+type Build struct {
+	Context    string    `yaml:"context,omitempty"`    // directory of the build context, relative to the manifest
+	Dockerfile string    `yaml:"dockerfile,omitempty"` // Dockerfile within the context, "Dockerfile" by default
+	Rockerfile string    `yaml:"rockerfile,omitempty"` // Rockerfile within the context, built by the rocker executable
+	Args       StringMap `yaml:"args,omitempty"`       // build arguments, passed as --var to rocker
+}
+
+// UnmarshalYAML unserialize Build object from YAML, string is the context directory
+func (b *Build) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var context string
+	if err := unmarshal(&context); err == nil {
+		*b = Build{Context: context}
+		return nil
+	}
+
+	// alias type to avoid the recursion
+	type build Build
+	value := build{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*b = Build(value)
+	return nil
+}
+
+// resolve validates the build spec and makes the context path relative to the manifest
+func (b *Build) resolve(resolvePath func(string) (string, error)) (err error) {
+	if b.Dockerfile != "" && b.Rockerfile != "" {
+		return fmt.Errorf("Either dockerfile or rockerfile can be given for the build, not both")
+	}
+	if b.Context == "" {
+		b.Context = "."
+	}
+	if b.Context, err = resolvePath(b.Context); err != nil {
+		return err
+	}
+	return nil
+}
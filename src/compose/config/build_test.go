@@ -0,0 +1,85 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigBuild(t *testing.T) {
+	configStr := `namespace: test
+containers:
+  short:
+    image: myapp:dev
+    build: ./app
+  full:
+    image: worker:dev
+    build:
+      context: worker
+      dockerfile: Dockerfile.dev
+      args:
+        VERSION: 1.2.3
+  child:
+    extends: full
+    image: worker:child`
+
+	cfg, err := ReadConfig("testdata/compose.yml", strings.NewReader(configStr), template.Vars{}, map[string]interface{}{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := "testdata"
+
+	assert.Equal(t, &Build{Context: filepath.Join(dir, "app")}, cfg.Containers["short"].Build)
+	assert.Equal(t, &Build{
+		Context:    filepath.Join(dir, "worker"),
+		Dockerfile: "Dockerfile.dev",
+		Args:       StringMap{"VERSION": "1.2.3"},
+	}, cfg.Containers["full"].Build)
+	assert.Equal(t, cfg.Containers["full"].Build, cfg.Containers["child"].Build)
+
+	// build does not affect the comparison of containers
+	a := &Container{Build: &Build{Context: "a"}}
+	b := &Container{Build: &Build{Context: "b"}}
+	assert.True(t, a.IsEqualTo(b))
+}
+
+func TestConfigBuildInvalid(t *testing.T) {
+	configStr := `namespace: test
+containers:
+  main:
+    build: ./app`
+
+	_, err := ReadConfig("testdata/compose.yml", strings.NewReader(configStr), template.Vars{}, map[string]interface{}{}, false)
+	assert.Contains(t, err.Error(), "image should be given")
+
+	configStr = `namespace: test
+containers:
+  main:
+    image: myapp:dev
+    build:
+      dockerfile: Dockerfile
+      rockerfile: Rockerfile`
+
+	_, err = ReadConfig("testdata/compose.yml", strings.NewReader(configStr), template.Vars{}, map[string]interface{}{}, false)
+	assert.Contains(t, err.Error(), "not both")
+}
@@ -31,6 +31,10 @@ func (a *Container) LastCompareField() string {
 // IsEqualTo compares the container spec against another one.
 // It returns false if at least one property is unequal.
 func (a *Container) IsEqualTo(b *Container) bool {
+	// secrets from the label are hashed, hash the resolved ones with same salts
+	a.Secrets.adoptSalts(b.Secrets)
+	b.Secrets.adoptSalts(a.Secrets)
+
 	for _, field := range getComparableFields() {
 		a.lastCompareField = field
 		if equal, _ := compareYaml(field, a, b); !equal {
@@ -194,6 +194,17 @@ func TestConfigIsEqualTo(t *testing.T) {
 				check{shouldNotEqual, "KEY:\n  - name: nofile\n    soft: 1024\n    hard: 2048\n  - name: /app\n    soft: 1024\n    hard: 2048", ""},
 			},
 		},
+		// type: []Secret
+		fieldSpec{
+			[]string{"Secrets"},
+			[]check{
+				check{shouldEqual, "", ""},
+				check{shouldEqual, "KEY:\n  - name: db\n    env: DB\n    hash: sha256:aa:bb", "KEY:\n  - name: db\n    env: DB\n    hash: sha256:aa:bb"},
+				check{shouldNotEqual, "KEY:\n  - name: db\n    env: DB\n    hash: sha256:aa:bb", ""},
+				check{shouldNotEqual, "KEY:\n  - name: db\n    env: DB\n    hash: sha256:aa:bb", "KEY:\n  - name: db\n    env: DB\n    hash: sha256:aa:cc"},
+				check{shouldNotEqual, "KEY:\n  - name: db\n    env: DB\n    hash: sha256:aa:bb", "KEY:\n  - name: db\n    env: DB_PASSWORD\n    hash: sha256:aa:bb"},
+			},
+		},
 		// type: map[string]string
 		fieldSpec{
 			[]string{"Labels", "Env", "Extra", "LogOpt"},
@@ -26,12 +26,14 @@ package config
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"util"
 
 	"github.com/grammarly/rocker/src/rocker/imagename"
 	"github.com/grammarly/rocker/src/rocker/template"
@@ -45,47 +47,55 @@ import (
 type Config struct {
 	Namespace  string // All containers names under current compose.yml will be prefixed with this namespace
 	Containers map[string]*Container
+	Notify     *Notify // where outcomes of runs are sent, see notify.go
 	Vars       template.Vars
+	Profiles   []string // Active profiles, containers tagged only for other profiles are not run
+	Rendered   string   `yaml:"-"` // The manifest after rendering the template, before parsing
 }
 
 // Container represents a single container spec from compose.yml
 type Container struct {
-	Extends         string         `yaml:"extends,omitempty"`           // can extend from other container spec referring by name
-	Image           *string        `yaml:"image,omitempty"`             //
-	Net             *Net           `yaml:"net,omitempty"`               //
-	Pid             *string        `yaml:"pid,omitempty"`               //
-	Uts             *string        `yaml:"uts,omitempty"`               //
-	State           *State         `yaml:"state,omitempty"`             // "running" or "created" or "ran"
-	DNS             Strings        `yaml:"dns,omitempty"`               //
-	AddHost         Strings        `yaml:"add_host,omitempty"`          //
-	Restart         *RestartPolicy `yaml:"restart,omitempty"`           //
-	Memory          *Memory        `yaml:"memory,omitempty"`            //
-	MemorySwap      *Memory        `yaml:"memory_swap,omitempty"`       //
-	CPUShares       *int64         `yaml:"cpu_shares,omitempty"`        //
-	CpusetCpus      *string        `yaml:"cpuset_cpus,omitempty"`       //
-	OomKillDisable  *bool          `yaml:"oom_kill_disable,omitempty"`  // e.g. docker run --oom-kill-disable TODO: pull request to go-dockerclient
-	Ulimits         []Ulimit       `yaml:"ulimits,omitempty"`           // search by "Ulimits" here https://goo.gl/IxbZck
-	Privileged      *bool          `yaml:"privileged,omitempty"`        //
-	Cmd             Cmd            `yaml:"cmd,omitempty"`               //
-	Entrypoint      Strings        `yaml:"entrypoint,omitempty"`        //
-	Expose          Strings        `yaml:"expose,omitempty"`            //
-	Ports           Ports          `yaml:"ports,omitempty"`             //
-	LogDriver       *string        `yaml:"log_driver,omitempty"`        //
-	LogOpt          StringMap      `yaml:"log_opt,omitempty"`           //
-	PublishAllPorts *bool          `yaml:"publish_all_ports,omitempty"` //
-	Labels          StringMap      `yaml:"labels,omitempty"`            //
-	Env             StringMap      `yaml:"env,omitempty"`               //
-	VolumesFrom     ContainerNames `yaml:"volumes_from,omitempty"`      //
-	Volumes         Strings        `yaml:"volumes,omitempty"`           //
-	Links           Links          `yaml:"links,omitempty"`             //
-	WaitFor         ContainerNames `yaml:"wait_for,omitempty"`          //
-	KillTimeout     *uint          `yaml:"kill_timeout,omitempty"`      //
-	Hostname        *string        `yaml:"hostname,omitempty"`          //
-	Domainname      *string        `yaml:"domainname,omitempty"`        //
-	User            *string        `yaml:"user,omitempty"`              //
-	Workdir         *string        `yaml:"workdir,omitempty"`           //
-	NetworkDisabled *bool          `yaml:"network_disabled,omitempty"`  // TODO: do we need this?
-	KeepVolumes     *bool          `yaml:"keep_volumes,omitempty"`      //
+	Extends           string         `yaml:"extends,omitempty"`             // can extend from other container spec referring by name
+	Image             *string        `yaml:"image,omitempty"`               //
+	Build             *Build         `yaml:"build,omitempty"`               // how to build the image with `run --build`, see build.go
+	Net               *Net           `yaml:"net,omitempty"`                 //
+	Pid               *string        `yaml:"pid,omitempty"`                 //
+	Uts               *string        `yaml:"uts,omitempty"`                 //
+	State             *State         `yaml:"state,omitempty"`               // "running" or "created" or "ran"
+	DNS               Strings        `yaml:"dns,omitempty"`                 //
+	AddHost           Strings        `yaml:"add_host,omitempty"`            //
+	Restart           *RestartPolicy `yaml:"restart,omitempty"`             //
+	Memory            *Memory        `yaml:"memory,omitempty"`              //
+	MemorySwap        *Memory        `yaml:"memory_swap,omitempty"`         //
+	CPUShares         *int64         `yaml:"cpu_shares,omitempty"`          //
+	CpusetCpus        *string        `yaml:"cpuset_cpus,omitempty"`         //
+	OomKillDisable    *bool          `yaml:"oom_kill_disable,omitempty"`    // e.g. docker run --oom-kill-disable TODO: pull request to go-dockerclient
+	Ulimits           []Ulimit       `yaml:"ulimits,omitempty"`             // search by "Ulimits" here https://goo.gl/IxbZck
+	Privileged        *bool          `yaml:"privileged,omitempty"`          //
+	Cmd               Cmd            `yaml:"cmd,omitempty"`                 //
+	Entrypoint        Strings        `yaml:"entrypoint,omitempty"`          //
+	Expose            Strings        `yaml:"expose,omitempty"`              //
+	Ports             Ports          `yaml:"ports,omitempty"`               //
+	LogDriver         *string        `yaml:"log_driver,omitempty"`          //
+	LogOpt            StringMap      `yaml:"log_opt,omitempty"`             //
+	PublishAllPorts   *bool          `yaml:"publish_all_ports,omitempty"`   //
+	Labels            StringMap      `yaml:"labels,omitempty"`              //
+	Env               StringMap      `yaml:"env,omitempty"`                 //
+	EnvFile           Strings        `yaml:"env_file,omitempty"`            // dotenv files to load into env, relative to the manifest
+	Secrets           Secrets        `yaml:"secrets,omitempty"`             // values that should not be stored in the label, see secrets.go
+	Profiles          Strings        `yaml:"profiles,omitempty"`            // run the container only if one of the profiles is active
+	VolumesFrom       ContainerNames `yaml:"volumes_from,omitempty"`        //
+	Volumes           Strings        `yaml:"volumes,omitempty"`             //
+	Links             Links          `yaml:"links,omitempty"`               //
+	WaitFor           ContainerNames `yaml:"wait_for,omitempty"`            //
+	KillTimeout       *uint          `yaml:"kill_timeout,omitempty"`        //
+	Hostname          *string        `yaml:"hostname,omitempty"`            //
+	Domainname        *string        `yaml:"domainname,omitempty"`          //
+	User              *string        `yaml:"user,omitempty"`                //
+	Workdir           *string        `yaml:"workdir,omitempty"`             //
+	NetworkDisabled   *bool          `yaml:"network_disabled,omitempty"`    // TODO: do we need this?
+	KeepVolumes       *bool          `yaml:"keep_volumes,omitempty"`        //
+	IgnoreImageUpdate *bool          `yaml:"ignore_image_update,omitempty"` // do not recreate the container when its image id changes under the same tag
 
 	// Aliases, for compatibility with docker-compose and `docker run`
 
@@ -225,20 +235,76 @@ func ReadConfig(configName string, reader io.Reader, vars template.Vars, funcs m
 		basedir = filepath.Dir(configName)
 	}
 
-	data, err := template.Process(configName, reader, vars, funcs)
+	// Function that gets HOME (initialize only once)
+	homeMemo := ""
+	getHome := func() (h string, err error) {
+		if homeMemo == "" {
+			if homeMemo, err = homedir.Dir(); err != nil {
+				return "", err
+			}
+		}
+		return homeMemo, nil
+	}
+
+	// {{ secret }} helper is also used for secrets with `provider` source
+	getSecret, _ := funcs["secret"].(func(string) (string, error))
+
+	// Function that resolves host paths relative to the manifest file
+	resolvePath := func(p string) (string, error) {
+		if strings.HasPrefix(p, "~") {
+			home, err := getHome()
+			if err != nil {
+				return "", fmt.Errorf("Failed to get HOME path, error: %s", err)
+			}
+			p = strings.Replace(p, "~", home, 1)
+		}
+		if !path.IsAbs(p) {
+			p = path.Join(basedir, p)
+		}
+		return p, nil
+	}
+
+	// Builtin helpers may be overridden by the given ones
+	helpers := templateHelpers(resolvePath)
+	for k, f := range funcs {
+		helpers[k] = f
+	}
+
+	source, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config %s, error: %s", configName, err)
+	}
+
+	// Substitute ${VAR} references from the environment, docker-compose style; only the
+	// manifest as it is written, values of vars and helpers are never interpolated
+	interpolated, err := Interpolate(string(source), lookupEnvEscaped)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to interpolate environment variables in %s, error: %s", configName, err)
+	}
+
+	data, err := template.Process(configName, strings.NewReader(interpolated), vars, helpers)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to process config template, error: %s", err)
 	}
+	rendered := data.String()
 
 	if print {
-		fmt.Print(data.String())
+		// resolve secrets in advance to redact their values from the output
+		registerSecrets(rendered, vars, resolvePath, getSecret)
+		fmt.Print(util.Redact(rendered))
 		os.Exit(0)
 	}
 
-	if err := yaml.Unmarshal(data.Bytes(), config); err != nil {
+	if err := yaml.Unmarshal([]byte(rendered), config); err != nil {
 		return nil, fmt.Errorf("Failed to parse YAML config, error: %s", err)
 	}
 
+	if config.Notify != nil {
+		if err := config.Notify.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid notify section in %s, error: %s", configName, err)
+		}
+	}
+
 	// empty namespace is a backward compatible docker-compose format
 	// we will try to guess the namespace my parent directory name
 	if config.Namespace == "" {
@@ -248,13 +314,14 @@ func ReadConfig(configName string, reader io.Reader, vars template.Vars, funcs m
 
 	// Save vars to config
 	config.Vars = vars
+	config.Rendered = rendered
 
 	// Read extra data
 	type ConfigExtra struct {
 		Containers map[string]map[string]interface{}
 	}
 	extra := &ConfigExtra{}
-	if err := yaml.Unmarshal(data.Bytes(), extra); err != nil {
+	if err := yaml.Unmarshal([]byte(rendered), extra); err != nil {
 		return nil, fmt.Errorf("Failed to parse YAML config extra properties, error: %s", err)
 	}
 
@@ -265,17 +332,6 @@ func ReadConfig(configName string, reader io.Reader, vars template.Vars, funcs m
 		yamlFields[v] = true
 	}
 
-	// Function that gets HOME (initialize only once)
-	homeMemo := ""
-	getHome := func() (h string, err error) {
-		if homeMemo == "" {
-			if homeMemo, err = homedir.Dir(); err != nil {
-				return "", err
-			}
-		}
-		return homeMemo, nil
-	}
-
 	// Process aliases on the first run, have to do it before extends
 	// because Golang randomizes maps, sometimes inherited containers
 	// process earlier then dependencies; also do initial validation
@@ -327,6 +383,45 @@ func ReadConfig(configName string, reader io.Reader, vars template.Vars, funcs m
 			container.Environment = nil
 		}
 
+		// Load env files, later files and inline env take precedence
+		if len(container.EnvFile) > 0 {
+			env := StringMap{}
+			for _, file := range container.EnvFile {
+				filename, err := resolvePath(file)
+				if err != nil {
+					return nil, err
+				}
+				fileEnv, err := ReadEnvFile(filename)
+				if err != nil {
+					return nil, fmt.Errorf("Container %s: %s", name, err)
+				}
+				for k, v := range fileEnv {
+					env[k] = v
+				}
+			}
+			for k, v := range container.Env {
+				env[k] = v
+			}
+			container.Env = env
+		}
+
+		// Resolve build context relative to the manifest
+		if container.Build != nil {
+			if container.Image == nil {
+				return nil, fmt.Errorf("Container %s: image should be given to tag the result of the build", name)
+			}
+			if err := container.Build.resolve(resolvePath); err != nil {
+				return nil, fmt.Errorf("Container %s: %s", name, err)
+			}
+		}
+
+		// Resolve secrets values, so they can be injected to the container
+		for i := range container.Secrets {
+			if err := container.Secrets[i].Resolve(vars, resolvePath, getSecret); err != nil {
+				return nil, fmt.Errorf("Container %s: %s", name, err)
+			}
+		}
+
 		// Process extra data
 		extraFields := map[string]interface{}{}
 		for key, val := range extra.Containers[name] {
@@ -397,15 +492,8 @@ func ReadConfig(configName string, reader io.Reader, vars template.Vars, funcs m
 			if len(split) == 1 {
 				continue
 			}
-			if strings.HasPrefix(split[0], "~") {
-				home, err := getHome()
-				if err != nil {
-					return nil, fmt.Errorf("Failed to get HOME path, error: %s", err)
-				}
-				split[0] = strings.Replace(split[0], "~", home, 1)
-			}
-			if !path.IsAbs(split[0]) {
-				split[0] = path.Join(basedir, split[0])
+			if split[0], err = resolvePath(split[0]); err != nil {
+				return nil, err
 			}
 			container.Volumes[i] = strings.Join(split, ":")
 		}
@@ -414,6 +502,39 @@ func ReadConfig(configName string, reader io.Reader, vars template.Vars, funcs m
 	return config, nil
 }
 
+// registerSecrets makes a best-effort attempt to resolve secrets of the rendered
+// manifest, so their values are known for redaction; errors are ignored
+func registerSecrets(data string, vars template.Vars, resolvePath, getSecret func(string) (string, error)) {
+	config := &Config{}
+	if err := yaml.Unmarshal([]byte(data), config); err != nil {
+		return
+	}
+	for _, container := range config.Containers {
+		if container == nil {
+			continue
+		}
+		for i := range container.Secrets {
+			container.Secrets[i].Resolve(vars, resolvePath, getSecret)
+		}
+	}
+}
+
+// IsActive returns true if the container should be run with the given active profiles;
+// containers that are not tagged with any profile are always active
+func (container *Container) IsActive(profiles []string) bool {
+	if len(container.Profiles) == 0 {
+		return true
+	}
+	for _, p := range container.Profiles {
+		for _, active := range profiles {
+			if p == active {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // HasExternalRefs returns true if there is at least one reference to the external namespace
 func (c *Config) HasExternalRefs() bool {
 	for _, container := range c.Containers {
@@ -222,3 +222,28 @@ containers:
 		assert.Equal(t, out, cfg.HasExternalRefs())
 	}
 }
+
+func TestContainerIsActive(t *testing.T) {
+	cfg, err := ReadConfig("test", strings.NewReader(`namespace: test
+containers:
+  _base:
+    image: web:latest
+    profiles: [dev]
+  main:
+    image: web:latest
+  debug:
+    extends: _base
+  test:
+    image: web:latest
+    profiles: [dev, ci]`), template.Vars{}, map[string]interface{}{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, cfg.Containers["main"].IsActive(nil))
+	assert.True(t, cfg.Containers["main"].IsActive([]string{"prod"}))
+	assert.False(t, cfg.Containers["debug"].IsActive(nil), "profiles should be inherited by extends")
+	assert.True(t, cfg.Containers["debug"].IsActive([]string{"dev"}))
+	assert.False(t, cfg.Containers["test"].IsActive([]string{"prod"}))
+	assert.True(t, cfg.Containers["test"].IsActive([]string{"prod", "ci"}))
+}
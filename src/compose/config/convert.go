@@ -123,6 +123,13 @@ func (config *Container) GetAPIConfig() *docker.Config {
 		}
 	}
 
+	// secrets that should be delivered as env variables
+	for _, secret := range config.Secrets {
+		if secret.Env != "" {
+			apiConfig.Env = append(apiConfig.Env, fmt.Sprintf("%s=%s", secret.Env, secret.Value()))
+		}
+	}
+
 	// volumes
 	if config.Volumes != nil {
 		hostVolumes := map[string]struct{}{}
@@ -0,0 +1,198 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Interpolate substitutes ${VAR} references in the given manifest data with
+// values from the environment, in the same way docker-compose does.
+// Supported forms are:
+//    ${VAR}            value of VAR, empty string if VAR is not set
+//    ${VAR:-default}   "default" if VAR is unset or empty
+//    ${VAR-default}    "default" if VAR is unset
+//    ${VAR:?message}   error with "message" if VAR is unset or empty
+//    ${VAR?message}    error with "message" if VAR is unset
+//    $${VAR}           literal "${VAR}", no substitution
+func Interpolate(data string, lookup func(string) (string, bool)) (string, error) {
+	var buf bytes.Buffer
+
+	for {
+		start := strings.Index(data, "${")
+		if start < 0 {
+			buf.WriteString(data)
+			break
+		}
+
+		// $${VAR} is an escaped reference, keep it as ${VAR}
+		if start > 0 && data[start-1] == '$' {
+			buf.WriteString(data[:start-1])
+			buf.WriteString("${")
+			data = data[start+2:]
+			continue
+		}
+
+		end := strings.Index(data[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("Unterminated variable reference: %.20s", data[start:])
+		}
+		end += start
+
+		value, err := interpolateExpr(data[start+2:end], lookup)
+		if err != nil {
+			return "", err
+		}
+
+		buf.WriteString(data[:start])
+		buf.WriteString(value)
+		data = data[end+1:]
+	}
+
+	return buf.String(), nil
+}
+
+// ReadEnvFile reads the dotenv file and returns the key/value pairs defined in it.
+// See ParseEnvFile for the format details.
+func ReadEnvFile(filename string) (StringMap, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open env file %s, error: %s", filename, err)
+	}
+	defer fd.Close()
+
+	env, err := ParseEnvFile(fd)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse env file %s, error: %s", filename, err)
+	}
+
+	return env, nil
+}
+
+// ParseEnvFile parses the dotenv formatted stream. Every line is a KEY=VALUE pair,
+// empty lines and lines starting with '#' are skipped, optional "export " prefix
+// is allowed and values may be enclosed with single or double quotes.
+// If only the KEY is given, the value is taken from the environment.
+func ParseEnvFile(reader io.Reader) (StringMap, error) {
+	env := StringMap{}
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("Invalid variable name at line %d: %q", lineNum, key)
+		}
+
+		if len(kv) == 1 {
+			if value, ok := os.LookupEnv(key); ok {
+				env[key] = value
+			}
+			continue
+		}
+
+		env[key] = unquoteEnvValue(strings.TrimSpace(kv[1]))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// interpolateExpr evaluates the expression found inside of ${...}
+func interpolateExpr(expr string, lookup func(string) (string, bool)) (string, error) {
+	name := expr
+	op := ""
+	arg := ""
+
+	if i := strings.IndexAny(expr, ":-?"); i >= 0 {
+		name = expr[:i]
+		op = expr[i:]
+		for _, prefix := range []string{":-", ":?", "-", "?"} {
+			if strings.HasPrefix(op, prefix) {
+				arg = op[len(prefix):]
+				op = prefix
+				break
+			}
+		}
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("Invalid variable reference: ${%s}", expr)
+	}
+
+	value, ok := lookup(name)
+
+	switch op {
+	case "":
+		return value, nil
+	case ":-":
+		if value == "" {
+			return arg, nil
+		}
+	case "-":
+		if !ok {
+			return arg, nil
+		}
+	case ":?":
+		if value == "" {
+			return "", fmt.Errorf("Required variable %s is not set: %s", name, arg)
+		}
+	case "?":
+		if !ok {
+			return "", fmt.Errorf("Required variable %s is not set: %s", name, arg)
+		}
+	default:
+		return "", fmt.Errorf("Invalid variable reference: ${%s}", expr)
+	}
+
+	return value, nil
+}
+
+// unquoteEnvValue strips matching quotes around the value of the env file
+func unquoteEnvValue(value string) string {
+	if len(value) >= 2 {
+		first, last := value[0], value[len(value)-1]
+		if (first == '"' || first == '\'') && first == last {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
+
+// lookupEnvEscaped looks up the environment variable for the manifest template,
+// "{{" in the value is escaped, so it is not processed as an action
+func lookupEnvEscaped(name string) (string, bool) {
+	value, ok := os.LookupEnv(name)
+	return strings.Replace(value, "{{", `{{"{{"}}`, -1), ok
+}
@@ -0,0 +1,223 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{
+		"HOST":  "example.com",
+		"EMPTY": "",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	assertions := map[string]string{
+		"no vars":                "no vars",
+		"${HOST}":                "example.com",
+		"http://${HOST}:80/":     "http://example.com:80/",
+		"${MISSING}":             "",
+		"${MISSING:-default}":    "default",
+		"${EMPTY:-default}":      "default",
+		"${EMPTY-default}":       "",
+		"${MISSING-default}":     "default",
+		"${HOST:-default}":       "example.com",
+		"${EMPTY?oops}":          "",
+		"$${HOST}":               "${HOST}",
+		"$$${HOST}":              "$${HOST}",
+		"${HOST} and $${HOST}":   "example.com and ${HOST}",
+		"$HOST is not supported": "$HOST is not supported",
+	}
+
+	for in, out := range assertions {
+		t.Logf("Checking interpolation %q", in)
+		actual, err := Interpolate(in, lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, out, actual)
+	}
+
+	errors := map[string]string{
+		"${MISSING:?need it}": "Required variable MISSING is not set: need it",
+		"${EMPTY:?need it}":   "Required variable EMPTY is not set: need it",
+		"${MISSING?need it}":  "Required variable MISSING is not set: need it",
+		"${HOST":              "Unterminated variable reference: ${HOST",
+		"${}":                 "Invalid variable reference: ${}",
+	}
+
+	for in, out := range errors {
+		t.Logf("Checking interpolation error %q", in)
+		_, err := Interpolate(in, lookup)
+		if assert.Error(t, err) {
+			assert.Equal(t, out, err.Error())
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	os.Setenv("ROCKER_COMPOSE_TEST_PASSTHROUGH", "from-env")
+	defer os.Unsetenv("ROCKER_COMPOSE_TEST_PASSTHROUGH")
+
+	env, err := ParseEnvFile(strings.NewReader(`
+# comment
+KEY=value
+export EXPORTED=1
+QUOTED="with spaces"
+SINGLE='single'
+EQ=a=b
+EMPTY=
+ROCKER_COMPOSE_TEST_PASSTHROUGH
+ROCKER_COMPOSE_TEST_UNSET
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, StringMap{
+		"KEY":                             "value",
+		"EXPORTED":                        "1",
+		"QUOTED":                          "with spaces",
+		"SINGLE":                          "single",
+		"EQ":                              "a=b",
+		"EMPTY":                           "",
+		"ROCKER_COMPOSE_TEST_PASSTHROUGH": "from-env",
+	}, env)
+
+	_, err = ParseEnvFile(strings.NewReader("BAD KEY=1"))
+	assert.Error(t, err)
+}
+
+func TestConfigEnvFile(t *testing.T) {
+	configStr := `namespace: test
+containers:
+  main:
+    image: ubuntu:14.04
+    env_file:
+      - base.env
+      - override.env
+    env:
+      DB_PORT: "5433"
+  child:
+    extends: main
+    env:
+      DB_NAME: child`
+
+	cfg, err := ReadConfig("testdata/compose.yml", strings.NewReader(configStr), template.Vars{}, map[string]interface{}{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, StringMap{
+		"DB_HOST": "db.local",
+		"DB_PORT": "5433",
+		"DB_NAME": "app",
+	}, cfg.Containers["main"].Env)
+
+	assert.Equal(t, StringMap{
+		"DB_HOST": "db.local",
+		"DB_PORT": "5433",
+		"DB_NAME": "child",
+	}, cfg.Containers["child"].Env)
+}
+
+func TestConfigEnvFileNotFound(t *testing.T) {
+	configStr := `namespace: test
+containers:
+  main:
+    image: ubuntu:14.04
+    env_file: missing.env`
+
+	_, err := ReadConfig("testdata/compose.yml", strings.NewReader(configStr), template.Vars{}, map[string]interface{}{}, false)
+	assert.Error(t, err)
+}
+
+func TestConfigEnvFileIsCompared(t *testing.T) {
+	a := &Container{EnvFile: Strings{"a.env"}, Env: StringMap{"KEY": "1"}}
+	b := &Container{EnvFile: Strings{"b.env"}, Env: StringMap{"KEY": "1"}}
+	c := &Container{EnvFile: Strings{"a.env"}, Env: StringMap{"KEY": "2"}}
+
+	assert.True(t, a.IsEqualTo(b), "different file names with same content should not cause recreation")
+	assert.False(t, a.IsEqualTo(c), "changed content of the env file should cause recreation")
+}
+
+func TestConfigInterpolation(t *testing.T) {
+	os.Setenv("ROCKER_COMPOSE_TEST_TAG", "1.2.3")
+	defer os.Unsetenv("ROCKER_COMPOSE_TEST_TAG")
+
+	configStr := `namespace: test
+containers:
+  main:
+    image: ubuntu:${ROCKER_COMPOSE_TEST_TAG}
+    cmd: echo $${HOME}
+    env:
+      MODE: ${ROCKER_COMPOSE_TEST_MODE:-production}`
+
+	cfg, err := ReadConfig("test", strings.NewReader(configStr), template.Vars{}, map[string]interface{}{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "ubuntu:1.2.3", *cfg.Containers["main"].Image)
+	assert.Equal(t, Cmd{"/bin/sh", "-c", "echo ${HOME}"}, cfg.Containers["main"].Cmd)
+	assert.Equal(t, "production", cfg.Containers["main"].Env["MODE"])
+}
+
+func TestConfigInterpolationRequired(t *testing.T) {
+	configStr := `namespace: test
+containers:
+  main:
+    image: ubuntu:${ROCKER_COMPOSE_TEST_UNSET:?tag is required}`
+
+	_, err := ReadConfig("test", strings.NewReader(configStr), template.Vars{}, map[string]interface{}{}, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tag is required")
+	}
+}
+
+func TestConfigInterpolationSkipsVars(t *testing.T) {
+	os.Setenv("ROCKER_COMPOSE_TEST_TAG", "{{ .password }}")
+	defer os.Unsetenv("ROCKER_COMPOSE_TEST_TAG")
+
+	configStr := `namespace: test
+containers:
+  main:
+    image: ubuntu:${ROCKER_COMPOSE_TEST_TAG}
+    env:
+      HOME: {{ .home }}
+      PASSWORD: {{ .password }}`
+
+	vars := template.Vars{"home": "${HOME}", "password": "pa$$word${ROCKER_COMPOSE_TEST_UNSET:?}"}
+
+	cfg, err := ReadConfig("test", strings.NewReader(configStr), vars, map[string]interface{}{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "ubuntu:{{ .password }}", *cfg.Containers["main"].Image)
+	assert.Equal(t, "${HOME}", cfg.Containers["main"].Env["HOME"])
+	assert.Equal(t, "pa$$word${ROCKER_COMPOSE_TEST_UNSET:?}", cfg.Containers["main"].Env["PASSWORD"])
+}
@@ -90,6 +90,12 @@ func (container *Container) ExtendFrom(parent *Container) {
 	if container.KeepVolumes == nil {
 		container.KeepVolumes = parent.KeepVolumes
 	}
+	if container.IgnoreImageUpdate == nil {
+		container.IgnoreImageUpdate = parent.IgnoreImageUpdate
+	}
+	if container.Build == nil {
+		container.Build = parent.Build
+	}
 	// Extend labels
 	newLabels := make(map[string]string)
 	for k, v := range parent.Labels {
@@ -110,6 +116,13 @@ func (container *Container) ExtendFrom(parent *Container) {
 	}
 	container.Env = newEnv
 
+	if container.Secrets == nil {
+		container.Secrets = parent.Secrets
+	}
+	if container.Profiles == nil {
+		container.Profiles = parent.Profiles
+	}
+
 	if container.Links == nil {
 		container.Links = parent.Links
 	}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+)
+
+// templateHelpers returns manifest-specific template helpers that do not need
+// the Docker client. resolvePath is used for making file paths relative to the manifest.
+// Helpers given to ReadConfig with the same names take precedence over these.
+func templateHelpers(resolvePath func(string) (string, error)) map[string]interface{} {
+	readFile := func(filename string) (string, error) {
+		filename, err := resolvePath(filename)
+		if err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read file %s, error: %s", filename, err)
+		}
+		return string(data), nil
+	}
+
+	return map[string]interface{}{
+		"env":      os.Getenv,
+		"default":  defaultFn,
+		"required": requiredFn,
+		"readFile": readFile,
+		"sha256":   sha256Fn,
+		"sha256file": func(filename string) (string, error) {
+			data, err := readFile(filename)
+			if err != nil {
+				return "", err
+			}
+			return sha256Fn(data), nil
+		},
+		"b64enc":   b64encFn,
+		"hostname": os.Hostname,
+	}
+}
+
+// defaultFn returns the value if it is not empty, otherwise returns def;
+// usage: {{ .port | default "8080" }}
+func defaultFn(def interface{}, value interface{}) interface{} {
+	if isEmptyValue(value) {
+		return def
+	}
+	return value
+}
+
+// requiredFn fails the rendering with the given message if the value is empty;
+// usage: {{ required "port is not given" .port }}
+func requiredFn(message string, value interface{}) (interface{}, error) {
+	if isEmptyValue(value) {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+func sha256Fn(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func b64encFn(data string) string {
+	return base64.StdEncoding.EncodeToString([]byte(data))
+}
+
+// isEmptyValue returns true for nil and for zero values of basic types, empty slices and maps
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func renderHelpersTest(t *testing.T, tpl string, vars template.Vars) (string, error) {
+	resolvePath := func(p string) (string, error) {
+		return "testdata/" + p, nil
+	}
+	data, err := template.Process("test", strings.NewReader(tpl), vars, templateHelpers(resolvePath))
+	if err != nil {
+		return "", err
+	}
+	return data.String(), nil
+}
+
+func TestTemplateHelpers(t *testing.T) {
+	hostname, _ := os.Hostname()
+	os.Setenv("ROCKER_COMPOSE_HELPERS_TEST", "hello")
+	defer os.Unsetenv("ROCKER_COMPOSE_HELPERS_TEST")
+
+	vars := template.Vars{"port": "8081", "empty": ""}
+
+	assertions := map[string]string{
+		`{{ env "ROCKER_COMPOSE_HELPERS_TEST" }}`:       "hello",
+		`{{ .port | default "8080" }}`:                  "8081",
+		`{{ .empty | default "8080" }}`:                 "8080",
+		`{{ .missing | default "8080" }}`:               "8080",
+		`{{ required "port is required" .port }}`:       "8081",
+		`{{ sha256 "hello" }}`:                          "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		`{{ b64enc "hello" }}`:                          "aGVsbG8=",
+		`{{ readFile "secrets/db_password" }}`:          "db-secret-password\n",
+		`{{ sha256file "secrets/db_password" }}`:        "42b0f71a58d716b20d5a320cbc81d2f5418a5dc8942eb3ca829692a685f10be2",
+		`{{ readFile "secrets/db_password" | b64enc }}`: "ZGItc2VjcmV0LXBhc3N3b3JkCg==",
+		`{{ hostname }}`:                                hostname,
+	}
+
+	for tpl, expected := range assertions {
+		actual, err := renderHelpersTest(t, tpl, vars)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tpl, err)
+			continue
+		}
+		assert.Equal(t, expected, actual, "bad result for %s", tpl)
+	}
+}
+
+func TestTemplateHelpersErrors(t *testing.T) {
+	vars := template.Vars{"empty": ""}
+
+	assertions := map[string]string{
+		`{{ required "port is required" .empty }}`:   "port is required",
+		`{{ required "port is required" .missing }}`: "port is required",
+		`{{ readFile "nonexisting" }}`:               "Failed to read file testdata/nonexisting",
+		`{{ sha256file "nonexisting" }}`:             "Failed to read file testdata/nonexisting",
+	}
+
+	for tpl, expected := range assertions {
+		_, err := renderHelpersTest(t, tpl, vars)
+		if assert.Error(t, err, tpl) {
+			assert.Contains(t, err.Error(), expected, tpl)
+		}
+	}
+}
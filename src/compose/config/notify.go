@@ -0,0 +1,51 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import "fmt"
+
+// Values of Notify.On
+const (
+	NotifyAlways  = "always"  // every run
+	NotifyChange  = "change"  // runs that changed something or failed
+	NotifyFailure = "failure" // failed runs only
+)
+
+// Notify lists where outcomes of runs are sent, either in the `notify` section
+// of the manifest or in the global notify file:
+//
+//	notify:
+//	  on: change
+//	  webhooks:
+//	    - https://hooks.example.com/deploys
+//	  commands:
+//	    - /usr/local/bin/page-oncall
+type Notify struct {
+	On       string  `yaml:"on,omitempty"`       // when to notify, "change" by default
+	Webhooks Strings `yaml:"webhooks,omitempty"` // URLs the outcome is POSTed to as JSON
+	Commands Strings `yaml:"commands,omitempty"` // commands run with `sh -c`, the outcome is given on STDIN
+}
+
+// Validate checks the value of On
+func (n *Notify) Validate() error {
+	switch n.On {
+	case "", NotifyAlways, NotifyChange, NotifyFailure:
+		return nil
+	}
+	return fmt.Errorf("Invalid notify.on value '%s', expected one of: %s, %s, %s",
+		n.On, NotifyAlways, NotifyChange, NotifyFailure)
+}
@@ -0,0 +1,57 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigNotify(t *testing.T) {
+	cfg, err := ReadConfig("test", strings.NewReader(`namespace: test
+notify:
+  on: failure
+  webhooks: https://hooks.example.com/deploys
+  commands:
+    - cat > /dev/null
+containers:
+  main:
+    image: "busybox"
+`), template.Vars{}, map[string]interface{}{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &Notify{
+		On:       NotifyFailure,
+		Webhooks: Strings{"https://hooks.example.com/deploys"},
+		Commands: Strings{"cat > /dev/null"},
+	}, cfg.Notify)
+}
+
+func TestConfigNotifyInvalid(t *testing.T) {
+	_, err := ReadConfig("test", strings.NewReader(`namespace: test
+notify:
+  on: sometimes
+containers:
+  main:
+    image: "busybox"
+`), template.Vars{}, map[string]interface{}{}, false)
+	assert.Error(t, err)
+}
@@ -30,6 +30,10 @@ var compareSkipFields = []string{
 	"NetworkDisabled",
 	"State",
 	"KeepVolumes",
+	"IgnoreImageUpdate",
+	"EnvFile",  // loaded into Env, which is compared instead
+	"Profiles", // only affects whether the container is run
+	"Build",    // only affects how the image is made, which is compared by id
 
 	// aliases
 	"Command",
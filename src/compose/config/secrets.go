@@ -0,0 +1,189 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"util"
+
+	"github.com/grammarly/rocker/src/rocker/template"
+)
+
+// DefaultSecretStore is the directory of the local secret store, which is used
+// when "SecretStore" variable is not given. Every secret is a file in it.
+const DefaultSecretStore = "~/.rocker-compose/secrets"
+
+// Secret describes a single value that should be delivered to a container
+// without being stored in the 'rocker-compose-config' label. The value is taken
+// from one of the sources (file, var, store or provider) and injected either as an ENV
+// variable, or as a file inside of the container, or both.
+//
+// In the label, only the salted hash of the value is stored, which is enough
+// to detect that the secret was changed and the container should be recreated.
+type Secret struct {
+	Name     string `yaml:"name"`               // unique name of the secret within the container
+	File     string `yaml:"file,omitempty"`     // read value from a file, relative to the manifest
+	Var      string `yaml:"var,omitempty"`      // read value from a variable given by --var or --vars
+	Store    string `yaml:"store,omitempty"`    // read value from the local secret store by key
+	Provider string `yaml:"provider,omitempty"` // read value by key from the --secret-provider, same as {{ secret }} helper
+	Env      string `yaml:"env,omitempty"`      // ENV variable to put the value to
+	Target   string `yaml:"target,omitempty"`   // path of the file inside of the container to put the value to
+	Hash     string `yaml:"hash,omitempty"`     // salted hash of the value, the only thing that goes to the label
+
+	value    string
+	salt     string
+	resolved bool
+}
+
+// Secrets is a collection of container secrets
+type Secrets []Secret
+
+// Value returns the resolved secret value
+func (s *Secret) Value() string {
+	return s.value
+}
+
+// Resolve reads the secret value from its source. resolvePath is used for making
+// file paths relative to the manifest, getSecret is the {{ secret }} template helper
+// used for the `provider` source. Resolved values are registered for redaction.
+func (s *Secret) Resolve(vars template.Vars, resolvePath func(string) (string, error), getSecret func(string) (string, error)) (err error) {
+	sources := 0
+	for _, src := range []string{s.File, s.Var, s.Store, s.Provider} {
+		if src != "" {
+			sources++
+		}
+	}
+
+	if s.Name == "" {
+		return fmt.Errorf("Secret name is not specified")
+	}
+	if sources != 1 {
+		return fmt.Errorf("Secret %s: exactly one of `file`, `var`, `store` or `provider` should be specified", s.Name)
+	}
+	if s.Env == "" && s.Target == "" {
+		return fmt.Errorf("Secret %s: at least one of `env` or `target` should be specified", s.Name)
+	}
+	if s.Target != "" && !path.IsAbs(s.Target) {
+		return fmt.Errorf("Secret %s: target should be an absolute path, `%s` given", s.Name, s.Target)
+	}
+
+	switch {
+	case s.File != "":
+		if s.value, err = readSecretFile(s.File, resolvePath); err != nil {
+			return fmt.Errorf("Secret %s: %s", s.Name, err)
+		}
+
+	case s.Var != "":
+		v, ok := vars[s.Var]
+		if !ok {
+			return fmt.Errorf("Secret %s: variable `%s` is not set", s.Name, s.Var)
+		}
+		s.value = fmt.Sprintf("%v", v)
+
+	case s.Store != "":
+		if strings.Contains(s.Store, "..") {
+			return fmt.Errorf("Secret %s: invalid store key `%s`", s.Name, s.Store)
+		}
+		store := DefaultSecretStore
+		if dir, ok := vars["SecretStore"].(string); ok && dir != "" {
+			store = dir
+		}
+		if s.value, err = readSecretFile(path.Join(store, s.Store), resolvePath); err != nil {
+			return fmt.Errorf("Secret %s: failed to read from the secret store, %s", s.Name, err)
+		}
+
+	case s.Provider != "":
+		if getSecret == nil {
+			return fmt.Errorf("Secret %s: no secret provider configured", s.Name)
+		}
+		if s.value, err = getSecret(s.Provider); err != nil {
+			return fmt.Errorf("Secret %s: %s", s.Name, err)
+		}
+	}
+
+	if s.salt, err = newSecretSalt(); err != nil {
+		return fmt.Errorf("Secret %s: failed to generate salt, error: %s", s.Name, err)
+	}
+
+	s.Hash = ""
+	s.resolved = true
+	util.RegisterSecret(s.value)
+
+	return nil
+}
+
+// MarshalYAML serializes the secret, replacing the value with its salted hash
+func (s Secret) MarshalYAML() (interface{}, error) {
+	// type without methods, to not end up in recursion
+	type secretYaml Secret
+	out := secretYaml(s)
+	if s.resolved {
+		out.Hash = hashSecret(s.salt, s.value)
+	}
+	return out, nil
+}
+
+// adoptSalts takes salts from the hashes of the same secrets of another
+// container, so the hashes of resolved secrets can be compared against them
+func (secrets Secrets) adoptSalts(from Secrets) {
+	for i := range secrets {
+		if !secrets[i].resolved {
+			continue
+		}
+		for _, s := range from {
+			if s.resolved || s.Name != secrets[i].Name {
+				continue
+			}
+			if parts := strings.SplitN(s.Hash, ":", 3); len(parts) == 3 {
+				secrets[i].salt = parts[1]
+			}
+		}
+	}
+}
+
+func hashSecret(salt, value string) string {
+	sum := sha256.Sum256([]byte(salt + value))
+	return fmt.Sprintf("sha256:%s:%s", salt, hex.EncodeToString(sum[:]))
+}
+
+func newSecretSalt() (string, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+func readSecretFile(filename string, resolvePath func(string) (string, error)) (string, error) {
+	filename, err := resolvePath(filename)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	// files usually end with a newline which is not a part of the secret
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
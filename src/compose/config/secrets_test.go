@@ -0,0 +1,153 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"strings"
+	"testing"
+	"util"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/stretchr/testify/assert"
+)
+
+var secretsTestManifest = `namespace: test
+containers:
+  main:
+    image: ubuntu:14.04
+    secrets:
+      - name: db_password
+        file: secrets/db_password
+        env: DB_PASSWORD
+      - name: api_key
+        var: api_key
+        target: /run/secrets/api_key
+      - name: provided
+        provider: db/password
+        env: PROVIDED
+      - name: tls_key
+        store: tls.key
+        env: TLS_KEY
+        target: /etc/ssl/app.key`
+
+func readSecretsTestConfig(t *testing.T, apiKey string) *Config {
+	vars := template.Vars{
+		"api_key":     apiKey,
+		"SecretStore": "secrets",
+	}
+	funcs := map[string]interface{}{
+		"secret": func(key string) (string, error) { return "provided-" + key, nil },
+	}
+	cfg, err := ReadConfig("testdata/compose.yml", strings.NewReader(secretsTestManifest), vars, funcs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestSecretsResolve(t *testing.T) {
+	secrets := readSecretsTestConfig(t, "key-123456").Containers["main"].Secrets
+
+	assert.Equal(t, 4, len(secrets))
+	assert.Equal(t, "db-secret-password", secrets[0].Value())
+	assert.Equal(t, "key-123456", secrets[1].Value())
+	assert.Equal(t, "provided-db/password", secrets[2].Value())
+	assert.Equal(t, "tls-private-key", secrets[3].Value())
+}
+
+func TestSecretsValidation(t *testing.T) {
+	assertions := map[string]string{
+		"- name: a\n  env: A":                            "exactly one of",
+		"- name: a\n  provider: db\n  env: A":            "no secret provider configured",
+		"- name: a\n  var: x\n  file: y\n  env: A":       "exactly one of",
+		"- name: a\n  var: x":                            "at least one of",
+		"- var: x\n  env: A":                             "name is not specified",
+		"- name: a\n  var: missing\n  env: A":            "variable `missing` is not set",
+		"- name: a\n  var: x\n  target: relative":        "absolute path",
+		"- name: a\n  store: ../../etc/passwd\n  env: A": "invalid store key",
+	}
+
+	for in, out := range assertions {
+		t.Logf("Checking secret %q", in)
+		secrets := Secrets{}
+		if err := yaml.Unmarshal([]byte(in), &secrets); err != nil {
+			t.Fatal(err)
+		}
+		err := secrets[0].Resolve(template.Vars{"x": "value"}, func(p string) (string, error) { return p, nil }, nil)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), out)
+		}
+	}
+}
+
+func TestSecretsNotInLabel(t *testing.T) {
+	container := readSecretsTestConfig(t, "key-123456").Containers["main"]
+
+	data, err := yaml.Marshal(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotContains(t, string(data), "db-secret-password")
+	assert.NotContains(t, string(data), "key-123456")
+	assert.NotContains(t, string(data), "tls-private-key")
+	assert.Contains(t, string(data), "hash: sha256:")
+}
+
+func TestSecretsCompare(t *testing.T) {
+	container := readSecretsTestConfig(t, "key-123456").Containers["main"]
+
+	data, err := yaml.Marshal(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromLabel, err := NewFromDocker(&docker.Container{
+		Config: &docker.Config{
+			Labels: map[string]string{"rocker-compose-config": string(data)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same secrets, new salts should be taken from the label
+	assert.True(t, readSecretsTestConfig(t, "key-123456").Containers["main"].IsEqualTo(fromLabel))
+
+	// changed secret
+	changed := readSecretsTestConfig(t, "key-654321").Containers["main"]
+	assert.False(t, changed.IsEqualTo(fromLabel))
+	assert.Equal(t, "Secrets", changed.LastCompareField())
+}
+
+func TestSecretsApiConfig(t *testing.T) {
+	apiConfig := readSecretsTestConfig(t, "key-123456").Containers["main"].GetAPIConfig()
+
+	assert.Contains(t, apiConfig.Env, "DB_PASSWORD=db-secret-password")
+	assert.Contains(t, apiConfig.Env, "PROVIDED=provided-db/password")
+	assert.Contains(t, apiConfig.Env, "TLS_KEY=tls-private-key")
+	assert.Equal(t, 3, len(apiConfig.Env))
+}
+
+func TestSecretsRedacted(t *testing.T) {
+	readSecretsTestConfig(t, "key-123456")
+
+	assert.Equal(t, "password is "+util.Redacted, util.Redact("password is db-secret-password"))
+	assert.Equal(t, "api key is "+util.Redacted, util.Redact("api key is key-123456"))
+}
@@ -33,9 +33,11 @@ func (config *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	c := &struct {
 		Namespace  *string
 		Containers *map[string]*Container
+		Notify     **Notify
 	}{
 		&config.Namespace,
 		&config.Containers,
+		&config.Notify,
 	}
 	if err := unmarshal(c); err != nil {
 		return err
@@ -18,6 +18,7 @@ package compose
 
 import (
 	"compose/config"
+	"fmt"
 	"strings"
 	"time"
 	"util"
@@ -29,6 +30,9 @@ import (
 	"github.com/fsouza/go-dockerclient"
 )
 
+// imageNameLabel keeps the image name of containers created by the image ID
+const imageNameLabel = "rocker-compose-image"
+
 // Container object represents a single container produced by a rocker-compose spec
 type Container struct {
 	ID            string
@@ -42,6 +46,7 @@ type Container struct {
 	Io            *ContainerIo
 
 	container *docker.Container
+	healthy   bool // has not exited within --wait after it was started, reported by eventAction
 }
 
 // ContainerState represents the state of a container.
@@ -58,11 +63,11 @@ type ContainerState struct {
 }
 
 // GetContainersFromConfig returns the list of Container objects from
-// a spec Config object.
+// a spec Config object. Containers of inactive profiles are skipped.
 func GetContainersFromConfig(cfg *config.Config) []*Container {
 	var containers []*Container
 	for name, containerConfig := range cfg.Containers {
-		if strings.HasPrefix(name, "_") {
+		if strings.HasPrefix(name, "_") || !containerConfig.IsActive(cfg.Profiles) {
 			continue
 		}
 		containerName := config.NewContainerName(cfg.Namespace, name)
@@ -71,6 +76,19 @@ func GetContainersFromConfig(cfg *config.Config) []*Container {
 	return containers
 }
 
+// GetInactiveContainerNames returns names of containers from a spec Config object
+// that are skipped because none of their profiles is active.
+func GetInactiveContainerNames(cfg *config.Config) []config.ContainerName {
+	var names []config.ContainerName
+	for name, containerConfig := range cfg.Containers {
+		if strings.HasPrefix(name, "_") || containerConfig.IsActive(cfg.Profiles) {
+			continue
+		}
+		names = append(names, *config.NewContainerName(cfg.Namespace, name))
+	}
+	return names
+}
+
 // NewContainerFromConfig makes a single Container object from a spec Config object.
 func NewContainerFromConfig(name *config.ContainerName, containerConfig *config.Container) *Container {
 	container := &Container{
@@ -95,9 +113,13 @@ func NewContainerFromDocker(dockerContainer *docker.Container) (*Container, erro
 			return nil, err
 		}
 	}
+	image := dockerContainer.Config.Image
+	if name, ok := dockerContainer.Config.Labels[imageNameLabel]; ok {
+		image = name
+	}
 	return &Container{
 		ID:      dockerContainer.ID,
-		Image:   imagename.NewFromString(dockerContainer.Config.Image),
+		Image:   imagename.NewFromString(image),
 		ImageID: dockerContainer.Image,
 		Name:    config.NewContainerNameFromString(dockerContainer.Name),
 		Created: dockerContainer.Created,
@@ -138,9 +160,16 @@ func (a *Container) IsSameKind(b *Container) bool {
 // all dimensions. It compares configuration, image id (image can be updated),
 // state (running, craeted)
 func (a *Container) IsEqualTo(b *Container) bool {
+	return a.Difference(b) == ""
+}
+
+// Difference compares current and given containers in the same way as IsEqualTo
+// does and returns the human readable reason why they are different, or an empty
+// string if they are equal.
+func (a *Container) Difference(b *Container) string {
 	// check name
 	if !a.IsSameKind(b) {
-		return false
+		return fmt.Sprintf("name changed: %s -> %s", b.Name, a.Name)
 	}
 
 	// check configuration
@@ -149,7 +178,7 @@ func (a *Container) IsEqualTo(b *Container) bool {
 			a.Name.String(),
 			b.Name.String(),
 			a.Config.LastCompareField())
-		return false
+		return fmt.Sprintf("config changed: %s", a.Config.LastCompareField())
 	}
 
 	// check image version
@@ -160,18 +189,19 @@ func (a *Container) IsEqualTo(b *Container) bool {
 			a.Image,
 			b.Image,
 			a.Image)
-		return false
+		return fmt.Sprintf("image changed: %s -> %s", b.Image, a.Image)
 	}
 
-	// check image id
-	if a.ImageID != "" && b.ImageID != "" && a.ImageID != b.ImageID {
+	// check image id, unless the container opted out of recreation on image updates
+	ignoreImageUpdate := a.Config.IgnoreImageUpdate != nil && *a.Config.IgnoreImageUpdate
+	if a.ImageID != "" && b.ImageID != "" && a.ImageID != b.ImageID && !ignoreImageUpdate {
 		log.Debugf("Comparing '%s' and '%s': image '%s' updated (was %.12s became %.12s)",
 			a.Name.String(),
 			b.Name.String(),
 			a.Image,
 			b.ImageID,
 			a.ImageID)
-		return false
+		return fmt.Sprintf("image updated: %s -> %s", shortImageID(b.ImageID), shortImageID(a.ImageID))
 	}
 
 	// One of exit codes is always '0' since once of containers (a or b) is always loaded from config
@@ -180,7 +210,7 @@ func (a *Container) IsEqualTo(b *Container) bool {
 			a.Name.String(),
 			b.Name.String(),
 			a.State.ExitCode+b.State.ExitCode)
-		return false
+		return fmt.Sprintf("previous run exited with code %d", a.State.ExitCode+b.State.ExitCode)
 	}
 
 	// check state
@@ -190,10 +220,10 @@ func (a *Container) IsEqualTo(b *Container) bool {
 			b.Name.String(),
 			a.State.Running,
 			b.State.Running)
-		return false
+		return fmt.Sprintf("state changed: running %t -> %t", b.State.Running, a.State.Running)
 	}
 
-	return true
+	return ""
 }
 
 // IsEqualState returns true if current and given containers have the same state
@@ -227,3 +257,15 @@ func (a *Container) CreateContainerOptions() (*docker.CreateContainerOptions, er
 		HostConfig: a.Config.GetAPIHostConfig(),
 	}, nil
 }
+
+// shortImageID truncates the image id for printing, keeping the "sha256:" prefix if any
+func shortImageID(id string) string {
+	prefix := ""
+	if i := strings.Index(id, ":"); i >= 0 {
+		prefix, id = id[:i+1], id[i+1:]
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return prefix + id
+}
@@ -18,10 +18,13 @@ package compose
 
 import (
 	"compose/config"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/grammarly/rocker/src/rocker/template"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -60,6 +63,28 @@ func TestConfigGetContainers(t *testing.T) {
 	assert.Equal(t, 5, len(containers), "bad containers number from config")
 }
 
+func TestConfigGetContainersProfiles(t *testing.T) {
+	cfg, err := config.ReadConfig("test", strings.NewReader(`namespace: test
+containers:
+  main:
+    image: web:latest
+  debug:
+    image: web:latest
+    profiles: [dev]`), template.Vars{}, map[string]interface{}{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containers := GetContainersFromConfig(cfg)
+	assert.Equal(t, 1, len(containers))
+	assert.Equal(t, "test.main", containers[0].Name.String())
+	assert.Equal(t, []config.ContainerName{{Namespace: "test", Name: "debug"}}, GetInactiveContainerNames(cfg))
+
+	cfg.Profiles = []string{"dev"}
+	assert.Equal(t, 2, len(GetContainersFromConfig(cfg)))
+	assert.Empty(t, GetInactiveContainerNames(cfg))
+}
+
 func TestNewContainerFromDocker(t *testing.T) {
 	createdTime := time.Now()
 	id := "2201c17d77c64d51a422c5732cb6368e010dfa47df8724378f4076f465de84c3"
@@ -98,6 +123,32 @@ func TestNewContainerFromDocker(t *testing.T) {
 	assert.Equal(t, assertionName, container.Name)
 }
 
+func TestNewContainerFromDockerByImageID(t *testing.T) {
+	image := "redis@sha256:ea9c2e3a4d7d4d3ec76c6b1df6e1c8de5df8d1fc0e4e0a0e37a1a0bdd2db8c0f"
+
+	apiContainer := &docker.Container{
+		ID:    "2201c17d77c6",
+		Image: "sha256:123",
+		Config: &docker.Config{
+			Image: "sha256:123",
+			Labels: map[string]string{
+				"rocker-compose-config": "image: " + image,
+				imageNameLabel:          image,
+			},
+		},
+		Name:       "/myapp.redis",
+		HostConfig: &docker.HostConfig{},
+	}
+
+	container, err := NewContainerFromDocker(apiContainer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, image, container.Image.String())
+	assert.Equal(t, "sha256:123", container.ImageID)
+}
+
 func TestNewFromDocker(t *testing.T) {
 	cfg, err := config.NewFromFile("config/testdata/compose.yml", containerTestVars, map[string]interface{}{}, false)
 	if err != nil {
@@ -130,3 +181,29 @@ func TestNewFromDocker(t *testing.T) {
 	assert.True(t, compareResult,
 		"container spec converted from API should be equal to one fetched from config file, failed on field: %s", cfg.Containers["main"].LastCompareField())
 }
+
+func TestContainerDifferenceImageID(t *testing.T) {
+	ignore := true
+	newContainer := func(imageID string, cfg *config.Container) *Container {
+		return &Container{
+			Name:    config.NewContainerName("myapp", "main"),
+			Image:   imagename.NewFromString("app:latest"),
+			ImageID: imageID,
+			State:   &ContainerState{Running: true},
+			Config:  cfg,
+		}
+	}
+
+	expected := newContainer("sha256:def4567890abcdef", &config.Container{})
+	actual := newContainer("sha256:abc1234567890abc", &config.Container{})
+
+	assert.Equal(t, "image updated: sha256:abc123456789 -> sha256:def4567890ab", expected.Difference(actual))
+	assert.False(t, expected.IsEqualTo(actual))
+
+	expected.Config.IgnoreImageUpdate = &ignore
+	assert.Equal(t, "", expected.Difference(actual))
+	assert.True(t, expected.IsEqualTo(actual))
+
+	// image id is not known before the image is fetched
+	assert.True(t, newContainer("", &config.Container{}).IsEqualTo(actual))
+}
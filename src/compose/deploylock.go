@@ -0,0 +1,257 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// DefaultDeployLockTTL is how long the deploy lock is valid, expired locks
+	// are taken over by other runs
+	DefaultDeployLockTTL = 30 * time.Minute
+
+	// DefaultDeployLockTimeout is how long run waits for the deploy lock held by another run
+	DefaultDeployLockTimeout = time.Minute
+
+	deployLockImage     = "rocker-compose-lock"
+	deployLockImageTag  = "latest"
+	deployLockLabel     = "rocker-compose-lock"
+	deployLockHolder    = "rocker-compose-lock.holder"
+	deployLockAcquired  = "rocker-compose-lock.acquired"
+	deployLockExpires   = "rocker-compose-lock.expires"
+	deployLockNamespace = "rocker-compose-lock.namespace"
+)
+
+// deployLockRetryInterval is how often the busy deploy lock is checked
+var deployLockRetryInterval = 2 * time.Second
+
+// DeployLock prevents concurrent runs against the same namespace. It is a sentinel
+// container that is created but never started, so the lock works for all clients
+// of the same Docker daemon. Creation of containers with the same name is atomic.
+type DeployLock struct {
+	ID         string
+	Namespace  string
+	Holder     string
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
+
+// ErrDeployLocked is returned when the deploy lock is held by another run
+type ErrDeployLocked struct {
+	Lock *DeployLock
+}
+
+// Error returns string representation of the error
+func (e ErrDeployLocked) Error() string {
+	return fmt.Sprintf("Namespace %s is locked by %s since %s (expires at %s), use `rocker-compose force-unlock` if it is stale",
+		e.Lock.Namespace, e.Lock.Holder, e.Lock.AcquiredAt.Format(time.RFC3339), e.Lock.ExpiresAt.Format(time.RFC3339))
+}
+
+// IsExpired returns true if the lock is not valid any longer
+func (lock *DeployLock) IsExpired(now time.Time) bool {
+	return now.After(lock.ExpiresAt)
+}
+
+// NewDeployLockHolder describes the current process for the deploy lock, e.g. "deployer@ci-1 pid 123, run"
+func NewDeployLockHolder(command string) string {
+	user, host := currentUserHost()
+	return fmt.Sprintf("%s@%s pid %d, %s", user, host, os.Getpid(), command)
+}
+
+// currentUserHost returns the user and host name for deploy locks
+func currentUserHost() (user, host string) {
+	if user = os.Getenv("USER"); user == "" {
+		user = "unknown"
+	}
+	var err error
+	if host, err = os.Hostname(); err != nil {
+		host = "unknown"
+	}
+	return user, host
+}
+
+// deployLockName returns the name of the sentinel container of the namespace
+func deployLockName(namespace string) string {
+	return "rocker-compose-lock." + namespace
+}
+
+// AcquireDeployLock takes the deploy lock of the namespace, waiting up to timeout
+// while it is held by another run. Expired locks are taken over.
+func (client *DockerClient) AcquireDeployLock(namespace, holder string, ttl, timeout time.Duration) (*DeployLock, error) {
+	if ttl <= 0 {
+		ttl = DefaultDeployLockTTL
+	}
+	if err := client.ensureDeployLockImage(); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+
+	for {
+		now := time.Now()
+		lock := &DeployLock{
+			Namespace:  namespace,
+			Holder:     holder,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(ttl),
+		}
+
+		container, err := client.Docker.CreateContainer(docker.CreateContainerOptions{
+			Name: deployLockName(namespace),
+			Config: &docker.Config{
+				Image:  deployLockImage + ":" + deployLockImageTag,
+				Cmd:    []string{"lock"},
+				Labels: lock.labels(),
+			},
+		})
+		if err == nil {
+			lock.ID = container.ID
+			log.Debugf("Acquired deploy lock of namespace %s", namespace)
+			return lock, nil
+		}
+		if err != docker.ErrContainerAlreadyExists {
+			return nil, fmt.Errorf("Failed to create deploy lock of namespace %s, error: %s", namespace, err)
+		}
+
+		current, err := client.GetDeployLock(namespace)
+		if err != nil {
+			return nil, err
+		}
+		// removed in the meantime, try again
+		if current == nil {
+			continue
+		}
+
+		if current.IsExpired(now) {
+			log.Warnf("Deploy lock of namespace %s held by %s expired at %s, taking it over",
+				namespace, current.Holder, current.ExpiresAt.Format(time.RFC3339))
+			if err := client.removeDeployLock(current); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if now.After(deadline) {
+			return nil, ErrDeployLocked{current}
+		}
+		if !waiting {
+			log.Infof("Namespace %s is locked by %s since %s, waiting up to %s",
+				namespace, current.Holder, current.AcquiredAt.Format(time.RFC3339), timeout)
+			waiting = true
+		}
+		time.Sleep(deployLockRetryInterval)
+	}
+}
+
+// ReleaseDeployLock removes the deploy lock taken by AcquireDeployLock
+func (client *DockerClient) ReleaseDeployLock(lock *DeployLock) error {
+	log.Debugf("Releasing deploy lock of namespace %s", lock.Namespace)
+	return client.removeDeployLock(lock)
+}
+
+// GetDeployLock returns the deploy lock of the namespace, nil if it is not locked
+func (client *DockerClient) GetDeployLock(namespace string) (*DeployLock, error) {
+	container, err := client.Docker.InspectContainer(deployLockName(namespace))
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to inspect deploy lock of namespace %s, error: %s", namespace, err)
+	}
+	return deployLockFromLabels(container.ID, container.Config.Labels), nil
+}
+
+// ForceUnlock removes the deploy lock of the namespace regardless of its holder,
+// returns the removed lock or nil if the namespace was not locked
+func (client *DockerClient) ForceUnlock(namespace string) (*DeployLock, error) {
+	lock, err := client.GetDeployLock(namespace)
+	if err != nil || lock == nil {
+		return nil, err
+	}
+	return lock, client.removeDeployLock(lock)
+}
+
+// removeDeployLock removes the sentinel container by id, so the lock taken over by
+// another run in the meantime is not removed
+func (client *DockerClient) removeDeployLock(lock *DeployLock) error {
+	err := client.Docker.RemoveContainer(docker.RemoveContainerOptions{ID: lock.ID, Force: true})
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to remove deploy lock of namespace %s, error: %s", lock.Namespace, err)
+	}
+	return nil
+}
+
+// ensureDeployLockImage imports an empty image for sentinel containers, if there is none
+func (client *DockerClient) ensureDeployLockImage() error {
+	name := deployLockImage + ":" + deployLockImageTag
+	_, err := client.Docker.InspectImage(name)
+	if err != docker.ErrNoSuchImage {
+		return err
+	}
+
+	log.Debugf("Importing image %s for deploy locks", name)
+
+	// empty tar archive
+	var buf bytes.Buffer
+	if err := tar.NewWriter(&buf).Close(); err != nil {
+		return err
+	}
+	err = client.Docker.ImportImage(docker.ImportImageOptions{
+		Repository:   deployLockImage,
+		Tag:          deployLockImageTag,
+		Source:       "-",
+		InputStream:  &buf,
+		OutputStream: &bytes.Buffer{},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to import image %s for deploy locks, error: %s", name, err)
+	}
+	return nil
+}
+
+func (lock *DeployLock) labels() map[string]string {
+	return map[string]string{
+		deployLockLabel:     "true",
+		deployLockNamespace: lock.Namespace,
+		deployLockHolder:    lock.Holder,
+		deployLockAcquired:  lock.AcquiredAt.UTC().Format(time.RFC3339),
+		deployLockExpires:   lock.ExpiresAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// deployLockFromLabels reads the lock from labels of the sentinel container,
+// locks with unreadable expiration time are considered expired
+func deployLockFromLabels(id string, labels map[string]string) *DeployLock {
+	lock := &DeployLock{
+		ID:        id,
+		Namespace: labels[deployLockNamespace],
+		Holder:    labels[deployLockHolder],
+	}
+	lock.AcquiredAt, _ = time.Parse(time.RFC3339, labels[deployLockAcquired])
+	lock.ExpiresAt, _ = time.Parse(time.RFC3339, labels[deployLockExpires])
+	return lock
+}
@@ -0,0 +1,100 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDeployLockLabels(t *testing.T) {
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	lock := &DeployLock{
+		Namespace:  "app",
+		Holder:     "deployer@ci-1 pid 123, run",
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(DefaultDeployLockTTL),
+	}
+
+	read := deployLockFromLabels("123", lock.labels())
+	assert.Equal(t, "123", read.ID)
+	assert.Equal(t, lock.Namespace, read.Namespace)
+	assert.Equal(t, lock.Holder, read.Holder)
+	assert.True(t, lock.AcquiredAt.Equal(read.AcquiredAt))
+	assert.True(t, lock.ExpiresAt.Equal(read.ExpiresAt))
+
+	assert.False(t, read.IsExpired(now.Add(time.Minute)))
+	assert.True(t, read.IsExpired(now.Add(time.Hour)))
+
+	// broken labels make the lock expired
+	assert.True(t, deployLockFromLabels("123", map[string]string{}).IsExpired(now))
+}
+
+func TestRunActionDeployLocked(t *testing.T) {
+	held := &DeployLock{Namespace: "app", Holder: "deployer@ci-2 pid 1, run"}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", "me", time.Duration(0), time.Second).Return(held, ErrDeployLocked{held})
+
+	compose := &Compose{
+		Manifest:    &config.Config{Namespace: "app"},
+		LockHolder:  "me",
+		LockTimeout: time.Second,
+		client:      client,
+	}
+
+	err := compose.RunAction()
+	assert.Equal(t, ErrDeployLocked{held}, err)
+	client.AssertExpectations(t)
+	client.AssertNotCalled(t, "GetContainers")
+}
+
+func TestRunActionReleasesDeployLock(t *testing.T) {
+	lock := &DeployLock{ID: "123", Namespace: "app"}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(lock, nil)
+	client.On("ReleaseDeployLock", lock).Return(nil)
+	client.On("GetContainers").Return(nil)
+
+	compose := &Compose{Manifest: &config.Config{Namespace: "app"}, client: client}
+
+	assert.Nil(t, compose.RunAction())
+	client.AssertExpectations(t)
+}
+
+func TestRunActionReleasesDeployLockBeforeAttach(t *testing.T) {
+	lock := &DeployLock{ID: "123", Namespace: "app"}
+	released := false
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(lock, nil)
+	client.On("ReleaseDeployLock", lock).Return(nil).Run(func(mock.Arguments) { released = true })
+	client.On("GetContainers").Return(nil)
+	client.On("AttachToContainers", mock.Anything).Return(nil).Run(func(mock.Arguments) {
+		assert.True(t, released, "the lock should be released before attaching")
+	})
+
+	compose := &Compose{Manifest: &config.Config{Namespace: "app"}, Attach: true, client: client}
+
+	assert.Nil(t, compose.RunAction())
+	client.AssertExpectations(t)
+}
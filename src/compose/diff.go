@@ -34,6 +34,7 @@ type Diff interface {
 // graph with container dependencies
 type graph struct {
 	ns           string
+	keep         []config.ContainerName
 	dependencies map[*Container][]*dependency
 }
 
@@ -44,10 +45,12 @@ type dependency struct {
 	waitForIt bool
 }
 
-// NewDiff returns an implementation of Diff object
-func NewDiff(ns string) Diff {
+// NewDiff returns an implementation of Diff object. Containers listed in keep
+// are known to the manifest, though not expected, and should not be removed.
+func NewDiff(ns string, keep ...config.ContainerName) Diff {
 	return &graph{
 		ns:           ns,
+		keep:         keep,
 		dependencies: make(map[*Container][]*dependency),
 	}
 }
@@ -69,7 +72,7 @@ func (g *graph) Diff(expected []*Container, actual []*Container) (res []Action,
 		return
 	}
 
-	res = listContainersToRemove(g.ns, expected, actual)
+	res = listContainersToRemove(g.ns, expected, actual, g.keep)
 	res = append(res, g.buildExecutionPlan(actual)...)
 	return
 }
@@ -147,13 +150,16 @@ func resolveDependencies(ns string, expected []*Container, actual []*Container,
 	return
 }
 
-func listContainersToRemove(ns string, expected []*Container, actual []*Container) (res []Action) {
+func listContainersToRemove(ns string, expected []*Container, actual []*Container, keep []config.ContainerName) (res []Action) {
 	for _, a := range actual {
 		if a.Name.Namespace == ns {
 			var found bool
 			for _, e := range expected {
 				found = found || e.IsSameKind(a)
 			}
+			for k := range keep {
+				found = found || keep[k].IsEqualTo(a.Name)
+			}
 			if !found {
 				res = append(res, NewRemoveContainerAction(a))
 			}
@@ -207,12 +213,13 @@ func (g *graph) buildExecutionPlan(actual []*Container) (res []Action) {
 			for _, actualContainer := range actual {
 				if container.IsSameKind(actualContainer) {
 					//in configuration was changed or restart forced by dependency - recreate container
-					if !container.IsEqualTo(actualContainer) || restart {
-						restartActions := []Action{
-							NewStepAction(true, depActions...),
-							NewRemoveContainerAction(actualContainer),
-							NewRunContainerAction(container),
-						}
+					reason := container.Difference(actualContainer)
+					if reason == "" && restart {
+						reason = "dependency recreated"
+					}
+					if reason != "" {
+						restartActions := append([]Action{NewStepAction(true, depActions...)},
+							NewRecreateContainerActions(actualContainer, container, reason)...)
 
 						// in recovery mode we have to ensure containers are started
 						if container.Name.Namespace != g.ns {
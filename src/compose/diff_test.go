@@ -19,8 +19,11 @@ package compose
 import (
 	"compose/config"
 	"fmt"
+	"io"
 	"testing"
+	"time"
 
+	"github.com/fsouza/go-dockerclient"
 	"github.com/grammarly/rocker/src/rocker/imagename"
 	"github.com/grammarly/rocker/src/rocker/template"
 	"github.com/stretchr/testify/assert"
@@ -342,6 +345,37 @@ func TestDiffCreateRemoving(t *testing.T) {
 	mock.AssertExpectations(t)
 }
 
+func TestDiffKeepInactive(t *testing.T) {
+	cmp := NewDiff("test", config.ContainerName{Namespace: "test", Name: "3"})
+	c1 := newContainer("test", "1")
+	c2 := newContainer("test", "2")
+	c3 := newContainer("test", "3")
+	actions, _ := cmp.Diff([]*Container{c1}, []*Container{c1, c2, c3})
+	mock := clientMock{}
+	mock.On("RemoveContainer", c2).Return(nil)
+	runner := NewDockerClientRunner(&mock)
+	runner.Run(actions)
+	mock.AssertExpectations(t)
+}
+
+func TestDiffRecreateReason(t *testing.T) {
+	cmp := NewDiff("test")
+	expected := newContainer("test", "1")
+	expected.ImageID = "sha256:def4567890abcdef"
+	actual := newContainer("test", "1")
+	actual.ImageID = "sha256:abc1234567890abc"
+	actions, _ := cmp.Diff([]*Container{expected}, []*Container{actual})
+
+	plan := []string{}
+	WalkActions(actions, func(action Action) {
+		plan = append(plan, action.String())
+	})
+	assert.Equal(t, []string{
+		"Removing container 'test.1' (image updated: sha256:abc123456789 -> sha256:def4567890ab)",
+		"Creating container 'test.1' (image updated: sha256:abc123456789 -> sha256:def4567890ab)",
+	}, plan)
+}
+
 func TestDiffCreateSome(t *testing.T) {
 	cmp := NewDiff("test")
 	containers := []*Container{}
@@ -436,6 +470,10 @@ func newContainerWaitFor(namespace string, name string, dependencies ...config.C
 
 func (m *clientMock) GetContainers(global bool) ([]*Container, error) {
 	args := m.Called()
+	// either containers or an error is given
+	if containers, ok := args.Get(0).([]*Container); ok {
+		return containers, nil
+	}
 	return nil, args.Error(0)
 }
 
@@ -469,8 +507,8 @@ func (m *clientMock) PullAll(containers []*Container, vars template.Vars) error
 	return args.Error(0)
 }
 
-func (m *clientMock) Clean(cfg *config.Config) error {
-	args := m.Called(cfg)
+func (m *clientMock) Clean(cfg *config.Config, recorded []string, dryRun bool) error {
+	args := m.Called(cfg, recorded, dryRun)
 	return args.Error(0)
 }
 
@@ -484,6 +522,11 @@ func (m *clientMock) AttachToContainers(container []*Container) error {
 	return args.Error(0)
 }
 
+func (m *clientMock) ResolveImages(container []*Container, hub bool, vars template.Vars) error {
+	args := m.Called(container, hub, vars)
+	return args.Error(0)
+}
+
 func (m *clientMock) FetchImages(container []*Container, vars template.Vars) error {
 	args := m.Called(container, vars)
 	return args.Error(0)
@@ -504,6 +547,84 @@ func (m *clientMock) GetRemovedImages() []*imagename.ImageName {
 	return []*imagename.ImageName{}
 }
 
+func (m *clientMock) GetCleanableImages() []*imagename.ImageName {
+	args := m.Called()
+	if images, ok := args.Get(0).([]*imagename.ImageName); ok {
+		return images
+	}
+	return []*imagename.ImageName{}
+}
+
+func (m *clientMock) GetReclaimedSpace() int64 {
+	m.Called()
+	return 0
+}
+
+func (m *clientMock) PinDigests(containers []*Container, localOnly bool) error {
+	args := m.Called(containers, localOnly)
+	return args.Error(0)
+}
+
+func (m *clientMock) ListImageTags(image *imagename.ImageName, local, hub bool) ([]*imagename.ImageName, error) {
+	args := m.Called(image, local, hub)
+	return args.Get(0).([]*imagename.ImageName), args.Error(1)
+}
+
+func (m *clientMock) BuildImages(containers []*Container) error {
+	args := m.Called(containers)
+	return args.Error(0)
+}
+
+func (m *clientMock) SaveBundle(index *BundleIndex, w io.Writer) error {
+	args := m.Called(index, w)
+	return args.Error(0)
+}
+
+func (m *clientMock) LoadBundle(r io.ReadSeeker) (*BundleIndex, error) {
+	args := m.Called(r)
+	return args.Get(0).(*BundleIndex), args.Error(1)
+}
+
+func (m *clientMock) GetRecoveredContainers() []*Container {
+	args := m.Called()
+	return args.Get(0).([]*Container)
+}
+
+func (m *clientMock) AddEventListener(ch chan *docker.APIEvents) error {
+	args := m.Called(ch)
+	return args.Error(0)
+}
+
+func (m *clientMock) RemoveEventListener(ch chan *docker.APIEvents) error {
+	args := m.Called(ch)
+	return args.Error(0)
+}
+
+func (m *clientMock) AcquireDeployLock(namespace, holder string, ttl, timeout time.Duration) (*DeployLock, error) {
+	args := m.Called(namespace, holder, ttl, timeout)
+	return args.Get(0).(*DeployLock), args.Error(1)
+}
+
+func (m *clientMock) ReleaseDeployLock(lock *DeployLock) error {
+	args := m.Called(lock)
+	return args.Error(0)
+}
+
+func (m *clientMock) GetDeployLock(namespace string) (*DeployLock, error) {
+	args := m.Called(namespace)
+	return args.Get(0).(*DeployLock), args.Error(1)
+}
+
+func (m *clientMock) ForceUnlock(namespace string) (*DeployLock, error) {
+	args := m.Called(namespace)
+	return args.Get(0).(*DeployLock), args.Error(1)
+}
+
+func (m *clientMock) GetImageDigests(containers []*Container) (map[string]string, error) {
+	args := m.Called(containers)
+	return args.Get(0).(map[string]string), args.Error(1)
+}
+
 func (m *clientMock) Pin(local, hub bool, vars template.Vars, container []*Container) error {
 	args := m.Called(local, hub, vars, container)
 	return args.Error(0)
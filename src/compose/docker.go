@@ -17,6 +17,7 @@
 package compose
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 
@@ -92,13 +93,7 @@ func GetBridgeIP(client *docker.Client) (ip string, err error) {
 func PullDockerImage(client *docker.Client, image *imagename.ImageName, auth *docker.AuthConfiguration) (*docker.Image, error) {
 	pipeReader, pipeWriter := io.Pipe()
 
-	pullOpts := docker.PullImageOptions{
-		Repository:    image.NameWithRegistry(),
-		Registry:      image.Registry,
-		Tag:           image.Tag,
-		OutputStream:  pipeWriter,
-		RawJSONStream: true,
-	}
+	pullOpts := pullImageOptions(image, pipeWriter)
 
 	errch := make(chan error, 1)
 
@@ -135,3 +130,73 @@ func PullDockerImage(client *docker.Client, image *imagename.ImageName, auth *do
 
 	return img, nil
 }
+
+// pullDockerImageStream pulls an image, feeding every message of the pull stream to the given
+// function instead of displaying it. It is used for pulling several images concurrently.
+func pullDockerImageStream(client *docker.Client, image *imagename.ImageName, auth *docker.AuthConfiguration, fn func(*jsonmessage.JSONMessage)) (*docker.Image, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	errch := make(chan error, 1)
+
+	go func() {
+		err := client.PullImage(pullImageOptions(image, pipeWriter), *auth)
+
+		if err := pipeWriter.Close(); err != nil {
+			log.Errorf("Failed to close pull image stream for %s, error: %s", image, err)
+		}
+
+		errch <- err
+	}()
+
+	var streamErr error
+	decoder := json.NewDecoder(pipeReader)
+	for {
+		msg := &jsonmessage.JSONMessage{}
+		if err := decoder.Decode(msg); err == io.EOF {
+			break
+		} else if err != nil {
+			// make the pulling goroutine fail instead of blocking on write
+			pipeReader.CloseWithError(err)
+			<-errch
+			return nil, fmt.Errorf("Failed to process json stream for image: %s, error: %s", image, err)
+		}
+		if msg.Error != nil {
+			streamErr = msg.Error
+		} else if msg.ErrorMessage != "" {
+			streamErr = fmt.Errorf("%s", msg.ErrorMessage)
+		}
+		fn(msg)
+	}
+
+	if err := <-errch; err != nil {
+		return nil, err
+	}
+	if streamErr != nil {
+		return nil, streamErr
+	}
+
+	img, err := client.InspectImage(image.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to inspect image %s after pull, error: %s", image, err)
+	}
+
+	return img, nil
+}
+
+func pullImageOptions(image *imagename.ImageName, out io.Writer) docker.PullImageOptions {
+	pullOpts := docker.PullImageOptions{
+		Repository:    image.NameWithRegistry(),
+		Registry:      image.Registry,
+		Tag:           image.Tag,
+		OutputStream:  out,
+		RawJSONStream: true,
+	}
+
+	// images pinned by digest are pulled as "name@sha256:..." references
+	if image.TagIsSha() {
+		pullOpts.Repository = image.String()
+		pullOpts.Tag = ""
+	}
+
+	return pullOpts
+}
@@ -0,0 +1,206 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Types of events of the deploy progress
+const (
+	EventPlan             = "plan"
+	EventActionStarted    = "action_started"
+	EventActionFinished   = "action_finished"
+	EventImagePulled      = "image_pulled"
+	EventContainerHealthy = "container_healthy"
+	EventRollback         = "rollback"
+	EventFinished         = "finished"
+
+	// EventStarted starts the deploy in the journal
+	EventStarted = "started"
+)
+
+// Event is a single event of the deploy progress, written as a JSON line
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Host        string    `json:"host,omitempty"` // name of the inventory host, when deploying to many of them
+	Namespace   string    `json:"namespace,omitempty"`
+	User        string    `json:"user,omitempty"` // user@host who started the deploy
+	Step        int       `json:"step,omitempty"` // index of the plan step, starting from 1
+	Action      string    `json:"action,omitempty"`
+	Container   string    `json:"container,omitempty"`
+	ContainerID string    `json:"container_id,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	Plan        []string  `json:"plan,omitempty"`
+	Revision    int       `json:"revision,omitempty"`
+	Duration    float64   `json:"duration,omitempty"` // seconds
+	Error       string    `json:"error,omitempty"`
+}
+
+// EventStream writes events as JSON lines, so that deploy progress can be followed
+// by other programs. A nil stream discards events.
+type EventStream struct {
+	outs []*eventOutput
+	host string
+}
+
+// eventOutput is shared by streams of all hosts
+type eventOutput struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewEventStream makes a stream writing to w
+func NewEventStream(w io.Writer) *EventStream {
+	return &EventStream{outs: []*eventOutput{{enc: json.NewEncoder(w)}}}
+}
+
+// Tee returns the stream writing events to outputs of both streams, e.g. to the journal
+func (s *EventStream) Tee(other *EventStream) *EventStream {
+	if s == nil {
+		return other
+	}
+	if other == nil {
+		return s
+	}
+	outs := append(append([]*eventOutput{}, s.outs...), other.outs...)
+	return &EventStream{outs: outs, host: s.host}
+}
+
+// WithHost returns the stream marking events with the host, it writes to the same output
+func (s *EventStream) WithHost(host string) *EventStream {
+	if s == nil {
+		return nil
+	}
+	return &EventStream{outs: s.outs, host: host}
+}
+
+// Emit writes the event, the time is set if it is not given
+func (s *EventStream) Emit(event *Event) {
+	if s == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Host == "" {
+		event.Host = s.host
+	}
+
+	for _, out := range s.outs {
+		out.emit(event)
+	}
+}
+
+func (out *eventOutput) emit(event *Event) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	// progress reporting should never break the deploy
+	if err := out.enc.Encode(event); err != nil {
+		log.Warnf("Failed to write event %s, error: %s", event.Type, err)
+	}
+}
+
+// eventAction emits events before and after execution of the wrapped action
+// and records its metrics
+type eventAction struct {
+	Action
+	step    int
+	events  *EventStream
+	metrics *Metrics
+}
+
+// withEvents wraps the action and all actions of the step, so they emit events and metrics
+func withEvents(a Action, step int, events *EventStream, metrics *Metrics) Action {
+	if s, ok := a.(*stepAction); ok {
+		actions := make([]Action, len(s.actions))
+		for i, child := range s.actions {
+			actions[i] = withEvents(child, step, events, metrics)
+		}
+		return &stepAction{actions: actions, async: s.async}
+	}
+	if a == NoAction {
+		return a
+	}
+	return &eventAction{Action: a, step: step, events: events, metrics: metrics}
+}
+
+// Execute runs the action, emits events of its start and finish and records its metrics
+func (a *eventAction) Execute(client Client) error {
+	container := actionContainer(a.Action)
+
+	started := &Event{Type: EventActionStarted, Step: a.step, Action: a.Action.String()}
+	setEventContainer(started, container)
+	a.events.Emit(started)
+
+	start := time.Now()
+	err := a.Action.Execute(client)
+
+	// id of the created container is known only now
+	finished := &Event{
+		Type:     EventActionFinished,
+		Step:     a.step,
+		Action:   a.Action.String(),
+		Duration: time.Since(start).Seconds(),
+	}
+	setEventContainer(finished, container)
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	a.events.Emit(finished)
+	a.metrics.ObserveAction(actionKind(a.Action), time.Since(start), err)
+
+	if err == nil && container != nil && container.healthy {
+		healthy := &Event{Type: EventContainerHealthy, Step: a.step}
+		setEventContainer(healthy, container)
+		a.events.Emit(healthy)
+	}
+
+	return err
+}
+
+// actionContainer returns the container the action deals with, nil if there is none
+func actionContainer(a Action) *Container {
+	switch a := a.(type) {
+	case *runContainer:
+		return a.container
+	case *removeContainer:
+		return a.container
+	case *ensureContainerExist:
+		return a.container
+	case *ensureContainerState:
+		return a.container
+	case *waitContainerAction:
+		return a.container
+	}
+	return nil
+}
+
+func setEventContainer(event *Event, container *Container) {
+	if container == nil {
+		return
+	}
+	event.Container = container.Name.String()
+	event.ContainerID = container.ID
+}
@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bytes"
+	"compose/config"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestEventStreamEmit(t *testing.T) {
+	var nilStream *EventStream
+	nilStream.Emit(&Event{Type: EventPlan})
+
+	buf := &bytes.Buffer{}
+	stream := NewEventStream(buf)
+	stream.Emit(&Event{Type: EventImagePulled, Image: "myapp:1.2.3", Container: "app.web"})
+	stream.Emit(&Event{Type: EventFinished})
+
+	events := readEvents(t, buf)
+	assert.Len(t, events, 2)
+	assert.Equal(t, EventImagePulled, events[0].Type)
+	assert.Equal(t, "myapp:1.2.3", events[0].Image)
+	assert.Equal(t, "app.web", events[0].Container)
+	assert.False(t, events[0].Time.IsZero())
+	assert.Equal(t, EventFinished, events[1].Type)
+
+	// streams of hosts write to the same output
+	stream.WithHost("web1").Emit(&Event{Type: EventFinished})
+	events = readEvents(t, buf)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "web1", events[0].Host)
+}
+
+func TestEventStreamTee(t *testing.T) {
+	var nilStream *EventStream
+	first, second := &bytes.Buffer{}, &bytes.Buffer{}
+	stream := NewEventStream(first)
+
+	assert.Equal(t, stream, stream.Tee(nil))
+	assert.Equal(t, stream, nilStream.Tee(stream))
+
+	stream.WithHost("web1").Tee(NewEventStream(second)).Emit(&Event{Type: EventFinished})
+	for _, buf := range []*bytes.Buffer{first, second} {
+		events := readEvents(t, buf)
+		assert.Len(t, events, 1)
+		assert.Equal(t, "web1", events[0].Host)
+	}
+}
+
+func TestRunActionEvents(t *testing.T) {
+	image := "myapp:1.2.3"
+	manifest := &config.Config{
+		Namespace: "app",
+		Containers: map[string]*config.Container{
+			"web": {Image: &image},
+		},
+	}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("RunContainer", mock.Anything).Return(errors.New("no space left"))
+
+	buf := &bytes.Buffer{}
+	compose := &Compose{
+		Manifest: manifest,
+		Events:   NewEventStream(buf),
+		client:   client,
+	}
+
+	assert.Error(t, compose.RunAction())
+
+	events := readEvents(t, buf)
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{EventPlan, EventActionStarted, EventActionFinished, EventFinished}, types)
+
+	assert.Equal(t, []string{"Creating container 'app.web'"}, events[0].Plan)
+	assert.Equal(t, "app", events[0].Namespace)
+
+	for _, event := range events[1:3] {
+		assert.Equal(t, 1, event.Step)
+		assert.Equal(t, "app.web", event.Container)
+		assert.Equal(t, "Creating container 'app.web'", event.Action)
+	}
+	assert.Equal(t, "no space left", events[2].Error)
+	assert.Contains(t, events[3].Error, "no space left")
+}
+
+func readEvents(t *testing.T, buf *bytes.Buffer) []*Event {
+	events := []*Event{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		event := &Event{}
+		if err := dec.Decode(event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEventActionHealthy(t *testing.T) {
+	container := &Container{ID: "123", Name: config.NewContainerName("app", "web")}
+
+	client := &clientMock{}
+	client.On("RunContainer", container).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(0).(*Container).healthy = true
+	})
+
+	buf := &bytes.Buffer{}
+	action := withEvents(NewRunContainerAction(container), 2, NewEventStream(buf), nil)
+	assert.NoError(t, action.Execute(client))
+
+	events := readEvents(t, buf)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, EventContainerHealthy, events[2].Type)
+		assert.Equal(t, 2, events[2].Step)
+		assert.Equal(t, "app.web", events[2].Container)
+		assert.Equal(t, "123", events[2].ContainerID)
+	}
+}
@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"fmt"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ContainerInspector is the part of the docker client needed for the container helpers
+type ContainerInspector interface {
+	InspectContainer(id string) (*docker.Container, error)
+}
+
+// ContainerHelpers returns template helpers that look at running containers:
+//
+//	{{ containerIp "namespace.name" }}          ip address of the container
+//	{{ containerPort "namespace.name" "80" }}   host port the container's 80/tcp port is published to
+//
+// Containers are inspected lazily, only once per name.
+func ContainerHelpers(client ContainerInspector) map[string]interface{} {
+	inspected := map[string]*docker.Container{}
+
+	inspect := func(name string) (*docker.Container, error) {
+		name = config.NewContainerNameFromString(name).String()
+		if container, ok := inspected[name]; ok {
+			return container, nil
+		}
+		container, err := client.InspectContainer(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to inspect container %s, error: %s", name, err)
+		}
+		inspected[name] = container
+		return container, nil
+	}
+
+	return map[string]interface{}{
+		"containerIp": func(name string) (string, error) {
+			container, err := inspect(name)
+			if err != nil {
+				return "", err
+			}
+			if container.NetworkSettings == nil || container.NetworkSettings.IPAddress == "" {
+				return "", fmt.Errorf("Container %s has no ip address, is it running?", name)
+			}
+			return container.NetworkSettings.IPAddress, nil
+		},
+		"containerPort": func(name, port string) (string, error) {
+			container, err := inspect(name)
+			if err != nil {
+				return "", err
+			}
+			if !strings.Contains(port, "/") {
+				port = port + "/tcp"
+			}
+			if container.NetworkSettings != nil {
+				for _, binding := range container.NetworkSettings.Ports[docker.Port(port)] {
+					if binding.HostPort != "" {
+						return binding.HostPort, nil
+					}
+				}
+			}
+			return "", fmt.Errorf("Port %s of container %s is not published", port, name)
+		},
+	}
+}
@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type inspectorMock struct {
+	containers map[string]*docker.Container
+	calls      int
+}
+
+func (m *inspectorMock) InspectContainer(id string) (*docker.Container, error) {
+	m.calls++
+	if container, ok := m.containers[id]; ok {
+		return container, nil
+	}
+	return nil, fmt.Errorf("no such container: %s", id)
+}
+
+func TestContainerHelpers(t *testing.T) {
+	client := &inspectorMock{
+		containers: map[string]*docker.Container{
+			"myapp.main": {
+				NetworkSettings: &docker.NetworkSettings{
+					IPAddress: "172.17.0.5",
+					Ports: map[docker.Port][]docker.PortBinding{
+						"80/tcp":   {{HostIP: "0.0.0.0", HostPort: "8080"}},
+						"53/udp":   {{HostIP: "0.0.0.0", HostPort: "5353"}},
+						"8125/tcp": {},
+					},
+				},
+			},
+			"myapp.stopped": {
+				NetworkSettings: &docker.NetworkSettings{},
+			},
+		},
+	}
+
+	helpers := ContainerHelpers(client)
+	containerIP := helpers["containerIp"].(func(string) (string, error))
+	containerPort := helpers["containerPort"].(func(string, string) (string, error))
+
+	ip, err := containerIP("myapp.main")
+	assert.Nil(t, err)
+	assert.Equal(t, "172.17.0.5", ip)
+
+	port, err := containerPort("myapp.main", "80")
+	assert.Nil(t, err)
+	assert.Equal(t, "8080", port)
+
+	port, err = containerPort("myapp.main", "53/udp")
+	assert.Nil(t, err)
+	assert.Equal(t, "5353", port)
+
+	// the container should be inspected only once
+	assert.Equal(t, 1, client.calls)
+
+	_, err = containerPort("myapp.main", "8125")
+	assert.EqualError(t, err, "Port 8125/tcp of container myapp.main is not published")
+
+	_, err = containerIP("myapp.stopped")
+	assert.EqualError(t, err, "Container myapp.stopped has no ip address, is it running?")
+
+	_, err = containerIP("myapp.missing")
+	assert.EqualError(t, err, "Failed to inspect container myapp.missing, error: no such container: myapp.missing")
+}
@@ -0,0 +1,372 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"util"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	// DefaultHistoryDir is where revisions of successful runs are kept, one directory per namespace
+	DefaultHistoryDir = "~/.rocker-compose/history"
+
+	// DefaultHistoryLimit is the number of revisions kept per namespace
+	DefaultHistoryLimit = 50
+)
+
+var revisionFileRe = regexp.MustCompile(`^(\d+)\.json$`)
+
+// Revision records a successful run: what was deployed, by whom and what was done.
+// Rollback renders Source with Vars again and runs the recorded images.
+type Revision struct {
+	Number       int              `json:"number"`
+	Namespace    string           `json:"namespace"`
+	CreatedAt    time.Time        `json:"created_at"`
+	User         string           `json:"user"`
+	Host         string           `json:"host"`
+	Command      string           `json:"command"`
+	ManifestFile string           `json:"manifest_file"`
+	Source       string           `json:"source"`   // manifest template as it was given
+	Rendered     string           `json:"rendered"` // rendered manifest with secrets redacted
+	Vars         template.Vars    `json:"vars"`     // vars with secrets redacted
+	Profiles     []string         `json:"profiles,omitempty"`
+	Images       []*RevisionImage `json:"images"`
+	Plan         []string         `json:"plan"`
+}
+
+// RevisionImage is the image a container was run with
+type RevisionImage struct {
+	Container string `json:"container"`
+	Image     string `json:"image"` // resolved image, e.g. "myapp:1.2.3" for "myapp:1.2.*"
+	Digest    string `json:"digest,omitempty"`
+	ID        string `json:"id"`
+}
+
+// NewRevision makes a revision of the run given by command, e.g. "run", of the manifest read from file
+func NewRevision(command, file, source string) *Revision {
+	user, host := currentUserHost()
+	return &Revision{
+		User:         user,
+		Host:         host,
+		Command:      command,
+		ManifestFile: file,
+		Source:       source,
+	}
+}
+
+// History keeps revisions of a namespace as numbered JSON files in a directory
+type History struct {
+	Dir   string
+	Limit int // oldest revisions above the limit are removed, DefaultHistoryLimit if zero
+}
+
+// NewHistory returns the history of the namespace kept under dir
+func NewHistory(dir, namespace string) (*History, error) {
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &History{Dir: filepath.Join(dir, namespace)}, nil
+}
+
+// List returns all revisions, the oldest first
+func (h *History) List() ([]*Revision, error) {
+	numbers, err := h.numbers()
+	if err != nil {
+		return nil, err
+	}
+	revisions := []*Revision{}
+	for _, n := range numbers {
+		rev, err := h.Get(n)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, nil
+}
+
+// Get reads the revision by number
+func (h *History) Get(n int) (*Revision, error) {
+	filename := h.path(n)
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Revision %d is not found in %s", n, h.Dir)
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read revision %s, error: %s", filename, err)
+	}
+	rev := &Revision{}
+	if err := json.Unmarshal(data, rev); err != nil {
+		return nil, fmt.Errorf("Failed to parse revision %s, error: %s", filename, err)
+	}
+	return rev, nil
+}
+
+// Previous returns the revision before the latest one, which is the default target of rollback
+func (h *History) Previous() (*Revision, error) {
+	numbers, err := h.numbers()
+	if err != nil {
+		return nil, err
+	}
+	if len(numbers) < 2 {
+		return nil, fmt.Errorf("There is no previous revision in %s to roll back to", h.Dir)
+	}
+	return h.Get(numbers[len(numbers)-2])
+}
+
+// Record saves the revision with the next number and removes the oldest revisions above the limit
+func (h *History) Record(rev *Revision) error {
+	numbers, err := h.numbers()
+	if err != nil {
+		return err
+	}
+	rev.Number = 1
+	if len(numbers) > 0 {
+		rev.Number = numbers[len(numbers)-1] + 1
+	}
+
+	data, err := json.MarshalIndent(rev, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(h.Dir, 0700); err != nil {
+		return fmt.Errorf("Failed to create history directory %s, error: %s", h.Dir, err)
+	}
+	// revisions may contain variables, keep them private
+	if err := ioutil.WriteFile(h.path(rev.Number), data, 0600); err != nil {
+		return fmt.Errorf("Failed to write revision %d, error: %s", rev.Number, err)
+	}
+
+	limit := h.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	numbers = append(numbers, rev.Number)
+	for i := 0; i < len(numbers)-limit; i++ {
+		if err := os.Remove(h.path(numbers[i])); err != nil {
+			log.Warnf("Failed to remove old revision %d, error: %s", numbers[i], err)
+		}
+	}
+
+	return nil
+}
+
+// numbers returns numbers of existing revisions in ascending order
+func (h *History) numbers() ([]int, error) {
+	files, err := ioutil.ReadDir(h.Dir)
+	if os.IsNotExist(err) {
+		return []int{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read history directory %s, error: %s", h.Dir, err)
+	}
+	numbers := []int{}
+	for _, f := range files {
+		if m := revisionFileRe.FindStringSubmatch(f.Name()); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+func (h *History) path(n int) string {
+	return filepath.Join(h.Dir, fmt.Sprintf("%06d.json", n))
+}
+
+// recordRevision fills the revision template with the results of the run and records it
+func (compose *Compose) recordRevision(containers []*Container) error {
+	rev := *compose.Revision
+	rev.Namespace = compose.Manifest.Namespace
+	rev.CreatedAt = time.Now()
+	rev.Rendered = util.Redact(compose.Manifest.Rendered)
+	rev.Vars = redactVars(compose.Manifest.Vars)
+	rev.Profiles = compose.Manifest.Profiles
+	rev.Plan = compose.Changes()
+	rev.Images = []*RevisionImage{}
+
+	digests, err := compose.client.GetImageDigests(containers)
+	if err != nil {
+		log.Warnf("Digests of images are not recorded in the revision, error: %s", err)
+	}
+
+	for _, container := range containers {
+		if container.Image == nil {
+			continue
+		}
+		rev.Images = append(rev.Images, &RevisionImage{
+			Container: container.Name.Name,
+			Image:     container.Image.String(),
+			Digest:    digests[container.Image.String()],
+			ID:        container.ImageID,
+		})
+	}
+	sort.Sort(revisionImagesByContainer(rev.Images))
+
+	if err := compose.History.Record(&rev); err != nil {
+		return err
+	}
+	log.Infof("Recorded revision %d of namespace %s", rev.Number, rev.Namespace)
+	compose.recorded = &rev
+	return nil
+}
+
+// RollbackAction implements 'rocker-compose rollback'. The manifest should be rendered
+// from the source of the revision; containers are run with images of the revision
+// through the normal diff and runner. Images are run by the recorded digest, since tags
+// may have moved since then; images without one should still have the recorded ID.
+func (compose *Compose) RollbackAction(rev *Revision) error {
+	compose.rollbackImages = map[string]*RevisionImage{}
+	defer func() { compose.rollbackImages = nil }()
+
+	for _, image := range rev.Images {
+		container, ok := compose.Manifest.Containers[image.Container]
+		if !ok || container.Image == nil {
+			continue
+		}
+		name := image.Image
+		if image.Digest != "" {
+			name = imagename.New(imagename.NewFromString(image.Image).NameWithRegistry(), image.Digest).String()
+		}
+		container.Image = &name
+		compose.rollbackImages[image.Container] = image
+	}
+
+	log.Infof("Rolling back namespace %s to revision %d of %s by %s@%s",
+		rev.Namespace, rev.Number, rev.CreatedAt.Format(time.RFC3339), rev.User, rev.Host)
+	compose.Events.Emit(&Event{Type: EventRollback, Namespace: rev.Namespace, Revision: rev.Number})
+
+	return compose.RunAction()
+}
+
+// checkRollbackImages fails if images of the rollback are not the ones of the revision,
+// which is the case of tags pointing to other images by now
+func (compose *Compose) checkRollbackImages(containers []*Container) error {
+	for _, container := range containers {
+		image, ok := compose.rollbackImages[container.Name.Name]
+		if !ok || image.ID == "" || container.ImageID == "" || container.ImageID == image.ID {
+			continue
+		}
+		if image.Digest != "" {
+			log.Warnf("Image %s of container %s is %s, but the revision recorded %s",
+				container.Image, container.Name, shortImageID(container.ImageID), shortImageID(image.ID))
+			continue
+		}
+		return fmt.Errorf("Image %s of container %s is %s by now, but the revision ran %s and has no digest recorded to roll back to",
+			container.Image, container.Name, shortImageID(container.ImageID), shortImageID(image.ID))
+	}
+	return nil
+}
+
+// recordedImageIDs returns IDs of images that revisions of the history recorded without
+// digests, so that clean keeps them: rollback cannot pull them back once they are removed
+func (compose *Compose) recordedImageIDs() ([]string, error) {
+	if compose.History == nil {
+		return nil, nil
+	}
+	revisions, err := compose.History.List()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, rev := range revisions {
+		for _, image := range rev.Images {
+			if image.ID != "" && image.Digest == "" {
+				ids = append(ids, image.ID)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// RollbackManifest renders the manifest of the revision with its variables again.
+// Redacted variables of the revision are taken from the given ones.
+func RollbackManifest(rev *Revision, vars template.Vars, funcs map[string]interface{}) (*config.Config, error) {
+	revVars := template.Vars{}
+	for k, v := range rev.Vars {
+		if str, ok := v.(string); ok && strings.Contains(str, util.Redacted) {
+			if v = vars[k]; v == nil {
+				return nil, fmt.Errorf("Variable %s of revision %d is a redacted secret, it should be given with --var or --vars", k, rev.Number)
+			}
+		}
+		revVars[k] = v
+	}
+	manifest, err := config.ReadConfig(rev.ManifestFile, strings.NewReader(rev.Source), revVars, funcs, false)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render the manifest of revision %d, error: %s", rev.Number, err)
+	}
+	manifest.Profiles = rev.Profiles
+	return manifest, nil
+}
+
+// redactVars returns a copy of vars with values of registered secrets redacted
+func redactVars(vars template.Vars) template.Vars {
+	if vars == nil {
+		return nil
+	}
+	redacted := template.Vars{}
+	for k, v := range vars {
+		redacted[k] = redactValue(v)
+	}
+	return redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return util.Redact(v)
+	case template.Vars:
+		return redactVars(v)
+	case map[string]interface{}:
+		return map[string]interface{}(redactVars(v))
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i := range v {
+			redacted[i] = redactValue(v[i])
+		}
+		return redacted
+	case []string:
+		redacted := make([]string, len(v))
+		for i := range v {
+			redacted[i] = util.Redact(v[i])
+		}
+		return redacted
+	}
+	return value
+}
+
+type revisionImagesByContainer []*RevisionImage
+
+func (a revisionImagesByContainer) Len() int           { return len(a) }
+func (a revisionImagesByContainer) Less(i, j int) bool { return a[i].Container < a[j].Container }
+func (a revisionImagesByContainer) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,257 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"io/ioutil"
+	"os"
+	"testing"
+	"util"
+
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHistoryRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	history, err := NewHistory(dir, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history.Limit = 3
+
+	revisions, err := history.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, revisions)
+
+	_, err = history.Previous()
+	assert.Error(t, err)
+
+	for i := 0; i < 4; i++ {
+		if err := history.Record(NewRevision("run", "compose.yml", "namespace: app")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest revision is removed above the limit
+	revisions, err = history.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := []int{}
+	for _, rev := range revisions {
+		numbers = append(numbers, rev.Number)
+	}
+	assert.Equal(t, []int{2, 3, 4}, numbers)
+
+	prev, err := history.Previous()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, prev.Number)
+	assert.Equal(t, "namespace: app", prev.Source)
+
+	_, err = history.Get(1)
+	assert.Error(t, err)
+}
+
+func TestCleanActionKeepsRecordedImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	history, err := NewHistory(dir, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := NewRevision("run", "compose.yml", "namespace: app")
+	rev.Images = []*RevisionImage{
+		{Container: "web", Image: "myapp:1.0", ID: "sha256:aaa"},
+		{Container: "worker", Image: "myapp:1.0", Digest: "sha256:0000", ID: "sha256:bbb"},
+	}
+	if err := history.Record(rev); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &config.Config{Namespace: "app"}
+	client := &clientMock{}
+	client.On("Clean", manifest, []string{"sha256:aaa"}, false).Return(nil)
+
+	compose := &Compose{Manifest: manifest, History: history, client: client}
+	assert.NoError(t, compose.CleanAction())
+	client.AssertExpectations(t)
+}
+
+func TestRollbackAction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	history, err := NewHistory(dir, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := "myapp:1.2.*"
+	manifest := &config.Config{
+		Namespace:  "app",
+		Containers: map[string]*config.Container{"web": {Image: &image}},
+	}
+	rev := &Revision{
+		Number:    1,
+		Namespace: "app",
+		Images:    []*RevisionImage{{Container: "web", Image: "myapp:1.2.3"}},
+	}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("RunContainer", mock.Anything).Return(nil)
+	client.On("WaitForContainer", mock.Anything).Return(nil)
+	client.On("GetImageDigests", mock.Anything).Return(map[string]string{"myapp:1.2.3": "sha256:123"}, nil)
+
+	compose := &Compose{
+		Manifest: manifest,
+		History:  history,
+		Revision: NewRevision("rollback --to 1", "compose.yml", "namespace: app"),
+		client:   client,
+	}
+
+	if err := compose.RollbackAction(rev); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "myapp:1.2.3", *manifest.Containers["web"].Image)
+
+	recorded, err := history.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "rollback --to 1", recorded.Command)
+	assert.Equal(t, []*RevisionImage{{Container: "web", Image: "myapp:1.2.3", Digest: "sha256:123"}}, recorded.Images)
+	assert.Equal(t, []string{"Creating container 'app.web'"}, recorded.Plan)
+}
+
+func TestRollbackActionByDigest(t *testing.T) {
+	image := "myapp:latest"
+	manifest := &config.Config{
+		Namespace:  "app",
+		Containers: map[string]*config.Container{"web": {Image: &image}},
+	}
+	rev := &Revision{
+		Number:    1,
+		Namespace: "app",
+		Images:    []*RevisionImage{{Container: "web", Image: "myapp:latest", Digest: "sha256:123", ID: "sha256:abc"}},
+	}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("RunContainer", mock.Anything).Return(nil)
+	client.On("WaitForContainer", mock.Anything).Return(nil)
+
+	compose := &Compose{Manifest: manifest, client: client}
+
+	if err := compose.RollbackAction(rev); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "myapp@sha256:123", *manifest.Containers["web"].Image)
+}
+
+func TestRollbackActionImageMoved(t *testing.T) {
+	image := "myapp:latest"
+	manifest := &config.Config{
+		Namespace:  "app",
+		Containers: map[string]*config.Container{"web": {Image: &image}},
+	}
+	rev := &Revision{
+		Number:    1,
+		Namespace: "app",
+		Images:    []*RevisionImage{{Container: "web", Image: "myapp:latest", ID: "sha256:abc"}},
+	}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		for _, container := range args.Get(0).([]*Container) {
+			container.ImageID = "sha256:def"
+		}
+	})
+
+	compose := &Compose{Manifest: manifest, client: client}
+
+	err := compose.RollbackAction(rev)
+	assert.EqualError(t, err, "Image myapp:latest of container app.web is sha256:def by now, but the revision ran sha256:abc and has no digest recorded to roll back to")
+	client.AssertNotCalled(t, "RunContainer", mock.Anything)
+}
+
+func TestRedactVars(t *testing.T) {
+	util.RegisterSecret("history-s3cr3t")
+
+	vars := template.Vars{
+		"version":  "1.2.3",
+		"password": "history-s3cr3t",
+		"db":       map[string]interface{}{"url": "postgres://app:history-s3cr3t@db"},
+		"hosts":    []interface{}{"a", "history-s3cr3t"},
+		"replicas": 2,
+	}
+	assert.Equal(t, template.Vars{
+		"version":  "1.2.3",
+		"password": util.Redacted,
+		"db":       map[string]interface{}{"url": "postgres://app:" + util.Redacted + "@db"},
+		"hosts":    []interface{}{"a", util.Redacted},
+		"replicas": 2,
+	}, redactVars(vars))
+	assert.Equal(t, "history-s3cr3t", vars["password"], "vars should not be modified")
+}
+
+func TestRollbackManifestRedactedVars(t *testing.T) {
+	rev := &Revision{
+		Number:       1,
+		ManifestFile: "compose.yml",
+		Source:       "namespace: app\ncontainers:\n  web:\n    image: myapp:{{ .version }}\n    env:\n      PASSWORD: {{ .password }}\n",
+		Vars:         template.Vars{"version": "1.2.3", "password": util.Redacted},
+	}
+
+	_, err := RollbackManifest(rev, template.Vars{}, nil)
+	assert.EqualError(t, err, "Variable password of revision 1 is a redacted secret, it should be given with --var or --vars")
+
+	manifest, err := RollbackManifest(rev, template.Vars{"password": "given", "version": "2.0.0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "myapp:1.2.3", *manifest.Containers["web"].Image)
+	assert.Equal(t, "given", manifest.Containers["web"].Env["PASSWORD"])
+}
@@ -0,0 +1,291 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mitchellh/go-homedir"
+)
+
+// DefaultStateDir is where journals of deploys are kept, one file per namespace (and host of run --hosts)
+const DefaultStateDir = "~/.rocker-compose/state"
+
+// Journal records the progress of a deploy as JSON lines of events, so that a deploy
+// interrupted midway, e.g. by a CI timeout, can be reported and resumed
+type Journal struct {
+	events *EventStream
+	file   *os.File
+}
+
+// JournalPath returns the journal file of the namespace kept under dir. Deploys to hosts
+// of an inventory (run --hosts) are journaled per host, e.g. app@web1.journal.
+func JournalPath(dir, namespace, host string) (string, error) {
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return "", err
+	}
+	name := namespace
+	if host != "" {
+		name += "@" + host
+	}
+	return filepath.Join(dir, name+".journal"), nil
+}
+
+// CreateJournal starts the journal of a deploy of the namespace, replacing the one of the previous deploy
+func CreateJournal(dir, namespace, host string) (*Journal, error) {
+	file, err := JournalPath(dir, namespace, host)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create state dir %s, error: %s", filepath.Dir(file), err)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create journal %s, error: %s", file, err)
+	}
+
+	user, machine := currentUserHost()
+	journal := &Journal{events: NewEventStream(f), file: f}
+	journal.events.Emit(&Event{Type: EventStarted, Namespace: namespace, Host: host, User: user + "@" + machine})
+	return journal, nil
+}
+
+// Events returns the stream writing to the journal, nil for a nil journal
+func (j *Journal) Events() *EventStream {
+	if j == nil {
+		return nil
+	}
+	return j.events
+}
+
+// Finish records the end of the deploy with its error, if any, and closes the journal
+func (j *Journal) Finish(err error) {
+	if j == nil {
+		return
+	}
+	finished := &Event{Type: EventFinished}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	j.events.Emit(finished)
+	if err := j.file.Close(); err != nil {
+		log.Warnf("Failed to close journal %s, error: %s", j.file.Name(), err)
+	}
+}
+
+// JournalState is the progress of a deploy read from its journal
+type JournalState struct {
+	Namespace string
+	Host      string // inventory host of run --hosts
+	User      string
+	Started   time.Time
+	Updated   time.Time // time of the last record
+	Plan      []string
+	Done      []string // actions finished successfully
+	Running   []string // actions started but not finished
+	Failed    []string // actions finished with an error
+	Finished  bool
+	Error     string
+}
+
+// ReadJournal reads the journal of the last deploy of the namespace, nil if there is none
+func ReadJournal(dir, namespace, host string) (*JournalState, error) {
+	file, err := JournalPath(dir, namespace, host)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read journal %s, error: %s", file, err)
+	}
+	defer f.Close()
+
+	state := &JournalState{Namespace: namespace, Host: host}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		event := &Event{}
+		// the last line is cut if the process was killed while writing it
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			log.Debugf("Skipping broken record of journal %s, error: %s", file, err)
+			continue
+		}
+		state.add(event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read journal %s, error: %s", file, err)
+	}
+	return state, nil
+}
+
+func (s *JournalState) add(event *Event) {
+	s.Updated = event.Time
+	switch event.Type {
+	case EventStarted:
+		s.Started = event.Time
+		s.User = event.User
+	case EventPlan:
+		s.Plan = event.Plan
+	case EventActionStarted:
+		s.Running = append(s.Running, event.Action)
+	case EventActionFinished:
+		s.Running = removeString(s.Running, event.Action)
+		if event.Error != "" {
+			s.Failed = append(s.Failed, event.Action)
+		} else {
+			s.Done = append(s.Done, event.Action)
+		}
+	case EventFinished:
+		s.Finished = true
+		s.Error = event.Error
+	}
+}
+
+// Interrupted is true if the deploy has not finished, e.g. the process was killed
+func (s *JournalState) Interrupted() bool {
+	return s != nil && !s.Finished
+}
+
+// Remaining returns actions of the plan that were not started
+func (s *JournalState) Remaining() []string {
+	remaining := []string{}
+	for _, action := range s.Plan {
+		if !containsString(s.Done, action) && !containsString(s.Running, action) && !containsString(s.Failed, action) {
+			remaining = append(remaining, action)
+		}
+	}
+	return remaining
+}
+
+// String returns a summary of the deploy progress
+func (s *JournalState) String() string {
+	namespace := s.Namespace
+	if s.Host != "" {
+		namespace += " on host " + s.Host
+	}
+	return fmt.Sprintf("deploy of namespace %s started at %s by %s, %d of %d actions done",
+		namespace, s.Started.Format(time.RFC3339), s.User, len(s.Done), len(s.Plan))
+}
+
+// ResumePlan is the plan of a deploy reconciled with the journal of the interrupted one
+type ResumePlan struct {
+	Done     []string // actions done by the interrupted deploy that are not needed again
+	Retry    []string // actions that were interrupted or failed, and are needed still
+	Redo     []string // actions that were done, but are needed again
+	Continue []string // actions of the interrupted plan that were not started
+	New      []string // actions that were not planned, the manifest or containers have changed since
+	Dropped  []string // actions of the interrupted plan that are not needed anymore
+	Failed   []string // actions that failed and are not planned anymore, something else changed the containers
+}
+
+// Reconcile compares the plan recomputed for the resumed deploy with the journal
+func (s *JournalState) Reconcile(plan []string) *ResumePlan {
+	resume := &ResumePlan{}
+	for _, action := range plan {
+		switch {
+		case containsString(s.Running, action) || containsString(s.Failed, action):
+			resume.Retry = append(resume.Retry, action)
+		case containsString(s.Done, action):
+			resume.Redo = append(resume.Redo, action)
+		case containsString(s.Plan, action):
+			resume.Continue = append(resume.Continue, action)
+		default:
+			resume.New = append(resume.New, action)
+		}
+	}
+	for _, action := range s.Done {
+		if !containsString(plan, action) {
+			resume.Done = append(resume.Done, action)
+		}
+	}
+	for _, action := range s.Plan {
+		if containsString(plan, action) || containsString(s.Done, action) {
+			continue
+		}
+		if containsString(s.Failed, action) {
+			resume.Failed = append(resume.Failed, action)
+		} else {
+			resume.Dropped = append(resume.Dropped, action)
+		}
+	}
+	return resume
+}
+
+// resumeJournal checks that the plan continues the interrupted deploy and reports how.
+// Resuming fails if actions that failed are not planned anymore, since the containers
+// were changed by something else and the result of the deploy cannot be foreseen.
+func resumeJournal(previous *JournalState, plan []string) error {
+	if !previous.Interrupted() {
+		log.Infof("No interrupted deploy to resume, running as usual")
+		return nil
+	}
+
+	resume := previous.Reconcile(plan)
+	if len(resume.Failed) > 0 {
+		return fmt.Errorf("Cannot resume %s, failed actions are not planned anymore: %s; check the containers and run without --resume",
+			previous, strings.Join(resume.Failed, "; "))
+	}
+
+	log.Infof("Resuming %s", previous)
+	for _, group := range []struct {
+		title   string
+		actions []string
+	}{
+		{"Already done", resume.Done},
+		{"Retrying interrupted", resume.Retry},
+		{"Redoing", resume.Redo},
+		{"Continuing", resume.Continue},
+		{"Not planned before", resume.New},
+		{"Not needed anymore", resume.Dropped},
+	} {
+		for _, action := range group.actions {
+			log.Infof("%s: %s", group.title, action)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString removes the first occurrence of s from the list
+func removeString(list []string, s string) []string {
+	for i, item := range list {
+		if item == s {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
@@ -0,0 +1,260 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestJournalInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := ReadJournal(dir, "app", "")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+	assert.False(t, state.Interrupted())
+
+	journal, err := CreateJournal(dir, "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := journal.Events()
+	events.Emit(&Event{Type: EventPlan, Plan: []string{"remove web", "create web", "create db"}})
+	events.Emit(&Event{Type: EventActionStarted, Action: "remove web"})
+	events.Emit(&Event{Type: EventActionFinished, Action: "remove web"})
+	events.Emit(&Event{Type: EventActionStarted, Action: "create web"})
+
+	// the process is killed while writing a record
+	file, err := JournalPath(dir, "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"type":"action_fin`)
+	f.Close()
+
+	state, err = ReadJournal(dir, "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, state.Interrupted())
+	assert.Contains(t, state.User, "@")
+	assert.Equal(t, []string{"remove web"}, state.Done)
+	assert.Equal(t, []string{"create web"}, state.Running)
+	assert.Equal(t, []string{"create db"}, state.Remaining())
+	assert.Contains(t, state.String(), "1 of 3 actions done")
+
+	// the next deploy replaces the journal
+	journal, err = CreateJournal(dir, "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Finish(errors.New("no space left"))
+
+	state, err = ReadJournal(dir, "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, state.Interrupted())
+	assert.Equal(t, "no space left", state.Error)
+	assert.Empty(t, state.Plan)
+}
+
+func TestJournalReconcile(t *testing.T) {
+	state := &JournalState{
+		Plan:    []string{"remove web", "create web", "remove db", "create db", "create cache"},
+		Done:    []string{"remove web", "remove db"},
+		Running: []string{"create web"},
+	}
+
+	resume := state.Reconcile([]string{"create web", "remove db", "create cache", "create worker"})
+	assert.Equal(t, []string{"remove web"}, resume.Done)
+	assert.Equal(t, []string{"create web"}, resume.Retry)
+	assert.Equal(t, []string{"remove db"}, resume.Redo)
+	assert.Equal(t, []string{"create cache"}, resume.Continue)
+	assert.Equal(t, []string{"create worker"}, resume.New)
+	assert.Equal(t, []string{"create db"}, resume.Dropped)
+}
+
+func TestJournalReconcileFailed(t *testing.T) {
+	state := &JournalState{
+		Plan:   []string{"create web", "create db", "create cache"},
+		Done:   []string{"create web"},
+		Failed: []string{"create db"},
+	}
+
+	resume := state.Reconcile([]string{})
+	assert.Equal(t, []string{"create web"}, resume.Done)
+	assert.Equal(t, []string{"create db"}, resume.Failed)
+	assert.Equal(t, []string{"create cache"}, resume.Dropped)
+}
+
+func TestRunActionResumeRefused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal, err := CreateJournal(dir, "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := journal.Events()
+	events.Emit(&Event{Type: EventPlan, Plan: []string{"Creating container 'app.db'"}})
+	events.Emit(&Event{Type: EventActionStarted, Action: "Creating container 'app.db'"})
+	events.Emit(&Event{Type: EventActionFinished, Action: "Creating container 'app.db'", Error: "failed"})
+
+	image := "myapp:1.2.3"
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+
+	compose := &Compose{
+		Manifest: &config.Config{Namespace: "app", Containers: map[string]*config.Container{"web": {Image: &image}}},
+		StateDir: dir,
+		Resume:   true,
+		client:   client,
+	}
+
+	err = compose.RunAction()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed actions are not planned anymore: Creating container 'app.db'")
+	}
+	client.AssertNotCalled(t, "RunContainer", mock.Anything)
+
+	// the journal of the interrupted deploy is kept
+	state, err := ReadJournal(dir, "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, state.Interrupted())
+	assert.Equal(t, []string{"Creating container 'app.db'"}, state.Failed)
+}
+
+func TestRunActionJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := "myapp:1.2.3"
+	manifest := &config.Config{
+		Namespace: "app",
+		Containers: map[string]*config.Container{
+			"web": {Image: &image},
+		},
+	}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("ResolveImages", mock.Anything, false, mock.Anything).Return(nil)
+	client.On("RunContainer", mock.Anything).Return(nil)
+	client.On("WaitForContainer", mock.Anything).Return(nil)
+
+	compose := &Compose{
+		Manifest: manifest,
+		StateDir: dir,
+		DryRun:   true,
+		client:   client,
+	}
+
+	// dry runs do not replace the journal
+	assert.NoError(t, compose.RunAction())
+	state, err := ReadJournal(dir, "app", "")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+
+	compose.DryRun = false
+	assert.NoError(t, compose.RunAction())
+
+	state, err = ReadJournal(dir, "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, state.Interrupted())
+	assert.Empty(t, state.Error)
+	assert.Equal(t, []string{"Creating container 'app.web'"}, state.Plan)
+	assert.Equal(t, state.Plan, state.Done)
+}
+
+func TestRunActionJournalHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := "myapp:1.2.3"
+	manifest := &config.Config{
+		Namespace: "app",
+		Containers: map[string]*config.Container{
+			"web": {Image: &image},
+		},
+	}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("RunContainer", mock.Anything).Return(nil)
+	client.On("WaitForContainer", mock.Anything).Return(nil)
+
+	compose := &Compose{
+		Manifest: manifest,
+		StateDir: dir,
+		Host:     "web1",
+		client:   client,
+	}
+	assert.NoError(t, compose.RunAction())
+
+	// hosts of an inventory do not share the journal
+	file, err := JournalPath(dir, "app", "web1")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "app@web1.journal"), file)
+
+	state, err := ReadJournal(dir, "app", "")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+
+	state, err = ReadJournal(dir, "app", "web1")
+	if assert.NoError(t, err) && assert.NotNil(t, state) {
+		assert.Equal(t, []string{"Creating container 'app.web'"}, state.Done)
+	}
+}
@@ -0,0 +1,206 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/grammarly/rocker/src/rocker/template"
+)
+
+// LockFileName is the name of the lock file that pin writes next to the manifest
+const LockFileName = "compose.lock"
+
+// LockPinTag is LockEntry.Pin of entries whose runs use the tag, even though the digest is recorded
+const LockPinTag = "tag"
+
+// Lock records versions of images resolved by pin, so that run and pull use
+// exactly the same versions until the lock is updated
+type Lock struct {
+	ManifestHash string                `yaml:"manifest_hash"`
+	ResolvedAt   time.Time             `yaml:"resolved_at"`
+	Containers   map[string]*LockEntry `yaml:"containers"`
+}
+
+// LockEntry is the resolved image of a single container
+type LockEntry struct {
+	Image  string `yaml:"image"`            // image as it is given in the manifest, e.g. "myapp:1.*"
+	Tag    string `yaml:"tag,omitempty"`    // resolved tag, e.g. "1.2.3"
+	Digest string `yaml:"digest,omitempty"` // content digest of the resolved image
+	Pin    string `yaml:"pin,omitempty"`    // "tag" unless pinned with --digest, then runs use the digest
+}
+
+// LockPath returns the path of the lock file of the given manifest
+func LockPath(manifestFile string) string {
+	return filepath.Join(filepath.Dir(manifestFile), LockFileName)
+}
+
+// HashManifest returns sha256 of the manifest file contents
+func HashManifest(manifestFile string) (string, error) {
+	data, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read manifest %s, error: %s", manifestFile, err)
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// ReadLock reads the lock file, nil is returned if the file does not exist
+func ReadLock(filename string) (*Lock, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read lock file %s, error: %s", filename, err)
+	}
+
+	lock := &Lock{}
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("Failed to parse lock file %s, error: %s", filename, err)
+	}
+	if lock.Containers == nil {
+		lock.Containers = map[string]*LockEntry{}
+	}
+
+	return lock, nil
+}
+
+// WriteFile writes the lock to the file
+func (lock *Lock) WriteFile(filename string) error {
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal lock, error: %s", err)
+	}
+
+	header := "# This file is generated by `rocker-compose pin`, do not edit it manually\n"
+	if err := ioutil.WriteFile(filename, append([]byte(header), data...), 0644); err != nil {
+		return fmt.Errorf("Failed to write lock file %s, error: %s", filename, err)
+	}
+
+	return nil
+}
+
+// Version returns the locked version of the image, the digest takes precedence over the tag
+// unless the entry is pinned by tag
+func (e *LockEntry) Version() string {
+	if e.Digest != "" && (e.Pin != LockPinTag || e.Tag == "") {
+		return e.Digest
+	}
+	return e.Tag
+}
+
+// Matches returns true if the locked version satisfies the image given in the manifest,
+// i.e. it is the same image and the tag is within the version range
+func (e *LockEntry) Matches(image string) bool {
+	if e.Image == image {
+		return true
+	}
+	spec := imagename.NewFromString(image)
+	if e.Tag == "" || spec.TagIsSha() || !spec.IsSameKind(*imagename.NewFromString(e.Image)) {
+		return false
+	}
+	return spec.Contains(imagename.New(spec.NameWithRegistry(), e.Tag))
+}
+
+// Vars returns version variables (v_container_<name>) of the locked containers of the
+// manifest, which are then used by image resolution in the same way as pinned variables.
+// Containers given in skip, the ones missing in the lock and the ones whose
+// manifest image does not match the locked version any longer are not included.
+func (lock *Lock) Vars(manifest *config.Config, skip ...string) template.Vars {
+	vars := template.Vars{}
+
+	skipped := map[string]struct{}{}
+	for _, name := range skip {
+		skipped[name] = struct{}{}
+	}
+
+	names := []string{}
+	for name := range manifest.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		container := manifest.Containers[name]
+		if _, ok := skipped[name]; ok || container.Image == nil {
+			continue
+		}
+
+		entry, ok := lock.Containers[name]
+		if !ok {
+			log.Warnf("Container %s is not in the lock file, run `rocker-compose pin` to add it", name)
+			continue
+		}
+		if !entry.Matches(*container.Image) {
+			log.Warnf("Locked version %s of container %s does not match image %s of the manifest, run `rocker-compose pin --update %s` to update it",
+				entry.Version(), name, *container.Image, name)
+			continue
+		}
+
+		vars[fmt.Sprintf("v_container_%s", name)] = entry.Version()
+	}
+
+	return vars
+}
+
+// Apply adds version variables of the lock to the manifest variables, so the locked
+// versions are used by run and pull. Variables given explicitly (--var, --vars) win,
+// either v_container_<name> or v_image_<repo> of the container image.
+func (lock *Lock) Apply(manifest *config.Config, skip ...string) {
+	if manifest.Vars == nil {
+		manifest.Vars = template.Vars{}
+	}
+	skip = append([]string{}, skip...)
+	for name := range lock.Containers {
+		container, ok := manifest.Containers[name]
+		if !ok || container.Image == nil {
+			continue
+		}
+		if _, ok := manifest.Vars[fmt.Sprintf("v_image_%s", imagename.NewFromString(*container.Image).NameWithRegistry())]; ok {
+			skip = append(skip, name)
+		}
+	}
+	for k, v := range lock.Vars(manifest, skip...) {
+		if _, ok := manifest.Vars[k]; !ok {
+			manifest.Vars[k] = v
+		}
+	}
+}
+
+// inherit copies tags from entries of the previous lock with the same digests;
+// containers that are kept locked by pin --update are resolved straight to digests
+func (lock *Lock) inherit(prev *Lock) {
+	if prev == nil {
+		return
+	}
+	for name, entry := range lock.Containers {
+		if p, ok := prev.Containers[name]; ok && entry.Tag == "" && entry.Digest != "" && p.Digest == entry.Digest {
+			entry.Tag = p.Tag
+		}
+	}
+}
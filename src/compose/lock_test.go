@@ -0,0 +1,193 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newLockManifest(images map[string]string) *config.Config {
+	manifest := &config.Config{
+		Namespace:  "test",
+		Containers: map[string]*config.Container{},
+		Vars:       template.Vars{},
+	}
+	for name, image := range images {
+		image := image
+		manifest.Containers[name] = &config.Container{Image: &image}
+	}
+	return manifest
+}
+
+func TestLockReadWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := LockPath(filepath.Join(dir, "compose.yml"))
+	assert.Equal(t, filepath.Join(dir, "compose.lock"), filename)
+
+	lock, err := ReadLock(filename)
+	assert.Nil(t, err)
+	assert.Nil(t, lock, "missing lock file should give no lock")
+
+	resolvedAt := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	lock = &Lock{
+		ManifestHash: "sha256:abc",
+		ResolvedAt:   resolvedAt,
+		Containers: map[string]*LockEntry{
+			"app":   {Image: "myapp:1.*", Tag: "1.2.0"},
+			"redis": {Image: "redis:3.0", Tag: "3.0", Digest: "sha256:def"},
+		},
+	}
+	if err := lock.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadLock(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha256:abc", read.ManifestHash)
+	assert.True(t, resolvedAt.Equal(read.ResolvedAt), "resolved_at should survive the round trip, got %s", read.ResolvedAt)
+	assert.Equal(t, lock.Containers, read.Containers)
+}
+
+func TestLockEntryMatches(t *testing.T) {
+	entry := &LockEntry{Image: "myapp:1.*", Tag: "1.2.0"}
+
+	assert.True(t, entry.Matches("myapp:1.*"))
+	assert.True(t, entry.Matches("myapp:1.2.*"), "narrowed range still contains the locked version")
+	assert.True(t, entry.Matches("myapp:~1.2"))
+	assert.False(t, entry.Matches("myapp:~1.1"))
+	assert.False(t, entry.Matches("myapp:2.*"))
+	assert.False(t, entry.Matches("otherapp:1.*"))
+	assert.False(t, entry.Matches("myapp@sha256:abc"))
+
+	assert.Equal(t, "1.2.0", entry.Version())
+	entry.Digest = "sha256:abc"
+	assert.Equal(t, "sha256:abc", entry.Version())
+
+	// the digest is recorded, but runs use the tag
+	entry.Pin = LockPinTag
+	assert.Equal(t, "1.2.0", entry.Version())
+	entry.Tag = ""
+	assert.Equal(t, "sha256:abc", entry.Version())
+}
+
+func TestLockApply(t *testing.T) {
+	lock := &Lock{
+		Containers: map[string]*LockEntry{
+			"app":    {Image: "myapp:1.*", Tag: "1.2.0"},
+			"worker": {Image: "myapp:1.*", Tag: "1.2.0"},
+			"redis":  {Image: "redis:3.0.*", Tag: "3.0.5", Digest: "sha256:def"},
+			"db":     {Image: "postgres:9.4.*", Tag: "9.4.5"},
+		},
+	}
+
+	manifest := newLockManifest(map[string]string{
+		"app":    "myapp:1.*",
+		"worker": "myapp:1.*",
+		"redis":  "redis:3.0.*",
+		"db":     "postgres:9.5.*", // range changed, lock is outdated
+		"nginx":  "nginx:1.9",      // not locked
+	})
+	manifest.Vars["v_container_worker"] = "1.3.0"
+
+	lock.Apply(manifest, "app")
+
+	assert.Equal(t, template.Vars{
+		"v_container_worker": "1.3.0",
+		"v_container_redis":  "sha256:def",
+	}, manifest.Vars)
+}
+
+func TestLockApplyImageVar(t *testing.T) {
+	lock := &Lock{
+		Containers: map[string]*LockEntry{
+			"app":   {Image: "myapp:1.*", Tag: "1.2.0"},
+			"redis": {Image: "redis:3.0.*", Tag: "3.0.5"},
+		},
+	}
+
+	manifest := newLockManifest(map[string]string{
+		"app":   "myapp:1.*",
+		"redis": "redis:3.0.*",
+	})
+	manifest.Vars["v_image_myapp"] = "1.3.0"
+
+	lock.Apply(manifest)
+
+	assert.Equal(t, template.Vars{
+		"v_image_myapp":     "1.3.0",
+		"v_container_redis": "3.0.5",
+	}, manifest.Vars)
+}
+
+func TestLockInherit(t *testing.T) {
+	prev := &Lock{Containers: map[string]*LockEntry{
+		"redis": {Image: "redis:3.0.*", Tag: "3.0.5", Digest: "sha256:def"},
+	}}
+	lock := &Lock{Containers: map[string]*LockEntry{
+		"redis": {Image: "redis:3.0.*", Digest: "sha256:def"},
+		"app":   {Image: "myapp:1.*", Tag: "1.3.0"},
+	}}
+
+	lock.inherit(prev)
+	assert.Equal(t, "3.0.5", lock.Containers["redis"].Tag)
+	assert.Equal(t, "1.3.0", lock.Containers["app"].Tag)
+}
+
+func TestPinActionLocalDigests(t *testing.T) {
+	manifest := newLockManifest(map[string]string{
+		"app":   "myapp:1.2.0",
+		"redis": "redis:3.0.5",
+	})
+
+	client := &clientMock{}
+	client.On("Pin", true, false, mock.Anything, mock.Anything).Return(nil)
+	// only redis is pulled, myapp is built locally and has no digest
+	client.On("PinDigests", mock.Anything, true).Return(nil).Run(func(args mock.Arguments) {
+		for _, c := range args.Get(0).([]*Container) {
+			if c.Name.Name == "redis" {
+				c.Image.SetTag("sha256:def")
+			}
+		}
+	})
+
+	compose := &Compose{Manifest: manifest, client: client}
+
+	vars, lock, err := compose.PinAction(true, false, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &LockEntry{Image: "myapp:1.2.0", Tag: "1.2.0", Pin: LockPinTag}, lock.Containers["app"])
+	assert.Equal(t, &LockEntry{Image: "redis:3.0.5", Tag: "3.0.5", Digest: "sha256:def", Pin: LockPinTag}, lock.Containers["redis"])
+	assert.Equal(t, "1.2.0", vars["v_container_app"])
+	assert.Equal(t, "3.0.5", vars["v_container_redis"])
+}
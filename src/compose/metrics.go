@@ -0,0 +1,207 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsPrefix = "rocker_compose_"
+
+// metricDescs are metrics exposed by Metrics, in the order they are written
+var metricDescs = []struct {
+	name, typ, help string
+}{
+	{"actions_total", "counter", "Number of executed actions by type and result."},
+	{"action_duration_seconds", "summary", "Time spent executing actions by type."},
+	{"failures_total", "counter", "Number of failed deploys by reason."},
+	{"image_pull_bytes_total", "counter", "Bytes of image layers downloaded by pulls."},
+	{"image_pull_duration_seconds", "summary", "Time spent pulling images."},
+	{"drift_detected_total", "counter", "Number of containers found not in the desired state without the manifest being changed."},
+	{"last_successful_reconcile_timestamp_seconds", "gauge", "Unix time of the last successful run of the manifest."},
+}
+
+// Metrics collects metrics of deploys in the Prometheus text format, to be served over HTTP
+// or written to a node_exporter textfile. A nil Metrics discards observations.
+type Metrics struct {
+	Namespace string // added as a label to all metrics
+
+	mu     sync.Mutex
+	values map[string]float64 // series, e.g. `actions_total{namespace="app",type="run"}`, to values
+}
+
+// NewMetrics makes metrics of the namespace
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		Namespace: namespace,
+		values:    map[string]float64{},
+	}
+}
+
+// ObserveAction counts the executed action of the kind, e.g. "run", "remove", "wait" or "pull"
+func (m *Metrics) ObserveAction(kind string, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.add("actions_total", 1, "type", kind, "result", result)
+	m.observe("action_duration_seconds", duration.Seconds(), "type", kind)
+}
+
+// ObserveFailure counts the failed deploy, the reason is the stage it failed at
+func (m *Metrics) ObserveFailure(reason string) {
+	m.add("failures_total", 1, "reason", reason)
+}
+
+// ObservePull counts bytes and time of the image pull
+func (m *Metrics) ObservePull(bytes int64, duration time.Duration) {
+	m.add("image_pull_bytes_total", float64(bytes))
+	m.observe("image_pull_duration_seconds", duration.Seconds())
+}
+
+// ObserveDrift counts containers found not in the desired state
+func (m *Metrics) ObserveDrift(containers int) {
+	m.add("drift_detected_total", float64(containers))
+}
+
+// SetLastReconcile remembers the time of the last successful run
+func (m *Metrics) SetLastReconcile(t time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[m.series("last_successful_reconcile_timestamp_seconds")] = float64(t.Unix())
+}
+
+// WriteTo writes metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	series := make([]string, 0, len(m.values))
+	for s := range m.values {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+
+	buf := &bytes.Buffer{}
+	for _, desc := range metricDescs {
+		suffixes := []string{""}
+		if desc.typ == "summary" {
+			suffixes = []string{"_sum", "_count"}
+		}
+		fmt.Fprintf(buf, "# HELP %s%s %s\n", metricsPrefix, desc.name, desc.help)
+		fmt.Fprintf(buf, "# TYPE %s%s %s\n", metricsPrefix, desc.name, desc.typ)
+		for _, suffix := range suffixes {
+			for _, s := range series {
+				if strings.HasPrefix(s, desc.name+suffix+"{") {
+					fmt.Fprintf(buf, "%s%s %s\n", metricsPrefix, s, strconv.FormatFloat(m.values[s], 'f', -1, 64))
+				}
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves metrics to Prometheus
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTextfile writes metrics to the file atomically, so that the node_exporter
+// textfile collector never reads a partially written file
+func (m *Metrics) WriteTextfile(file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to write metrics to %s, error: %s", file, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := m.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write metrics to %s, error: %s", file, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to write metrics to %s, error: %s", file, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("Failed to write metrics to %s, error: %s", file, err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("Failed to write metrics to %s, error: %s", file, err)
+	}
+	return nil
+}
+
+func (m *Metrics) add(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[m.series(name, labels...)] += value
+}
+
+// observe adds the value to the sum and count of the summary
+func (m *Metrics) observe(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[m.series(name+"_sum", labels...)] += value
+	m.values[m.series(name+"_count", labels...)]++
+}
+
+// series renders the name with the namespace label and given label pairs
+func (m *Metrics) series(name string, labels ...string) string {
+	pairs := []string{fmt.Sprintf("namespace=%q", m.Namespace)}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// actionKind returns the type of the action for metrics
+func actionKind(a Action) string {
+	switch a.(type) {
+	case *runContainer:
+		return "run"
+	case *removeContainer:
+		return "remove"
+	case *waitContainerAction:
+		return "wait"
+	case *ensureContainerExist:
+		return "ensure_exist"
+	case *ensureContainerState:
+		return "ensure_state"
+	}
+	return "other"
+}
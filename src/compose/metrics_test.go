@@ -0,0 +1,127 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bytes"
+	"compose/config"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	var nilMetrics *Metrics
+	nilMetrics.ObserveAction("run", time.Second, nil)
+	nilMetrics.SetLastReconcile(time.Now())
+
+	metrics := NewMetrics("app")
+	metrics.ObserveAction("run", 1500*time.Millisecond, nil)
+	metrics.ObserveAction("run", 500*time.Millisecond, errors.New("failed"))
+	metrics.ObservePull(1024, 3*time.Second)
+	metrics.ObserveFailure("pull")
+	metrics.ObserveDrift(2)
+	metrics.SetLastReconcile(time.Unix(1450000000, 0))
+
+	buf := &bytes.Buffer{}
+	if _, err := metrics.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	assert.Contains(t, out, "# TYPE rocker_compose_actions_total counter\n")
+	assert.Contains(t, out, `rocker_compose_actions_total{namespace="app",type="run",result="success"} 1`+"\n")
+	assert.Contains(t, out, `rocker_compose_actions_total{namespace="app",type="run",result="error"} 1`+"\n")
+	assert.Contains(t, out, `rocker_compose_action_duration_seconds_sum{namespace="app",type="run"} 2`+"\n")
+	assert.Contains(t, out, `rocker_compose_action_duration_seconds_count{namespace="app",type="run"} 2`+"\n")
+	assert.Contains(t, out, `rocker_compose_failures_total{namespace="app",reason="pull"} 1`+"\n")
+	assert.Contains(t, out, `rocker_compose_image_pull_bytes_total{namespace="app"} 1024`+"\n")
+	assert.Contains(t, out, `rocker_compose_image_pull_duration_seconds_sum{namespace="app"} 3`+"\n")
+	assert.Contains(t, out, `rocker_compose_drift_detected_total{namespace="app"} 2`+"\n")
+	assert.Contains(t, out, `rocker_compose_last_successful_reconcile_timestamp_seconds{namespace="app"} 1450000000`+"\n")
+}
+
+func TestMetricsWriteTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	metrics := NewMetrics("app")
+	metrics.ObserveFailure("lock")
+
+	file := filepath.Join(dir, "rocker_compose.prom")
+	if err := metrics.WriteTextfile(file); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), `rocker_compose_failures_total{namespace="app",reason="lock"} 1`)
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, files, 1)
+}
+
+func TestRunActionMetrics(t *testing.T) {
+	image := "myapp:1.2.3"
+	manifest := &config.Config{
+		Namespace: "app",
+		Containers: map[string]*config.Container{
+			"web": {Image: &image},
+		},
+	}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("RunContainer", mock.Anything).Return(errors.New("no space left"))
+
+	metrics := NewMetrics("app")
+	compose := &Compose{
+		Manifest: manifest,
+		Metrics:  metrics,
+		client:   client,
+	}
+
+	assert.Error(t, compose.RunAction())
+
+	buf := &bytes.Buffer{}
+	if _, err := metrics.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	assert.Contains(t, out, `rocker_compose_actions_total{namespace="app",type="run",result="error"} 1`+"\n")
+	assert.Contains(t, out, `rocker_compose_failures_total{namespace="app",reason="execute"} 1`+"\n")
+	assert.NotContains(t, out, "rocker_compose_last_successful_reconcile_timestamp_seconds{")
+}
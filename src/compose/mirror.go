@@ -0,0 +1,179 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+)
+
+// Mirrors rewrites image names to pull them from mirror registries, e.g. with the rule
+// "docker.io=mirror.local", "redis:3.0" is pulled as "mirror.local/library/redis:3.0".
+// Prefixes are matched against canonical image names, where Docker Hub images are
+// "docker.io/[library/]name", the longest matching prefix wins.
+type Mirrors []*mirrorRule
+
+type mirrorRule struct {
+	from string
+	to   string
+}
+
+// NewMirrors makes mirror rules from "prefix=mirror" pairs
+func NewMirrors(rules []string) (Mirrors, error) {
+	m := map[string]string{}
+	for _, rule := range rules {
+		split := strings.SplitN(rule, "=", 2)
+		if len(split) != 2 || split[0] == "" || split[1] == "" {
+			return nil, fmt.Errorf("Invalid mirror rule %q, should be prefix=mirror, e.g. docker.io=mirror.local", rule)
+		}
+		m[split[0]] = split[1]
+	}
+	return newMirrorsFromMap(m), nil
+}
+
+// ReadMirrorsFile reads mirror rules from the YAML file, which is a map of prefixes to mirrors:
+//
+//	docker.io: mirror.local
+//	quay.io: mirror.local/quay
+func ReadMirrorsFile(filename string) (Mirrors, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read mirrors file %s, error: %s", filename, err)
+	}
+	m := map[string]string{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Failed to parse mirrors file %s, error: %s", filename, err)
+	}
+	return newMirrorsFromMap(m), nil
+}
+
+func newMirrorsFromMap(m map[string]string) Mirrors {
+	mirrors := Mirrors{}
+	for from, to := range m {
+		mirrors = append(mirrors, &mirrorRule{
+			from: canonicalPrefix(from),
+			to:   strings.TrimSuffix(to, "/"),
+		})
+	}
+	// longest prefixes first
+	sort.Sort(mirrorsByPrefix(mirrors))
+	return mirrors
+}
+
+// Merge returns rules of both, the given ones take precedence
+func (m Mirrors) Merge(other Mirrors) Mirrors {
+	merged := map[string]string{}
+	for _, rule := range m {
+		merged[rule.from] = rule.to
+	}
+	for _, rule := range other {
+		merged[rule.from] = rule.to
+	}
+	return newMirrorsFromMap(merged)
+}
+
+// Rewrite returns the image name to pull the image from, or the image itself if no rule
+// matches. Images referred by digest keep the digest, since mirrors serve the same manifests.
+func (m Mirrors) Rewrite(image *imagename.ImageName) *imagename.ImageName {
+	if len(m) == 0 {
+		return image
+	}
+
+	name := canonicalImageName(image)
+	for _, rule := range m {
+		if name == rule.from || strings.HasPrefix(name, rule.from+"/") {
+			rewritten := imagename.New(rule.to+strings.TrimPrefix(name, rule.from), "")
+			rewritten.Tag, rewritten.Version = image.Tag, image.Version
+			return rewritten
+		}
+	}
+
+	return image
+}
+
+// canonicalImageName returns the full name of the image without tag,
+// e.g. "docker.io/library/redis" for "redis"
+func canonicalImageName(image *imagename.ImageName) string {
+	registry := normalizeRegistry(image.Registry)
+	name := image.Name
+	if registry == "docker.io" && image.Name != "" && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" {
+		return registry
+	}
+	return registry + "/" + name
+}
+
+// canonicalPrefix normalizes the registry of the rule prefix, e.g. "index.docker.io/library"
+// becomes "docker.io/library"
+func canonicalPrefix(prefix string) string {
+	split := strings.SplitN(strings.Trim(prefix, "/"), "/", 2)
+	split[0] = normalizeRegistry(split[0])
+	return strings.Join(split, "/")
+}
+
+// tagMirroredImage tags the image pulled from the mirror with its original name,
+// so containers refer to the original name. Docker cannot tag images by digest,
+// those are known by the mirror name only, see inspectImage.
+func tagMirroredImage(client *docker.Client, source, image *imagename.ImageName) error {
+	if source == image || image.TagIsSha() {
+		return nil
+	}
+	log.Debugf("Tag %s as %s", source, image)
+	err := client.TagImage(source.String(), docker.TagImageOptions{
+		Repo:  image.NameWithRegistry(),
+		Tag:   image.GetTag(),
+		Force: true,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to tag image %s pulled from the mirror as %s, error: %s", source, image, err)
+	}
+	return nil
+}
+
+// inspectImage inspects the image by its name, or by the mirror name if the image
+// is pinned by digest and could be pulled from the mirror
+func (client *DockerClient) inspectImage(image *imagename.ImageName) (*docker.Image, error) {
+	img, err := client.Docker.InspectImage(image.String())
+	if err != docker.ErrNoSuchImage || !image.TagIsSha() {
+		return img, err
+	}
+	if source := client.Mirrors.Rewrite(image); source != image {
+		return client.Docker.InspectImage(source.String())
+	}
+	return img, err
+}
+
+// runsByImageID tells whether the container should be created by the image ID instead of
+// the image name, which is the case of images pinned by digest and pulled from the mirror
+func (client *DockerClient) runsByImageID(container *Container) bool {
+	return container.ImageID != "" && container.Image.TagIsSha() && client.Mirrors.Rewrite(container.Image) != container.Image
+}
+
+type mirrorsByPrefix Mirrors
+
+func (a mirrorsByPrefix) Len() int           { return len(a) }
+func (a mirrorsByPrefix) Less(i, j int) bool { return len(a[i].from) > len(a[j].from) }
+func (a mirrorsByPrefix) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,111 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMirrors(t *testing.T) {
+	mirrors, err := NewMirrors([]string{"docker.io=mirror.local", "index.docker.io/grammarly=mirror.local/gr/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, mirrors, 2)
+	assert.Equal(t, "docker.io/grammarly", mirrors[0].from)
+	assert.Equal(t, "mirror.local/gr", mirrors[0].to)
+
+	_, err = NewMirrors([]string{"docker.io"})
+	assert.Error(t, err)
+}
+
+func TestMirrorsRewrite(t *testing.T) {
+	mirrors, err := NewMirrors([]string{
+		"docker.io=mirror.local",
+		"docker.io/grammarly=mirror.local/gr",
+		"quay.io=mirror.local/quay",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := "sha256:ea9c2e3a4d7d4d3ec76c6b1df6e1c8de5df8d1fc0e4e0a0e37a1a0bdd2db8c0f"
+	tests := map[string]string{
+		"redis:3.0":                      "mirror.local/library/redis:3.0",
+		"grammarly/rocker:1.0":           "mirror.local/gr/rocker:1.0",
+		"grammarlyx/rocker:1.0":          "mirror.local/grammarlyx/rocker:1.0",
+		"quay.io/coreos/etcd:v2.2.0":     "mirror.local/quay/coreos/etcd:v2.2.0",
+		"dockerhub.grammarly.io/app:1.2": "dockerhub.grammarly.io/app:1.2",
+		"redis@" + digest:                "mirror.local/library/redis@" + digest,
+	}
+	for name, expected := range tests {
+		assert.Equal(t, expected, mirrors.Rewrite(imagename.NewFromString(name)).String(), "rewrite of %s", name)
+	}
+
+	// no rules, no rewrite
+	image := imagename.NewFromString("redis:3.0")
+	assert.True(t, Mirrors{}.Rewrite(image) == image)
+}
+
+func TestMirrorsRunsByImageID(t *testing.T) {
+	mirrors, _ := NewMirrors([]string{"docker.io=mirror.local"})
+	client := &DockerClient{Mirrors: mirrors}
+
+	digest := "sha256:ea9c2e3a4d7d4d3ec76c6b1df6e1c8de5df8d1fc0e4e0a0e37a1a0bdd2db8c0f"
+	container := func(image string) *Container {
+		return &Container{Image: imagename.NewFromString(image), ImageID: "sha256:123"}
+	}
+
+	assert.True(t, client.runsByImageID(container("redis@"+digest)))
+	assert.False(t, client.runsByImageID(container("redis:3.0")), "tagged images are tagged back with the original name")
+	assert.False(t, client.runsByImageID(container("quay.io/coreos/etcd@"+digest)), "no mirror for the image")
+	assert.False(t, (&DockerClient{}).runsByImageID(container("redis@"+digest)))
+}
+
+func TestMirrorsMerge(t *testing.T) {
+	a, _ := NewMirrors([]string{"docker.io=a.local", "quay.io=a.local/quay"})
+	b, _ := NewMirrors([]string{"docker.io=b.local"})
+
+	merged := a.Merge(b)
+	assert.Equal(t, "b.local/library/redis:3.0", merged.Rewrite(imagename.NewFromString("redis:3.0")).String())
+	assert.Equal(t, "a.local/quay/etcd:2", merged.Rewrite(imagename.NewFromString("quay.io/etcd:2")).String())
+}
+
+func TestReadMirrorsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "rocker-compose-mirrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("docker.io: mirror.local\nquay.io: mirror.local/quay\n")
+	f.Close()
+
+	mirrors, err := ReadMirrorsFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "mirror.local/library/redis:3.0", mirrors.Rewrite(imagename.NewFromString("redis:3.0")).String())
+
+	_, err = ReadMirrorsFile(f.Name() + ".missing")
+	assert.Error(t, err)
+}
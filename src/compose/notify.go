@@ -0,0 +1,227 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bytes"
+	"compose/ansible"
+	"compose/config"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-yaml/yaml"
+)
+
+var (
+	// notifyRetries is the number of retries of failed deliveries
+	notifyRetries = 3
+
+	// notifyBackoff is the delay before the first retry, it doubles every time
+	notifyBackoff = time.Second
+
+	// notifyTimeout limits every delivery attempt
+	notifyTimeout = 10 * time.Second
+)
+
+// Notification is the outcome of a run sent to webhooks and commands, it has the
+// fields of the ansible response plus the context of the run
+type Notification struct {
+	ansible.Response
+
+	Namespace string    `json:"namespace"`
+	Time      time.Time `json:"time"`
+	Duration  float64   `json:"duration"` // seconds
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	Command   string    `json:"command,omitempty"`
+	Revision  int       `json:"revision,omitempty"` // number of the recorded revision, if any
+}
+
+// Notifier delivers notifications to webhooks and commands. Failed deliveries are
+// retried and logged, but never fail the run.
+type Notifier struct {
+	On       string
+	Webhooks []string
+	Commands []string
+}
+
+// NewNotifier makes a notifier delivering to all of the given targets, On of the
+// first config having it is taken
+func NewNotifier(configs ...*config.Notify) *Notifier {
+	n := &Notifier{}
+	for _, c := range configs {
+		if c == nil {
+			continue
+		}
+		if n.On == "" {
+			n.On = c.On
+		}
+		n.Webhooks = append(n.Webhooks, c.Webhooks...)
+		n.Commands = append(n.Commands, c.Commands...)
+	}
+	return n
+}
+
+// ReadNotifyFile reads the global notify config, it has the format of the notify
+// section of the manifest
+func ReadNotifyFile(file string) (*config.Notify, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read notify file %s, error: %s", file, err)
+	}
+	n := &config.Notify{}
+	if err := yaml.Unmarshal(data, n); err != nil {
+		return nil, fmt.Errorf("Failed to parse notify file %s, error: %s", file, err)
+	}
+	if err := n.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid notify file %s, error: %s", file, err)
+	}
+	return n, nil
+}
+
+// ShouldNotify tells whether the outcome is notified according to On
+func (n *Notifier) ShouldNotify(notification *Notification) bool {
+	switch n.On {
+	case config.NotifyAlways:
+		return true
+	case config.NotifyFailure:
+		return notification.Failed
+	}
+	return notification.Failed || notification.Changed
+}
+
+// Notify delivers the notification to all targets
+func (n *Notifier) Notify(notification *Notification) {
+	if n == nil || !n.hasTargets() || !n.ShouldNotify(notification) {
+		return
+	}
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		log.Errorf("Failed to encode the notification, error: %s", err)
+		return
+	}
+
+	for _, url := range n.Webhooks {
+		if err := retryNotify(func() error { return postWebhook(url, payload) }); err != nil {
+			log.Errorf("Failed to notify %s, error: %s", url, err)
+		}
+	}
+	for _, command := range n.Commands {
+		if err := retryNotify(func() error { return runNotifyCommand(command, payload) }); err != nil {
+			log.Errorf("Failed to notify with command `%s`, error: %s", command, err)
+		}
+	}
+}
+
+func (n *Notifier) hasTargets() bool {
+	return len(n.Webhooks)+len(n.Commands) > 0
+}
+
+// retryNotify calls the delivery until it succeeds or retries are exhausted
+func retryNotify(deliver func() error) (err error) {
+	backoff := notifyBackoff
+	for attempt := 0; ; attempt++ {
+		if err = deliver(); err == nil || attempt >= notifyRetries {
+			return err
+		}
+		log.Warnf("Notification failed, retrying in %s, error: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(url string, payload []byte) error {
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func runNotifyCommand(command string, payload []byte) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(payload)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s, output: %s", err, bytes.TrimSpace(output.Bytes()))
+		}
+		return nil
+	case <-time.After(notifyTimeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("Command timed out after %s", notifyTimeout)
+	}
+}
+
+// notify sends the outcome of the run to the notifier of the compose merged
+// with the notify section of the manifest
+func (compose *Compose) notify(err error, duration time.Duration) {
+	notifier := NewNotifier(compose.Manifest.Notify)
+	if compose.Notifier != nil {
+		notifier = NewNotifier(compose.Manifest.Notify, &config.Notify{
+			On:       compose.Notifier.On,
+			Webhooks: compose.Notifier.Webhooks,
+			Commands: compose.Notifier.Commands,
+		})
+	}
+	if !notifier.hasTargets() {
+		return
+	}
+
+	notification := &Notification{
+		Namespace: compose.Manifest.Namespace,
+		Time:      time.Now(),
+		Duration:  duration.Seconds(),
+	}
+	compose.WritePlan(&notification.Response)
+	if err != nil {
+		notification.Error(err)
+	}
+	notification.User, notification.Host = currentUserHost()
+	if compose.Revision != nil {
+		notification.Command = compose.Revision.Command
+	}
+	if compose.recorded != nil {
+		notification.Revision = compose.recorded.Number
+	}
+
+	notifier.Notify(notification)
+}
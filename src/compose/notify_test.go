@@ -0,0 +1,195 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// webhookStub records notifications, failing the first given number of requests
+type webhookStub struct {
+	mu            sync.Mutex
+	fail          int
+	requests      int
+	notifications []*Notification
+}
+
+func (s *webhookStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if s.requests <= s.fail {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	n := &Notification{}
+	if err := json.NewDecoder(r.Body).Decode(n); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.notifications = append(s.notifications, n)
+}
+
+func withFastNotifyRetries() func() {
+	backoff := notifyBackoff
+	notifyBackoff = time.Millisecond
+	return func() { notifyBackoff = backoff }
+}
+
+func TestNotifierWebhookRetry(t *testing.T) {
+	defer withFastNotifyRetries()()
+
+	stub := &webhookStub{fail: 2}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	n := NewNotifier(&config.Notify{Webhooks: config.Strings{server.URL}})
+	notification := &Notification{Namespace: "app"}
+	notification.Changed = true
+	n.Notify(notification)
+
+	assert.Equal(t, 3, stub.requests)
+	assert.Len(t, stub.notifications, 1)
+	assert.Equal(t, "app", stub.notifications[0].Namespace)
+	assert.True(t, stub.notifications[0].Changed)
+}
+
+func TestNotifierCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "notification.json")
+	n := NewNotifier(&config.Notify{On: config.NotifyAlways, Commands: config.Strings{"cat > " + out}})
+	n.Notify(&Notification{Namespace: "app", User: "alice"})
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := &Notification{}
+	if err := json.Unmarshal(data, notification); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "alice", notification.User)
+}
+
+func TestNotifierShouldNotify(t *testing.T) {
+	unchanged, changed, failed := &Notification{}, &Notification{}, &Notification{}
+	changed.Changed = true
+	failed.Failed = true
+
+	tests := []struct {
+		on                         string
+		unchanged, changed, failed bool
+	}{
+		{"", false, true, true},
+		{config.NotifyChange, false, true, true},
+		{config.NotifyAlways, true, true, true},
+		{config.NotifyFailure, false, false, true},
+	}
+	for _, test := range tests {
+		n := &Notifier{On: test.on}
+		assert.Equal(t, test.unchanged, n.ShouldNotify(unchanged), "on %q, unchanged", test.on)
+		assert.Equal(t, test.changed, n.ShouldNotify(changed), "on %q, changed", test.on)
+		assert.Equal(t, test.failed, n.ShouldNotify(failed), "on %q, failed", test.on)
+	}
+}
+
+func TestRunActionNotify(t *testing.T) {
+	defer withFastNotifyRetries()()
+
+	stub := &webhookStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	// webhooks that never succeed do not fail the run
+	broken := &webhookStub{fail: 100}
+	brokenServer := httptest.NewServer(broken)
+	defer brokenServer.Close()
+
+	image := "myapp:1.2.3"
+	manifest := &config.Config{
+		Namespace: "app",
+		Notify:    &config.Notify{Webhooks: config.Strings{server.URL}},
+		Containers: map[string]*config.Container{
+			"web": {Image: &image},
+		},
+	}
+
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("RunContainer", mock.Anything).Return(nil)
+	client.On("WaitForContainer", mock.Anything).Return(nil)
+	client.On("GetPulledImages").Return(nil)
+	client.On("GetRemovedImages").Return(nil)
+	client.On("GetCleanableImages").Return(nil)
+	client.On("GetReclaimedSpace").Return(nil)
+
+	compose := &Compose{
+		Manifest: manifest,
+		Notifier: NewNotifier(&config.Notify{Webhooks: config.Strings{brokenServer.URL}}),
+		client:   client,
+	}
+
+	if err := compose.RunAction(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, notifyRetries+1, broken.requests)
+	assert.Len(t, stub.notifications, 1)
+	notification := stub.notifications[0]
+	assert.Equal(t, "app", notification.Namespace)
+	assert.True(t, notification.Changed)
+	assert.False(t, notification.Failed)
+	assert.Equal(t, "app.web", notification.Created[0].Name)
+	assert.NotEmpty(t, notification.User)
+
+	// failures are notified with the error message
+	client.ExpectedCalls = nil
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(errors.New("docker is down"))
+	client.On("GetPulledImages").Return(nil)
+	client.On("GetRemovedImages").Return(nil)
+	client.On("GetCleanableImages").Return(nil)
+	client.On("GetReclaimedSpace").Return(nil)
+
+	assert.Error(t, compose.RunAction())
+	assert.Len(t, stub.notifications, 2)
+	assert.True(t, stub.notifications[1].Failed)
+	assert.Contains(t, stub.notifications[1].Message, "docker is down")
+}
@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/grammarly/rocker/src/rocker/imagename"
+)
+
+// OutdatedImage describes versions of the image of a container: the one it runs,
+// the newest one matching the version range of the manifest and the newest one at all
+type OutdatedImage struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`   // image as it is given in the manifest, e.g. "myapp:1.2.*"
+	Current   string `json:"current"` // tag of the running container, empty if it does not exist
+	Wanted    string `json:"wanted"`  // newest tag matching the range, empty if there is none
+	Latest    string `json:"latest"`  // newest version tag of the image
+}
+
+// IsOutdated returns true if the container does not run the wanted version,
+// or there is a newer version outside of the range
+func (o *OutdatedImage) IsOutdated() bool {
+	return o.Current != o.Wanted || o.Wanted != o.Latest
+}
+
+// OutdatedAction implements 'rocker-compose outdated'. It reports versions of images
+// of containers having version ranges, e.g. "myapp:1.2.*". Tags are searched locally
+// and/or in the registry. Only outdated images are returned unless all is true.
+func (compose *Compose) OutdatedAction(local, hub, all bool) ([]*OutdatedImage, error) {
+	actual, err := compose.client.GetContainers(false)
+	if err != nil {
+		return nil, fmt.Errorf("GetContainers failed with error, error: %s", err)
+	}
+
+	// tags are listed once per image name
+	tags := map[string][]*imagename.ImageName{}
+	listTags := func(image *imagename.ImageName) ([]*imagename.ImageName, error) {
+		name := image.NameWithRegistry()
+		if _, ok := tags[name]; !ok {
+			list, err := compose.client.ListImageTags(image, local, hub)
+			if err != nil {
+				return nil, err
+			}
+			tags[name] = list
+		}
+		return tags[name], nil
+	}
+
+	result := []*OutdatedImage{}
+	for _, container := range GetContainersFromConfig(compose.Manifest) {
+		// images without semver tags, such as "redis:latest" or digests, have nothing to compare
+		if container.Image == nil || !container.Image.HasVersionRange() {
+			continue
+		}
+
+		list, err := listTags(container.Image)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list tags for container %s, error: %s", container.Name, err)
+		}
+
+		outdated := &OutdatedImage{
+			Container: container.Name.String(),
+			Image:     container.Image.String(),
+		}
+		for _, a := range actual {
+			if container.IsSameKind(a) && a.Image != nil {
+				outdated.Current = a.Image.GetTag()
+			}
+		}
+		if wanted := newestVersion(list, container.Image); wanted != nil {
+			outdated.Wanted = wanted.GetTag()
+		}
+		if latest := newestVersion(list, nil); latest != nil {
+			outdated.Latest = latest.GetTag()
+		}
+
+		if all || outdated.IsOutdated() {
+			result = append(result, outdated)
+		}
+	}
+
+	sort.Sort(outdatedByContainer(result))
+
+	return result, nil
+}
+
+// newestVersion returns the newest version tag of the list within the range of the
+// given image, or among all release versions if the image is nil
+func newestVersion(list []*imagename.ImageName, image *imagename.ImageName) (result *imagename.ImageName) {
+	for _, candidate := range list {
+		if !candidate.HasVersion() {
+			continue
+		}
+		if image != nil && !image.Contains(candidate) {
+			continue
+		}
+		// pre-releases are only considered if the range asks for them
+		if image == nil && candidate.TagAsVersion().IsAPreRelease() {
+			continue
+		}
+		if result == nil || result.TagAsVersion().Less(candidate.TagAsVersion()) {
+			result = candidate
+		}
+	}
+	return
+}
+
+type outdatedByContainer []*OutdatedImage
+
+func (a outdatedByContainer) Len() int           { return len(a) }
+func (a outdatedByContainer) Less(i, j int) bool { return a[i].Container < a[j].Container }
+func (a outdatedByContainer) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
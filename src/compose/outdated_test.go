@@ -0,0 +1,80 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func newImageNames(names ...string) []*imagename.ImageName {
+	result := []*imagename.ImageName{}
+	for _, name := range names {
+		result = append(result, imagename.NewFromString(name))
+	}
+	return result
+}
+
+func TestNewestVersion(t *testing.T) {
+	list := newImageNames("myapp:1.2.0", "myapp:1.2.10", "myapp:1.2.9", "myapp:1.3.0", "myapp:2.0.0-rc1", "myapp:latest")
+
+	assert.Equal(t, "1.2.10", newestVersion(list, imagename.NewFromString("myapp:1.2.*")).GetTag())
+	assert.Equal(t, "1.3.0", newestVersion(list, nil).GetTag())
+	assert.Nil(t, newestVersion(list, imagename.NewFromString("myapp:3.*")))
+}
+
+func TestOutdatedAction(t *testing.T) {
+	app, redis, db := "myapp:1.2.*", "redis:latest", "postgres:9.4.5"
+	manifest := &config.Config{
+		Namespace: "test",
+		Containers: map[string]*config.Container{
+			"app":   {Image: &app},
+			"redis": {Image: &redis},
+			"db":    {Image: &db},
+		},
+	}
+
+	client := &clientMock{}
+	client.On("GetContainers").Return(nil)
+	client.On("ListImageTags", imagename.NewFromString(app), true, true).Return(
+		newImageNames("myapp:1.2.0", "myapp:1.2.3", "myapp:1.3.0"), nil)
+	client.On("ListImageTags", imagename.NewFromString(db), true, true).Return(
+		newImageNames("postgres:9.4.5"), nil)
+
+	compose := &Compose{Manifest: manifest, client: client}
+
+	outdated, err := compose.OutdatedAction(true, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.AssertExpectations(t)
+
+	// redis has no version range, db runs no version as it is not running
+	assert.Equal(t, []*OutdatedImage{
+		{Container: "test.app", Image: "myapp:1.2.*", Wanted: "1.2.3", Latest: "1.3.0"},
+		{Container: "test.db", Image: "postgres:9.4.5", Wanted: "9.4.5", Latest: "9.4.5"},
+	}, outdated)
+
+	outdated, err = compose.OutdatedAction(true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(outdated))
+}
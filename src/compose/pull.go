@@ -0,0 +1,367 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"util"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/term"
+	"github.com/docker/docker/pkg/units"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/rocker/imagename"
+)
+
+// DefaultPullConcurrency is the number of images pulled in parallel, if not specified
+const DefaultPullConcurrency = 4
+
+// pullRetryBackoff is the delay before the first retry of a failed pull,
+// it doubles with every next attempt
+var pullRetryBackoff = 2 * time.Second
+
+// pullProgressInterval is how often progress of a single image is logged
+// when the output is not a terminal
+var pullProgressInterval = 5 * time.Second
+
+// pullRequest is an image to pull along with the container that needs it
+type pullRequest struct {
+	image     *imagename.ImageName
+	container *Container
+}
+
+// pullImages pulls images concurrently, retrying on transient errors,
+// and returns inspected images by their names
+func (client *DockerClient) pullImages(requests []*pullRequest) (map[string]*docker.Image, error) {
+	concurrency := client.PullConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultPullConcurrency
+	}
+
+	def := log.StandardLogger()
+	_, isTerminal := term.GetFdInfo(def.Out)
+	progress := newPullProgress(def.Out, isTerminal)
+	defer progress.close()
+
+	var (
+		mu     sync.Mutex
+		images = map[string]*docker.Image{}
+		sem    = make(chan struct{}, concurrency)
+		wg     = util.NewErrorWaitGroup(len(requests))
+	)
+
+	for _, req := range requests {
+		go func(req *pullRequest) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			name := req.image.String()
+			started := time.Now()
+			progress.start(name)
+
+			// pull from the mirror, if there is one, and tag the image with the original name
+			source := client.Mirrors.Rewrite(req.image)
+			if source != req.image {
+				log.Debugf("Pulling image %s from the mirror %s", name, source)
+			}
+
+			var img *docker.Image
+			err := retryPull(name, client.PullRetries, pullRetryBackoff, func() (err error) {
+				img, err = pullDockerImageStream(client.Docker, source, client.Auth.DockerAPIForImage(source), func(msg *jsonmessage.JSONMessage) {
+					progress.update(name, msg)
+				})
+				return err
+			})
+			if err == nil && source != req.image {
+				if err = tagMirroredImage(client.Docker, source, req.image); err == nil {
+					img, err = client.inspectImage(req.image)
+				}
+			}
+			pulled := progress.downloaded(name)
+			progress.finish(name, err)
+
+			client.Metrics.ObserveAction("pull", time.Since(started), err)
+			if err != nil {
+				wg.Done(fmt.Errorf("Failed to pull image %s for container %s, error: %s", req.image, req.container.Name, err))
+				return
+			}
+
+			client.Metrics.ObservePull(pulled, time.Since(started))
+			client.Events.Emit(&Event{
+				Type:      EventImagePulled,
+				Image:     name,
+				Container: req.container.Name.String(),
+				Duration:  time.Since(started).Seconds(),
+			})
+
+			mu.Lock()
+			images[name] = img
+			mu.Unlock()
+			wg.Done(nil)
+		}(req)
+	}
+
+	if err := wg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// retryPull calls the pull function until it succeeds, fails with a non-transient
+// error or the number of retries is exhausted; the delay between attempts doubles every time
+func retryPull(name string, retries int, backoff time.Duration, pull func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := pull()
+		if err == nil || attempt > retries || !isTransientPullError(err) {
+			return err
+		}
+		log.Warnf("Failed to pull image %s, retrying in %s (%d of %d), error: %s", name, backoff, attempt, retries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// transientPullErrors are substrings of errors of registries and networks that
+// are worth retrying
+var transientPullErrors = []string{
+	"timeout",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected EOF",
+	"TLS handshake",
+	"no such host",
+	"too many requests",
+	"toomanyrequests",
+	"500 Internal Server Error",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+}
+
+// isTransientPullError returns true if the pull error may go away on retry,
+// such as network errors or 5xx errors of the registry
+func isTransientPullError(err error) bool {
+	if e, ok := err.(*docker.Error); ok && e.Status >= 500 {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range transientPullErrors {
+		if strings.Contains(msg, strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullProgress aggregates the progress of concurrent pulls. When attached to a terminal,
+// it renders a single summary line, otherwise it logs progress of every image periodically.
+type pullProgress struct {
+	mu         sync.Mutex
+	out        io.Writer
+	isTerminal bool
+	images     map[string]*imageProgress
+	pulled     int
+	printed    bool
+	lastRender time.Time
+}
+
+type imageProgress struct {
+	name      string
+	layers    map[string]*layerProgress
+	lastLog   time.Time
+	startedAt time.Time
+}
+
+type layerProgress struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+func newPullProgress(out io.Writer, isTerminal bool) *pullProgress {
+	return &pullProgress{
+		out:        out,
+		isTerminal: isTerminal,
+		images:     map[string]*imageProgress{},
+	}
+}
+
+func (p *pullProgress) start(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.images[name] = &imageProgress{
+		name:      name,
+		layers:    map[string]*layerProgress{},
+		startedAt: time.Now(),
+	}
+	p.println(fmt.Sprintf("Pulling image %s", name))
+}
+
+func (p *pullProgress) update(name string, msg *jsonmessage.JSONMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	img, ok := p.images[name]
+	if !ok || !img.update(msg) {
+		return
+	}
+
+	now := time.Now()
+	if p.isTerminal {
+		if now.Sub(p.lastRender) >= 200*time.Millisecond {
+			p.render()
+			p.lastRender = now
+		}
+	} else if now.Sub(img.lastLog) >= pullProgressInterval {
+		log.Infof("Pulling image %s: %s", name, img)
+		img.lastLog = now
+	}
+}
+
+func (p *pullProgress) finish(name string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	img, ok := p.images[name]
+	if !ok {
+		return
+	}
+	delete(p.images, name)
+
+	if err == nil {
+		p.pulled++
+		p.println(fmt.Sprintf("Pulled image %s in %.1fs", name, time.Since(img.startedAt).Seconds()))
+	}
+}
+
+// downloaded returns bytes of layers of the image downloaded so far
+func (p *pullProgress) downloaded(name string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	img, ok := p.images[name]
+	if !ok {
+		return 0
+	}
+	current, _ := img.bytes()
+	return current
+}
+
+func (p *pullProgress) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clearLine()
+}
+
+// println logs the message, taking care of the summary line on the terminal
+func (p *pullProgress) println(msg string) {
+	p.clearLine()
+	log.Info(msg)
+	if p.isTerminal && len(p.images) > 0 {
+		p.render()
+	}
+}
+
+// render prints the summary line of all images being pulled
+func (p *pullProgress) render() {
+	names := []string{}
+	for name := range p.images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{}
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %s", name, p.images[name].percent()))
+	}
+
+	fmt.Fprintf(p.out, "\r\033[KPulled %d, pulling %d: %s", p.pulled, len(names), strings.Join(parts, ", "))
+	p.printed = true
+}
+
+func (p *pullProgress) clearLine() {
+	if p.printed {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.printed = false
+	}
+}
+
+// update applies the message of the pull stream, returns true if
+// the progress of the image changed
+func (img *imageProgress) update(msg *jsonmessage.JSONMessage) bool {
+	// messages without progress details and statuses of the image itself are skipped
+	if msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from") {
+		return false
+	}
+
+	layer, ok := img.layers[msg.ID]
+	if !ok {
+		layer = &layerProgress{}
+		img.layers[msg.ID] = layer
+	}
+
+	switch {
+	case msg.Status == "Downloading" && msg.Progress != nil:
+		layer.current = int64(msg.Progress.Current)
+		layer.total = int64(msg.Progress.Total)
+	case msg.Status == "Download complete" || msg.Status == "Pull complete" || msg.Status == "Already exists":
+		layer.current = layer.total
+		layer.done = true
+	}
+
+	return true
+}
+
+// percent returns the downloaded percentage of layers with known sizes
+func (img *imageProgress) percent() string {
+	current, total := img.bytes()
+	if total == 0 {
+		return "..."
+	}
+	return fmt.Sprintf("%d%%", current*100/total)
+}
+
+func (img *imageProgress) bytes() (current, total int64) {
+	for _, layer := range img.layers {
+		current += layer.current
+		total += layer.total
+	}
+	return
+}
+
+// String returns the progress of the image, e.g. "2/5 layers, 12.5 MB/40.1 MB"
+func (img *imageProgress) String() string {
+	done := 0
+	for _, layer := range img.layers {
+		if layer.done {
+			done++
+		}
+	}
+	current, total := img.bytes()
+	return fmt.Sprintf("%d/%d layers, %s/%s", done, len(img.layers),
+		units.HumanSize(float64(current)), units.HumanSize(float64(total)))
+}
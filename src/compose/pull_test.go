@@ -0,0 +1,89 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPull(t *testing.T) {
+	transient := fmt.Errorf("Get https://registry/v2/: net/http: TLS handshake timeout")
+	permanent := fmt.Errorf("Error: image myapp:1.0 not found")
+
+	// succeeds after transient errors
+	calls := 0
+	err := retryPull("myapp:1.0", 3, time.Millisecond, func() error {
+		if calls++; calls < 3 {
+			return transient
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+
+	// gives up when retries are exhausted
+	calls = 0
+	err = retryPull("myapp:1.0", 2, time.Millisecond, func() error {
+		calls++
+		return transient
+	})
+	assert.Equal(t, transient, err)
+	assert.Equal(t, 3, calls)
+
+	// does not retry permanent errors
+	calls = 0
+	err = retryPull("myapp:1.0", 3, time.Millisecond, func() error {
+		calls++
+		return permanent
+	})
+	assert.Equal(t, permanent, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestIsTransientPullError(t *testing.T) {
+	assert.True(t, isTransientPullError(&docker.Error{Status: 503, Message: "unavailable"}))
+	assert.True(t, isTransientPullError(fmt.Errorf("read tcp 10.0.0.1:443: connection reset by peer")))
+	assert.True(t, isTransientPullError(fmt.Errorf("toomanyrequests: rate limit exceeded")))
+	assert.False(t, isTransientPullError(&docker.Error{Status: 404, Message: "not found"}))
+	assert.False(t, isTransientPullError(fmt.Errorf("unauthorized: authentication required")))
+}
+
+func TestImageProgress(t *testing.T) {
+	img := &imageProgress{layers: map[string]*layerProgress{}}
+
+	messages := []*jsonmessage.JSONMessage{
+		{ID: "1.0", Status: "Pulling from myapp"},
+		{ID: "a", Status: "Already exists"},
+		{ID: "b", Status: "Pulling fs layer"},
+		{ID: "b", Status: "Downloading", Progress: &jsonmessage.JSONProgress{Current: 500, Total: 2000}},
+		{ID: "c", Status: "Downloading", Progress: &jsonmessage.JSONProgress{Current: 1000, Total: 2000}},
+		{ID: "c", Status: "Download complete"},
+	}
+	for _, msg := range messages {
+		img.update(msg)
+	}
+
+	assert.Equal(t, 3, len(img.layers))
+	assert.Equal(t, "2/3 layers, 2.5 kB/4 kB", img.String())
+	assert.Equal(t, "62%", img.percent())
+}
@@ -0,0 +1,162 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/grammarly/rocker/src/rocker/imagename"
+)
+
+// registryHTTPClient is used for requests to registries, may be replaced in tests
+var registryHTTPClient = http.DefaultClient
+
+// listRegistryTags lists tags of the image in the registry, or in its mirror
+// if there is one; the result refers to the original image name
+func (client *DockerClient) listRegistryTags(image *imagename.ImageName) ([]*imagename.ImageName, error) {
+	source := client.Mirrors.Rewrite(image)
+
+	tags, err := registryListTags(source, client.Auth.ForImage(source))
+	if err != nil || source == image {
+		return tags, err
+	}
+
+	images := []*imagename.ImageName{}
+	for _, tag := range tags {
+		images = append(images, imagename.New(image.NameWithRegistry(), tag.GetTag()))
+	}
+	return images, nil
+}
+
+// dockerHubRegistry is the registry API host of Docker Hub
+const dockerHubRegistry = "registry-1.docker.io"
+
+// registryListTags lists tags of the image in the registry, authenticating with
+// the given credentials. Tags are listed anonymously by imagename if there are none.
+func registryListTags(image *imagename.ImageName, auth *AuthConfig) ([]*imagename.ImageName, error) {
+	if auth == nil || auth.Username == "" {
+		return imagename.RegistryListTags(image)
+	}
+
+	registry, name := image.Registry, image.Name
+	if registry == "" {
+		// official images of Docker Hub are in the library namespace
+		registry = dockerHubRegistry
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+
+	tags := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if err := registryGet(fmt.Sprintf("https://%s/v2/%s/tags/list", registry, name), auth, &tags); err != nil {
+		return nil, err
+	}
+
+	images := []*imagename.ImageName{}
+	for _, t := range tags.Tags {
+		candidate := imagename.New(image.NameWithRegistry(), t)
+		if image.Contains(candidate) || image.Tag == candidate.Tag {
+			images = append(images, candidate)
+		}
+	}
+	return images, nil
+}
+
+// registryGet makes GET request to the registry API and decodes the JSON response.
+// It supports both basic auth and token auth of the registry v2.
+func registryGet(uri string, auth *AuthConfig, obj interface{}) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(auth.Username, auth.Password)
+
+	res, err := registryHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Request to %s failed, error: %s", uri, err)
+	}
+	defer res.Body.Close()
+
+	// registry asks to get a token from the auth service
+	if challenge := res.Header.Get("WWW-Authenticate"); res.StatusCode == http.StatusUnauthorized && strings.HasPrefix(challenge, "Bearer ") {
+		token, err := registryToken(challenge, auth)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if res, err = registryHTTPClient.Do(req); err != nil {
+			return fmt.Errorf("Request to %s failed, error: %s", uri, err)
+		}
+		defer res.Body.Close()
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Response from %s cannot be read, error: %s", uri, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request to %s failed with status %d, response: %s", uri, res.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, obj); err != nil {
+		return fmt.Errorf("Response from %s cannot be unmarshalled, error: %s", uri, err)
+	}
+	return nil
+}
+
+// registryToken gets the token from the auth service given by the Bearer challenge, e.g.
+//   Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:foo:pull"
+func registryToken(challenge string, auth *AuthConfig) (string, error) {
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("Invalid registry auth challenge: %s", challenge)
+	}
+
+	query := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			query.Set(k, params[k])
+		}
+	}
+
+	resp := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := registryGet(realm+"?"+query.Encode(), auth, &resp); err != nil {
+		return "", fmt.Errorf("Failed to get registry token, error: %s", err)
+	}
+
+	if resp.Token != "" {
+		return resp.Token, nil
+	}
+	return resp.AccessToken, nil
+}
@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/rocker/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryListTagsTokenAuth(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			user, pass, _ := r.BasicAuth()
+			if user != "user" || pass != "pass" || r.URL.Query().Get("scope") != "repository:myapp:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token": "secret-token"}`)
+
+		case "/v2/myapp/tags/list":
+			if r.Header.Get("Authorization") != "Bearer secret-token" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:myapp:pull"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"name": "myapp", "tags": ["1.0.0", "1.1.0", "2.0.0", "latest"]}`)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	defer func(c *http.Client) { registryHTTPClient = c }(registryHTTPClient)
+	registryHTTPClient = server.Client()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	images, err := registryListTags(imagename.NewFromString(host+"/myapp:1.*"), &AuthConfig{Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := []string{}
+	for _, img := range images {
+		tags = append(tags, img.GetTag())
+	}
+	assert.Equal(t, []string{"1.0.0", "1.1.0"}, tags)
+
+	_, err = registryListTags(imagename.NewFromString(host+"/myapp:1.*"), &AuthConfig{Username: "user", Password: "wrong"})
+	assert.Contains(t, err.Error(), "Failed to get registry token")
+}
+
+// rewriteTransport sends all requests to the test server
+type rewriteTransport struct {
+	host string
+	next http.RoundTripper
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Host = t.host
+	return t.next.RoundTrip(req)
+}
+
+func TestRegistryListTagsDockerHub(t *testing.T) {
+	requested := []string{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.Host+r.URL.Path)
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"name": "library/redis", "tags": ["3.0.5", "3.0.6", "latest"]}`)
+	}))
+	defer server.Close()
+
+	defer func(c *http.Client) { registryHTTPClient = c }(registryHTTPClient)
+	registryHTTPClient = &http.Client{Transport: &rewriteTransport{
+		host: strings.TrimPrefix(server.URL, "https://"),
+		next: server.Client().Transport,
+	}}
+
+	images, err := registryListTags(imagename.NewFromString("redis:3.0.*"), &AuthConfig{Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, images, 2)
+	assert.Equal(t, []string{"registry-1.docker.io/v2/library/redis/tags/list"}, requested)
+}
@@ -0,0 +1,297 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/rocker/dockerclient"
+	"github.com/grammarly/rocker/src/rocker/template"
+	"github.com/mitchellh/go-homedir"
+)
+
+// Statuses of hosts in the rollout summary
+const (
+	HostStatusOK      = "ok"
+	HostStatusFailed  = "failed"
+	HostStatusSkipped = "skipped"
+)
+
+// Host is a Docker endpoint of the inventory
+type Host struct {
+	Name      string        `yaml:"-"`
+	Host      string        `yaml:"host"`      // Docker endpoint, e.g. tcp://10.0.0.1:2376
+	TLSVerify *bool         `yaml:"tlsverify"` // use TLS and verify the remote
+	TLSCACert string        `yaml:"tlscacert"` // paths are relative to the inventory file
+	TLSCert   string        `yaml:"tlscert"`   //
+	TLSKey    string        `yaml:"tlskey"`    //
+	Vars      template.Vars `yaml:"vars"`      // vars of the manifest on this host, they override --var and --vars
+}
+
+// Inventory is the list of hosts to deploy to, read from YAML:
+//
+//	defaults:
+//	  tlsverify: true
+//	  tlscacert: certs/ca.pem
+//	  tlscert: certs/cert.pem
+//	  tlskey: certs/key.pem
+//	hosts:
+//	  web1:
+//	    host: tcp://10.0.0.1:2376
+//	    vars:
+//	      shard: 1
+//
+// Properties of defaults are taken for hosts not having them.
+type Inventory struct {
+	Defaults *Host            `yaml:"defaults"`
+	Hosts    map[string]*Host `yaml:"hosts"`
+}
+
+// ReadInventory reads the inventory file and resolves paths of certificates relative to it
+func ReadInventory(file string) (*Inventory, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read inventory %s, error: %s", file, err)
+	}
+	inventory := &Inventory{}
+	if err := yaml.Unmarshal(data, inventory); err != nil {
+		return nil, fmt.Errorf("Failed to parse inventory %s, error: %s", file, err)
+	}
+	if len(inventory.Hosts) == 0 {
+		return nil, fmt.Errorf("No hosts are listed in inventory %s", file)
+	}
+
+	dir := filepath.Dir(file)
+	defaults := inventory.Defaults
+	if defaults == nil {
+		defaults = &Host{}
+	}
+
+	for name, host := range inventory.Hosts {
+		if host == nil {
+			host = &Host{}
+			inventory.Hosts[name] = host
+		}
+		host.Name = name
+		host.applyDefaults(defaults)
+		if host.Host == "" {
+			return nil, fmt.Errorf("Docker endpoint of host %s is not given in inventory %s", name, file)
+		}
+		for _, p := range []*string{&host.TLSCACert, &host.TLSCert, &host.TLSKey} {
+			if *p, err = resolveInventoryPath(dir, *p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return inventory, nil
+}
+
+// Match returns hosts having names matching any of the shell patterns, sorted by name
+func (inventory *Inventory) Match(patterns []string) ([]*Host, error) {
+	hosts := []*Host{}
+	for name, host := range inventory.Hosts {
+		for _, pattern := range patterns {
+			ok, err := path.Match(pattern, name)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid hosts pattern %s, error: %s", pattern, err)
+			}
+			if ok {
+				hosts = append(hosts, host)
+				break
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("No hosts of the inventory match %s", strings.Join(patterns, ", "))
+	}
+	sort.Sort(hostsByName(hosts))
+	return hosts, nil
+}
+
+// DockerConfig returns the config of the Docker client of the host
+func (host *Host) DockerConfig() *dockerclient.Config {
+	return &dockerclient.Config{
+		Host:      host.Host,
+		Tlsverify: host.TLSVerify != nil && *host.TLSVerify,
+		Tlscacert: host.TLSCACert,
+		Tlscert:   host.TLSCert,
+		Tlskey:    host.TLSKey,
+	}
+}
+
+func (host *Host) applyDefaults(defaults *Host) {
+	if host.Host == "" {
+		host.Host = defaults.Host
+	}
+	if host.TLSVerify == nil {
+		host.TLSVerify = defaults.TLSVerify
+	}
+	if host.TLSCACert == "" {
+		host.TLSCACert = defaults.TLSCACert
+	}
+	if host.TLSCert == "" {
+		host.TLSCert = defaults.TLSCert
+	}
+	if host.TLSKey == "" {
+		host.TLSKey = defaults.TLSKey
+	}
+	host.Vars = template.Vars{}.Merge(defaults.Vars, host.Vars)
+}
+
+func resolveInventoryPath(dir, p string) (string, error) {
+	if p == "" {
+		return "", nil
+	}
+	p, err := homedir.Expand(p)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	return p, nil
+}
+
+// HostResult is the outcome of the deploy to a host
+type HostResult struct {
+	Host     string
+	Status   string
+	Changes  []string
+	Duration time.Duration
+	Error    error
+}
+
+// Rollout deploys to hosts in batches, halting when too many of them failed
+type Rollout struct {
+	Hosts []*Host
+
+	// BatchSize is the number of hosts deployed to in parallel, 1 if zero
+	BatchSize int
+
+	// MaxFailures is the number of failed hosts tolerated, the next batches are
+	// not deployed after more of them failed
+	MaxFailures int
+
+	// Deploy runs the manifest on the host and returns changes made
+	Deploy func(host *Host) ([]string, error)
+}
+
+// Run deploys to all hosts and returns results in the order of hosts; the error
+// is returned if any host failed
+func (r *Rollout) Run() ([]*HostResult, error) {
+	batchSize := r.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	results := make([]*HostResult, len(r.Hosts))
+	failed := 0
+
+	for start := 0; start < len(r.Hosts); start += batchSize {
+		end := start + batchSize
+		if end > len(r.Hosts) {
+			end = len(r.Hosts)
+		}
+
+		if failed > r.MaxFailures {
+			for i := start; i < len(r.Hosts); i++ {
+				results[i] = &HostResult{Host: r.Hosts[i].Name, Status: HostStatusSkipped}
+			}
+			break
+		}
+
+		names := []string{}
+		for _, host := range r.Hosts[start:end] {
+			names = append(names, host.Name)
+		}
+		log.Infof("Deploying to %s", strings.Join(names, ", "))
+
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = r.deploy(r.Hosts[i])
+			}(i)
+		}
+		wg.Wait()
+
+		for _, result := range results[start:end] {
+			if result.Status == HostStatusFailed {
+				failed++
+			}
+		}
+		if failed > r.MaxFailures && end < len(r.Hosts) {
+			log.Errorf("%d hosts failed, more than %d tolerated, halting the rollout", failed, r.MaxFailures)
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("Deploy failed on %d of %d hosts", failed, len(r.Hosts))
+	}
+	return results, nil
+}
+
+func (r *Rollout) deploy(host *Host) *HostResult {
+	started := time.Now()
+	changes, err := r.Deploy(host)
+
+	result := &HostResult{
+		Host:     host.Name,
+		Status:   HostStatusOK,
+		Changes:  changes,
+		Duration: time.Since(started),
+		Error:    err,
+	}
+	if err != nil {
+		result.Status = HostStatusFailed
+		log.Errorf("Deploy to %s failed, error: %s", host.Name, err)
+	}
+	return result
+}
+
+// WriteRolloutSummary prints results of the rollout as a table
+func WriteRolloutSummary(w io.Writer, results []*HostResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSTATUS\tCHANGES\tDURATION\tERROR")
+	for _, result := range results {
+		errStr := ""
+		if result.Error != nil {
+			errStr = result.Error.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", result.Host, result.Status, len(result.Changes),
+			result.Duration.Round(100*time.Millisecond), errStr)
+	}
+	return tw.Flush()
+}
+
+type hostsByName []*Host
+
+func (a hostsByName) Len() int           { return len(a) }
+func (a hostsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a hostsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,169 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "hosts.yml")
+	err = ioutil.WriteFile(file, []byte(`defaults:
+  tlsverify: true
+  tlscacert: certs/ca.pem
+  tlscert: /etc/docker/cert.pem
+  tlskey: certs/key.pem
+  vars:
+    env: prod
+    shard: 0
+hosts:
+  web1:
+    host: tcp://10.0.0.1:2376
+    vars:
+      shard: 1
+  web2:
+    host: tcp://10.0.0.2:2376
+    tlsverify: false
+  db1:
+    host: tcp://10.0.1.1:2376
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inventory, err := ReadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web1 := inventory.Hosts["web1"]
+	assert.Equal(t, "web1", web1.Name)
+	assert.Equal(t, map[string]interface{}{"env": "prod", "shard": 1}, map[string]interface{}(web1.Vars))
+
+	config := web1.DockerConfig()
+	assert.Equal(t, "tcp://10.0.0.1:2376", config.Host)
+	assert.True(t, config.Tlsverify)
+	assert.Equal(t, filepath.Join(dir, "certs/ca.pem"), config.Tlscacert)
+	assert.Equal(t, "/etc/docker/cert.pem", config.Tlscert)
+
+	assert.False(t, inventory.Hosts["web2"].DockerConfig().Tlsverify)
+
+	hosts, err := inventory.Match([]string{"web*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"web1", "web2"}, hostNames(hosts))
+
+	hosts, err = inventory.Match([]string{"db1", "web2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"db1", "web2"}, hostNames(hosts))
+
+	_, err = inventory.Match([]string{"cache*"})
+	assert.Error(t, err)
+}
+
+func TestReadInventoryNoEndpoint(t *testing.T) {
+	f, err := ioutil.TempFile("", "rocker-compose-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("hosts:\n  web1:\n    vars:\n      shard: 1\n")
+	f.Close()
+
+	_, err = ReadInventory(f.Name())
+	assert.Error(t, err)
+}
+
+func TestRolloutBatches(t *testing.T) {
+	hosts := []*Host{{Name: "h1"}, {Name: "h2"}, {Name: "h3"}, {Name: "h4"}, {Name: "h5"}}
+
+	var (
+		mu       sync.Mutex
+		deployed []string
+	)
+	rollout := &Rollout{
+		Hosts:       hosts,
+		BatchSize:   2,
+		MaxFailures: 1,
+		Deploy: func(host *Host) ([]string, error) {
+			mu.Lock()
+			deployed = append(deployed, host.Name)
+			mu.Unlock()
+			if host.Name == "h2" || host.Name == "h3" {
+				return nil, fmt.Errorf("host is down")
+			}
+			return []string{"Creating container 'app.web'"}, nil
+		},
+	}
+
+	results, err := rollout.Run()
+	assert.Error(t, err)
+
+	// the third batch is not deployed after two hosts failed
+	assert.Len(t, deployed, 4)
+	statuses := []string{}
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+	}
+	assert.Equal(t, []string{HostStatusOK, HostStatusFailed, HostStatusFailed, HostStatusOK, HostStatusSkipped}, statuses)
+
+	buf := &bytes.Buffer{}
+	if err := WriteRolloutSummary(buf, results); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, buf.String(), "HOST")
+	assert.Contains(t, buf.String(), "host is down")
+	assert.Contains(t, buf.String(), "skipped")
+}
+
+func TestRolloutSuccess(t *testing.T) {
+	rollout := &Rollout{
+		Hosts:  []*Host{{Name: "h1"}, {Name: "h2"}},
+		Deploy: func(host *Host) ([]string, error) { return nil, nil },
+	}
+	results, err := rollout.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, results, 2)
+	assert.Equal(t, HostStatusOK, results[1].Status)
+}
+
+func hostNames(hosts []*Host) []string {
+	names := []string{}
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+	return names
+}
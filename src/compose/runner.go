@@ -28,7 +28,9 @@ type Runner interface {
 type dryRunner struct{}
 
 type dockerClientRunner struct {
-	client Client
+	client  Client
+	events  *EventStream
+	metrics *Metrics
 }
 
 // NewDryRunner makes a runner that does not actually execute actions, but prints them
@@ -45,7 +47,10 @@ func NewDockerClientRunner(client Client) Runner {
 
 // Run executes all actions
 func (r *dockerClientRunner) Run(actions []Action) (err error) {
-	for _, a := range actions {
+	for i, a := range actions {
+		if r.events != nil || r.metrics != nil {
+			a = withEvents(a, i+1, r.events, r.metrics)
+		}
 		if err = a.Execute(r.client); err != nil {
 			return
 		}
@@ -0,0 +1,57 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// EnvProvider reads secrets from ENV variables
+type EnvProvider struct {
+	Prefix string
+	lookup func(string) (string, bool)
+}
+
+var envNameReplace = regexp.MustCompile("[^A-Z0-9_]")
+
+// NewEnvProvider makes a provider that reads secrets from ENV variables
+// having a given prefix
+func NewEnvProvider(prefix string) *EnvProvider {
+	return &EnvProvider{
+		Prefix: prefix,
+		lookup: os.LookupEnv,
+	}
+}
+
+// Get returns the value of ENV variable made from the key,
+// e.g. "db/password" becomes PREFIX_DB_PASSWORD
+func (p *EnvProvider) Get(key string) (string, error) {
+	name := p.Prefix + envNameReplace.ReplaceAllString(strings.ToUpper(key), "_")
+	value, ok := p.lookup(name)
+	if !ok {
+		return "", fmt.Errorf("ENV variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// String returns the printable description of the provider
+func (p *EnvProvider) String() string {
+	return fmt.Sprintf("env:%s", p.Prefix)
+}
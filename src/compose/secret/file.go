@@ -0,0 +1,178 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/go-yaml/yaml"
+	"github.com/mitchellh/go-homedir"
+)
+
+// DefaultKeyFile is the key file used by the file provider if no other is given
+const DefaultKeyFile = "~/.rocker-compose/secret.key"
+
+// keySize is the AES-256 key size in bytes
+const keySize = 32
+
+// FileProvider reads secrets from a YAML file with "key: value" pairs that is
+// encrypted with AES-256-GCM. The file content is base64 of nonce + ciphertext,
+// the key file contains hex encoded 32 bytes key, see GenerateKey.
+type FileProvider struct {
+	File    string
+	KeyFile string
+
+	once    sync.Once
+	secrets map[string]string
+	err     error
+}
+
+// NewFileProvider makes a provider from "PATH" or "PATH?keyfile=KEY" spec.
+// The file is decrypted lazily on the first Get.
+func NewFileProvider(spec string) (*FileProvider, error) {
+	p := &FileProvider{
+		File:    spec,
+		KeyFile: DefaultKeyFile,
+	}
+
+	if i := strings.Index(spec, "?"); i >= 0 {
+		p.File = spec[:i]
+		for _, opt := range strings.Split(spec[i+1:], "&") {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 || kv[0] != "keyfile" {
+				return nil, fmt.Errorf("Unknown option `%s` for the file secret provider, possible is: keyfile", opt)
+			}
+			p.KeyFile = kv[1]
+		}
+	}
+
+	return p, nil
+}
+
+// Get returns the value of the secret from the decrypted file
+func (p *FileProvider) Get(key string) (string, error) {
+	p.once.Do(func() {
+		p.secrets, p.err = p.load()
+	})
+	if p.err != nil {
+		return "", p.err
+	}
+	value, ok := p.secrets[key]
+	if !ok {
+		return "", fmt.Errorf("Secret is not found in %s", p.File)
+	}
+	return value, nil
+}
+
+// String returns the printable description of the provider
+func (p *FileProvider) String() string {
+	return fmt.Sprintf("file:%s", p.File)
+}
+
+func (p *FileProvider) load() (map[string]string, error) {
+	key, err := ReadKeyFile(p.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p.File)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read secrets file %s, error: %s", p.File, err)
+	}
+	plain, err := Decrypt(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt secrets file %s, error: %s", p.File, err)
+	}
+	secrets := map[string]string{}
+	if err := yaml.Unmarshal(plain, &secrets); err != nil {
+		return nil, fmt.Errorf("Failed to parse decrypted secrets file %s, error: %s", p.File, err)
+	}
+	return secrets, nil
+}
+
+// GenerateKey makes a new random key, hex encoded, to be stored in a key file
+func GenerateKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// ReadKeyFile reads and decodes the key file made by GenerateKey
+func ReadKeyFile(filename string) ([]byte, error) {
+	filename, err := homedir.Expand(filename)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read secret key file %s, error: %s", filename, err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("Secret key file %s should contain %d hex encoded bytes", filename, keySize)
+	}
+	return key, nil
+}
+
+// Encrypt encrypts the data with a given key, the result is base64 encoded
+func Encrypt(key, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// Decrypt decrypts the data produced by Encrypt
+func Decrypt(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("data is too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	hexKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "rocker-compose-secret-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "secret.key")
+	if err := ioutil.WriteFile(keyFile, []byte(hexKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := Encrypt(key, []byte("db/password: file-password\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(encrypted), "file-password")
+
+	secretsFile := path.Join(dir, "secrets.enc")
+	if err := ioutil.WriteFile(secretsFile, encrypted, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewFileProvider(secretsFile + "?keyfile=" + keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := p.Get("db/password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "file-password", value)
+
+	_, err = p.Get("db/missing")
+	assert.Error(t, err)
+
+	// wrong key should fail to decrypt
+	otherKey, _ := GenerateKey()
+	if err := ioutil.WriteFile(keyFile, []byte(otherKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, _ = NewFileProvider(secretsFile + "?keyfile=" + keyFile)
+	_, err = p.Get("db/password")
+	assert.Error(t, err)
+}
+
+func TestReadKeyFileInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "rocker-compose-secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("not a key")
+	f.Close()
+
+	_, err = ReadKeyFile(f.Name())
+	assert.Error(t, err)
+}
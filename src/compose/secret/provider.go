@@ -0,0 +1,102 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package secret provides secret providers that back the {{ secret "key" }}
+// template helper. A provider is chosen by the --secret-provider spec:
+//
+//	env                              ENV variables, "db/password" is read from DB_PASSWORD
+//	env:PREFIX_                      same, but with a prefix: PREFIX_DB_PASSWORD
+//	file:PATH                        AES encrypted YAML file, key is ~/.rocker-compose/secret.key
+//	file:PATH?keyfile=KEY            same, with the key file given explicitly
+//	vault:https://HOST:8200/v1/PATH  HashiCorp Vault compatible HTTP endpoint, token is VAULT_TOKEN
+//
+// Every value returned by the helper is registered for redaction, so it
+// never appears in the log or --print output.
+package secret
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"util"
+)
+
+// Provider is the source of secret values
+type Provider interface {
+	// Get returns the value of the secret by a given key, such as "db/password"
+	Get(key string) (string, error)
+	// String returns the printable description of the provider
+	String() string
+}
+
+// NewProvider makes a provider by a given spec, see package doc for the format
+func NewProvider(spec string) (Provider, error) {
+	split := strings.SplitN(spec, ":", 2)
+	arg := ""
+	if len(split) > 1 {
+		arg = split[1]
+	}
+
+	switch split[0] {
+	case "env":
+		return NewEnvProvider(arg), nil
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("Secret provider `file` requires a path, e.g. file:secrets.enc")
+		}
+		return NewFileProvider(arg)
+	case "vault":
+		if arg == "" {
+			return nil, fmt.Errorf("Secret provider `vault` requires an address, e.g. vault:https://127.0.0.1:8200/v1/secret")
+		}
+		return NewVaultProvider(arg)
+	}
+
+	return nil, fmt.Errorf("Unknown secret provider `%s`, possible are: env, file, vault", split[0])
+}
+
+// TemplateHelper makes the {{ secret "key" }} template function on top of a given
+// provider. Values are fetched once per key and registered for redaction.
+// If provider is nil, the helper fails with an explanation.
+func TemplateHelper(provider Provider) func(string) (string, error) {
+	var (
+		mu    sync.Mutex
+		cache = map[string]string{}
+	)
+
+	return func(key string) (string, error) {
+		if provider == nil {
+			return "", fmt.Errorf("Cannot get secret `%s`: no secret provider configured, use --secret-provider", key)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if value, ok := cache[key]; ok {
+			return value, nil
+		}
+
+		value, err := provider.Get(key)
+		if err != nil {
+			return "", fmt.Errorf("Failed to get secret `%s` from %s, error: %s", key, provider, err)
+		}
+
+		util.RegisterSecret(value)
+		cache[key] = value
+
+		return value, nil
+	}
+}
@@ -0,0 +1,100 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+import (
+	"os"
+	"testing"
+	"util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProvider(t *testing.T) {
+	assertions := map[string]string{
+		"env":                                    "env:",
+		"env:APP_":                               "env:APP_",
+		"file:secrets.enc":                       "file:secrets.enc",
+		"file:secrets.enc?keyfile=test.key":      "file:secrets.enc",
+		"vault:http://127.0.0.1:8200/v1/secret/": "vault:http://127.0.0.1:8200/v1/secret",
+	}
+
+	for in, out := range assertions {
+		t.Logf("Checking provider spec %q", in)
+		p, err := NewProvider(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, out, p.String())
+	}
+
+	for _, in := range []string{"", "unknown", "file", "vault", "file:a?foo=bar"} {
+		t.Logf("Checking invalid provider spec %q", in)
+		_, err := NewProvider(in)
+		assert.Error(t, err)
+	}
+}
+
+func TestEnvProvider(t *testing.T) {
+	os.Setenv("ROCKER_COMPOSE_TEST_DB_PASSWORD", "env-password")
+	defer os.Unsetenv("ROCKER_COMPOSE_TEST_DB_PASSWORD")
+
+	p := NewEnvProvider("ROCKER_COMPOSE_TEST_")
+
+	value, err := p.Get("db/password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "env-password", value)
+
+	_, err = p.Get("db/missing")
+	assert.EqualError(t, err, "ENV variable ROCKER_COMPOSE_TEST_DB_MISSING is not set")
+}
+
+type countingProvider struct {
+	calls int
+}
+
+func (p *countingProvider) Get(key string) (string, error) {
+	p.calls++
+	return "value-of-" + key, nil
+}
+
+func (p *countingProvider) String() string {
+	return "counting"
+}
+
+func TestTemplateHelper(t *testing.T) {
+	p := &countingProvider{}
+	helper := TemplateHelper(p)
+
+	for i := 0; i < 3; i++ {
+		value, err := helper("db/password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "value-of-db/password", value)
+	}
+
+	assert.Equal(t, 1, p.calls, "provider should be called once per key")
+	assert.Equal(t, "password: "+util.Redacted, util.Redact("password: value-of-db/password"))
+}
+
+func TestTemplateHelperNoProvider(t *testing.T) {
+	_, err := TemplateHelper(nil)("db/password")
+	assert.Error(t, err)
+}
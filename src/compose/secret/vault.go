@@ -0,0 +1,117 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// defaultVaultField is the field of the Vault secret which is returned
+// when the key does not specify one
+const defaultVaultField = "value"
+
+// VaultProvider reads secrets from the HashiCorp Vault compatible HTTP API.
+// Key "db/password" reads the "value" field of ADDR/db/password secret,
+// key "db#password" reads the "password" field of ADDR/db secret.
+// Both KV v1 and KV v2 response formats are understood.
+type VaultProvider struct {
+	Address string
+	Token   string
+	Client  *http.Client
+}
+
+// NewVaultProvider makes a provider for a given Vault address, including the
+// mount path, e.g. https://127.0.0.1:8200/v1/secret. The token is taken from
+// VAULT_TOKEN or ~/.vault-token, same as the Vault CLI does.
+func NewVaultProvider(address string) (*VaultProvider, error) {
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if filename, err := homedir.Expand("~/.vault-token"); err == nil {
+			if data, err := ioutil.ReadFile(filename); err == nil {
+				token = strings.TrimSpace(string(data))
+			}
+		}
+	}
+
+	return &VaultProvider{
+		Address: strings.TrimRight(address, "/"),
+		Token:   token,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Get fetches the secret from Vault
+func (p *VaultProvider) Get(key string) (string, error) {
+	secretPath, field := key, defaultVaultField
+	if i := strings.Index(key, "#"); i >= 0 {
+		secretPath, field = key[:i], key[i+1:]
+	}
+
+	req, err := http.NewRequest("GET", p.Address+"/"+strings.TrimLeft(secretPath, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	if p.Token != "" {
+		req.Header.Set("X-Vault-Token", p.Token)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("Failed to decode response, error: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unexpected response status %d %s", resp.StatusCode, strings.Join(body.Errors, ", "))
+	}
+
+	data := body.Data
+	// KV v2 wraps the secret into data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("Field `%s` is not found in the secret %s", field, secretPath)
+	}
+
+	return fmt.Sprintf("%v", value), nil
+}
+
+// String returns the printable description of the provider
+func (p *VaultProvider) String() string {
+	return fmt.Sprintf("vault:%s", p.Address)
+}
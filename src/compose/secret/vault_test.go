@@ -0,0 +1,95 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newVaultStub(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/db/password":
+			w.Write([]byte(`{"data":{"value":"vault-password"}}`))
+		case "/v1/secret/db":
+			w.Write([]byte(`{"data":{"user":"app","password":"vault-db-password"}}`))
+		case "/v1/secret/v2":
+			w.Write([]byte(`{"data":{"data":{"value":"kv2-value"},"metadata":{"version":3}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestVaultProvider(t *testing.T) {
+	server := newVaultStub(t)
+	defer server.Close()
+
+	p, err := NewVaultProvider(server.URL + "/v1/secret/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Token = "test-token"
+
+	assertions := map[string]string{
+		"db/password": "vault-password",
+		"db#password": "vault-db-password",
+		"db#user":     "app",
+		"v2":          "kv2-value",
+	}
+
+	for in, out := range assertions {
+		t.Logf("Checking vault key %q", in)
+		value, err := p.Get(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, out, value)
+	}
+
+	_, err = p.Get("missing")
+	assert.Error(t, err)
+
+	_, err = p.Get("db#missing")
+	assert.Error(t, err)
+}
+
+func TestVaultProviderForbidden(t *testing.T) {
+	server := newVaultStub(t)
+	defer server.Close()
+
+	p, err := NewVaultProvider(server.URL + "/v1/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Token = "wrong-token"
+
+	_, err = p.Get("db/password")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "permission denied")
+	}
+}
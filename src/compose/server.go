@@ -0,0 +1,536 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"util"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/rocker/template"
+)
+
+// ServerManifestFile is the name of manifests in subdirectories of the server root
+const ServerManifestFile = "compose.yml"
+
+// Server exposes manifests of a directory over an HTTP API, every manifest is
+// <Root>/<name>/compose.yml, the lock file next to it is applied as 'run' does
+type Server struct {
+	Root   string            // directory of manifests
+	Tokens map[string]string // API tokens to names of their users
+	Audit  io.Writer         // applies are logged to it as JSON lines, if given
+
+	// Config is the base configuration of Compose instances, the manifest,
+	// dry run and the lock holder are set per request
+	Config *Config
+
+	// Funcs returns helpers for rendering manifests
+	Funcs func() (map[string]interface{}, error)
+
+	// HistoryDir is where applies are recorded, they are not if it is empty
+	HistoryDir string
+
+	newCompose func(config *Config) (*Compose, error)
+	hub        *eventHub
+	events     *EventStream
+	auditMu    sync.Mutex
+}
+
+// ServerRequest is the body of render, plan and apply requests
+type ServerRequest struct {
+	Vars     template.Vars `json:"vars"`
+	Profiles []string      `json:"profiles"`
+}
+
+// ServerPlan is the response of plan and apply requests
+type ServerPlan struct {
+	Namespace string   `json:"namespace"`
+	Changes   []string `json:"changes"`
+}
+
+// ServerContainer is the status of a container of the namespace
+type ServerContainer struct {
+	Name       string    `json:"name"`
+	ID         string    `json:"id"`
+	Image      string    `json:"image"`
+	Running    bool      `json:"running"`
+	ExitCode   int       `json:"exit_code"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// AuditEntry is a record of the audit log
+type AuditEntry struct {
+	Time      time.Time     `json:"time"`
+	User      string        `json:"user"`
+	Remote    string        `json:"remote"`
+	Action    string        `json:"action"`
+	Manifest  string        `json:"manifest"`
+	Namespace string        `json:"namespace,omitempty"`
+	Vars      template.Vars `json:"vars,omitempty"`
+	Changes   []string      `json:"changes,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// NewServer makes a server of manifests under root, Compose instances are made from base
+func NewServer(root string, base *Config, tokens map[string]string) *Server {
+	hub := &eventHub{subscribers: map[chan []byte]struct{}{}}
+	return &Server{
+		Root:       root,
+		Tokens:     tokens,
+		Config:     base,
+		newCompose: New,
+		hub:        hub,
+		events:     NewEventStream(hub),
+	}
+}
+
+// ReadTokensFile reads API tokens from the YAML file, a map of user names to tokens
+func ReadTokensFile(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read tokens file %s, error: %s", file, err)
+	}
+	users := map[string]string{}
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("Failed to parse tokens file %s, error: %s", file, err)
+	}
+	tokens := map[string]string{}
+	for user, token := range users {
+		if token == "" {
+			return nil, fmt.Errorf("Token of user %s is empty in %s", user, file)
+		}
+		tokens[token] = user
+	}
+	return tokens, nil
+}
+
+// Handler returns the handler of the API:
+//
+//	GET  /v1/manifests                 list manifests
+//	POST /v1/manifests/<name>/render   render the manifest with given vars
+//	POST /v1/manifests/<name>/plan     compute changes without applying them
+//	POST /v1/manifests/<name>/apply    apply the manifest, taking the deploy lock
+//	GET  /v1/manifests/<name>/status   containers of the namespace
+//	GET  /v1/manifests/<name>/logs     logs of a container, ?container=<name>&tail=<n>
+//	GET  /v1/events                    events of applies as JSON lines
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/manifests", s.auth(s.listManifests))
+	mux.HandleFunc("/v1/manifests/", s.auth(s.manifest))
+	mux.HandleFunc("/v1/events", s.auth(s.streamEvents))
+	return mux
+}
+
+// serverHandler is a handler of an authenticated user
+type serverHandler func(w http.ResponseWriter, r *http.Request, user string)
+
+func (s *Server) auth(h serverHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("Missing API token"))
+			return
+		}
+		if user, ok := s.user(strings.TrimPrefix(header, "Bearer ")); ok {
+			h(w, r, user)
+			return
+		}
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("Invalid API token"))
+	}
+}
+
+// user returns the user of the token, comparing tokens in constant time
+func (s *Server) user(token string) (user string, ok bool) {
+	if token == "" {
+		return "", false
+	}
+	for t, u := range s.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			user, ok = u, true
+		}
+	}
+	return
+}
+
+func (s *Server) listManifests(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", r.Method))
+		return
+	}
+
+	dirs, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Failed to list manifests, error: %s", err))
+		return
+	}
+	names := []string{}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.Root, dir.Name(), ServerManifestFile)); err == nil {
+			names = append(names, dir.Name())
+		}
+	}
+	sort.Strings(names)
+
+	writeJSON(w, http.StatusOK, names)
+}
+
+// manifest serves /v1/manifests/<name>/<op>
+func (s *Server) manifest(w http.ResponseWriter, r *http.Request, user string) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/manifests/"), "/")
+	if len(parts) != 2 || !validManifestName(parts[0]) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found: %s", r.URL.Path))
+		return
+	}
+	name, op := parts[0], parts[1]
+
+	method := "POST"
+	if op == "status" || op == "logs" {
+		method = "GET"
+	}
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", r.Method))
+		return
+	}
+
+	req, err := readServerRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	file := filepath.Join(s.Root, name, ServerManifestFile)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Manifest %s not found", name))
+		return
+	}
+
+	manifest, err := s.loadManifest(file, req)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	switch op {
+	case "render":
+		w.Header().Set("Content-Type", "text/yaml")
+		io.WriteString(w, util.Redact(manifest.Rendered))
+	case "plan":
+		s.plan(w, manifest)
+	case "apply":
+		s.apply(w, r, user, name, file, manifest)
+	case "status":
+		s.status(w, manifest)
+	case "logs":
+		s.logs(w, r, manifest)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found: %s", r.URL.Path))
+	}
+}
+
+// loadManifest renders the manifest with vars of the request and applies the lock file next to it
+func (s *Server) loadManifest(file string, req *ServerRequest) (*config.Config, error) {
+	funcs := map[string]interface{}{}
+	if s.Funcs != nil {
+		var err error
+		if funcs, err = s.Funcs(); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := config.NewFromFile(file, req.Vars, funcs, false)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Profiles = req.Profiles
+
+	lock, err := ReadLock(LockPath(file))
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		lock.Apply(manifest)
+	}
+	return manifest, nil
+}
+
+func (s *Server) plan(w http.ResponseWriter, manifest *config.Config) {
+	cfg := *s.Config
+	cfg.Manifest = manifest
+	cfg.DryRun = true
+
+	compose, err := s.newCompose(&cfg)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := compose.RunAction(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &ServerPlan{Namespace: manifest.Namespace, Changes: compose.Changes()})
+}
+
+func (s *Server) apply(w http.ResponseWriter, r *http.Request, user, name, file string, manifest *config.Config) {
+	cfg := *s.Config
+	cfg.Manifest = manifest
+	cfg.DryRun = false
+	cfg.LockHolder = fmt.Sprintf("%s via API, %s", user, NewDeployLockHolder("serve"))
+	cfg.Events = s.events
+
+	if s.HistoryDir != "" {
+		history, err := NewHistory(s.HistoryDir, manifest.Namespace)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		source, err := ioutil.ReadFile(file)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		cfg.History = history
+		cfg.Revision = NewRevision(fmt.Sprintf("serve apply by %s", user), file, string(source))
+	}
+
+	entry := &AuditEntry{
+		User:      user,
+		Remote:    r.RemoteAddr,
+		Action:    "apply",
+		Manifest:  name,
+		Namespace: manifest.Namespace,
+		Vars:      redactVars(manifest.Vars),
+	}
+
+	compose, err := s.newCompose(&cfg)
+	if err == nil {
+		err = compose.RunAction()
+		entry.Changes = compose.Changes()
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.audit(entry)
+
+	switch err.(type) {
+	case nil:
+		writeJSON(w, http.StatusOK, &ServerPlan{Namespace: manifest.Namespace, Changes: entry.Changes})
+	case ErrDeployLocked:
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (s *Server) status(w http.ResponseWriter, manifest *config.Config) {
+	cfg := *s.Config
+	cfg.Manifest = manifest
+
+	compose, err := s.newCompose(&cfg)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := compose.Status()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) logs(w http.ResponseWriter, r *http.Request, manifest *config.Config) {
+	name := r.URL.Query().Get("container")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Container is not given"))
+		return
+	}
+	if s.Config.Docker == nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Docker client is not configured"))
+		return
+	}
+	tail := r.URL.Query().Get("tail")
+	if tail == "" {
+		tail = "100"
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	out := &flushWriter{w: w}
+	err := s.Config.Docker.Logs(docker.LogsOptions{
+		Container:    config.NewContainerName(manifest.Namespace, name).String(),
+		OutputStream: out,
+		ErrorStream:  out,
+		Stdout:       true,
+		Stderr:       true,
+		Tail:         tail,
+	})
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Failed to get logs of container %s, error: %s", name, err))
+	}
+}
+
+// streamEvents writes events of applies as JSON lines until the client disconnects
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, user string) {
+	ch := s.hub.subscribe()
+	defer s.hub.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	out := &flushWriter{w: w}
+	out.Flush()
+
+	for {
+		select {
+		case line := <-ch:
+			if _, err := out.Write(line); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) audit(entry *AuditEntry) {
+	entry.Time = time.Now()
+	if entry.Error != "" {
+		log.Infof("%s applied %s from %s, error: %s", entry.User, entry.Manifest, entry.Remote, entry.Error)
+	} else {
+		log.Infof("%s applied %s from %s, changes: %s", entry.User, entry.Manifest, entry.Remote, strings.Join(entry.Changes, "; "))
+	}
+	if s.Audit == nil {
+		return
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	if err := json.NewEncoder(s.Audit).Encode(entry); err != nil {
+		log.Errorf("Failed to write the audit log, error: %s", err)
+	}
+}
+
+func readServerRequest(r *http.Request) (*ServerRequest, error) {
+	req := &ServerRequest{}
+	if r.Method == "POST" && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("Failed to parse the request, error: %s", err)
+		}
+	}
+
+	// vars and profiles may also be given in the query, e.g. for GET requests;
+	// unlike --var, "@file" values are not read, clients must not read files of the server
+	query := r.URL.Query()
+	req.Vars = template.Vars{}.Merge(template.ParseKvPairs(query["var"]), req.Vars)
+	req.Profiles = append(req.Profiles, query["profile"]...)
+
+	return req, nil
+}
+
+// validManifestName does not let names escape the root directory
+func validManifestName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write the response, error: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// eventHub broadcasts JSON lines written by EventStream to subscribers,
+// lines are dropped for subscribers that do not keep up
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func (h *eventHub) Write(p []byte) (int, error) {
+	line := append([]byte{}, p...)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (h *eventHub) subscribe() chan []byte {
+	ch := make(chan []byte, 100)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	delete(h.subscribers, ch)
+	h.mu.Unlock()
+}
+
+// flushWriter flushes every write, so that streams reach clients at once
+type flushWriter struct {
+	w io.Writer
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.Flush()
+	return n, err
+}
+
+func (f *flushWriter) Flush() {
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type serverContainersByName []*ServerContainer
+
+func (a serverContainersByName) Len() int           { return len(a) }
+func (a serverContainersByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a serverContainersByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,241 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const serverTestManifest = `namespace: app
+containers:
+  web:
+    image: "myapp:{{ .version }}"
+`
+
+func newTestServer(t *testing.T, client *clientMock) (*Server, func()) {
+	root, err := ioutil.TempDir("", "rocker-compose-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "app", ServerManifestFile), []byte(serverTestManifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// directories without manifests are not listed
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(root, &Config{}, map[string]string{"secret-token": "alice"})
+	server.newCompose = func(config *Config) (*Compose, error) {
+		return &Compose{
+			Manifest:   config.Manifest,
+			DryRun:     config.DryRun,
+			LockHolder: config.LockHolder,
+			Events:     config.Events,
+			client:     client,
+		}, nil
+	}
+	return server, func() { os.RemoveAll(root) }
+}
+
+func serverRequest(server *Server, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret-token")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestServerAuth(t *testing.T) {
+	server, cleanup := newTestServer(t, &clientMock{})
+	defer cleanup()
+
+	for _, header := range []string{"", "Bearer wrong-token", "secret-token"} {
+		req, _ := http.NewRequest("GET", "/v1/manifests", nil)
+		req.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "header %q", header)
+	}
+}
+
+func TestServerListAndRender(t *testing.T) {
+	server, cleanup := newTestServer(t, &clientMock{})
+	defer cleanup()
+
+	w := serverRequest(server, "GET", "/v1/manifests", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[\"app\"]\n", w.Body.String())
+
+	w = serverRequest(server, "POST", "/v1/manifests/app/render", `{"vars": {"version": "1.2.3"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `image: "myapp:1.2.3"`)
+
+	// query vars are taken as well
+	w = serverRequest(server, "POST", "/v1/manifests/app/render?var=version=1.2.4", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `image: "myapp:1.2.4"`)
+
+	w = serverRequest(server, "POST", "/v1/manifests/missing/render", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serverRequest(server, "POST", "/v1/manifests/.hidden/render", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serverRequest(server, "GET", "/v1/manifests/app/apply", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestServerPlan(t *testing.T) {
+	client := &clientMock{}
+	client.On("GetContainers").Return(nil)
+	client.On("ResolveImages", mock.Anything, false, mock.Anything).Return(nil)
+
+	server, cleanup := newTestServer(t, client)
+	defer cleanup()
+
+	w := serverRequest(server, "POST", "/v1/manifests/app/plan", `{"vars": {"version": "1.2.3"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	plan := &ServerPlan{}
+	if err := json.Unmarshal(w.Body.Bytes(), plan); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &ServerPlan{Namespace: "app", Changes: []string{"Creating container 'app.web'"}}, plan)
+
+	// dry runs do not take the deploy lock
+	client.AssertNotCalled(t, "AcquireDeployLock", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestServerApply(t *testing.T) {
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("RunContainer", mock.Anything).Return(nil)
+	client.On("WaitForContainer", mock.Anything).Return(nil)
+
+	server, cleanup := newTestServer(t, client)
+	defer cleanup()
+
+	audit := &bytes.Buffer{}
+	server.Audit = audit
+
+	util.RegisterSecret("server-s3cr3t")
+	w := serverRequest(server, "POST", "/v1/manifests/app/apply", `{"vars": {"version": "1.2.3", "password": "server-s3cr3t"}}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	holder := client.Calls[0].Arguments.String(1)
+	assert.True(t, strings.HasPrefix(holder, "alice via API"), holder)
+
+	entry := &AuditEntry{}
+	if err := json.Unmarshal(audit.Bytes(), entry); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "alice", entry.User)
+	assert.Equal(t, "apply", entry.Action)
+	assert.Equal(t, "app", entry.Manifest)
+	assert.Equal(t, "1.2.3", entry.Vars["version"])
+	assert.Equal(t, util.Redacted, entry.Vars["password"])
+	assert.Equal(t, []string{"Creating container 'app.web'"}, entry.Changes)
+	assert.Empty(t, entry.Error)
+}
+
+func TestServerApplyLocked(t *testing.T) {
+	client := &clientMock{}
+	client.On("AcquireDeployLock", "app", mock.Anything, mock.Anything, mock.Anything).
+		Return((*DeployLock)(nil), ErrDeployLocked{&DeployLock{Namespace: "app", Holder: "bob", ExpiresAt: time.Now().Add(time.Minute)}})
+
+	server, cleanup := newTestServer(t, client)
+	defer cleanup()
+
+	audit := &bytes.Buffer{}
+	server.Audit = audit
+
+	w := serverRequest(server, "POST", "/v1/manifests/app/apply", `{"vars": {"version": "1.2.3"}}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, audit.String(), `"error":`)
+}
+
+func TestServerStatus(t *testing.T) {
+	web := newContainer("app", "web")
+	web.ID = "123"
+	client := &clientMock{}
+	client.On("GetContainers").Return([]*Container{web, newContainer("other", "db")})
+
+	server, cleanup := newTestServer(t, client)
+	defer cleanup()
+
+	w := serverRequest(server, "GET", "/v1/manifests/app/status?var=version=1.2.3", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	status := []*ServerContainer{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, status, 1)
+	assert.Equal(t, "app.web", status[0].Name)
+	assert.Equal(t, "123", status[0].ID)
+	assert.True(t, status[0].Running)
+}
+
+func TestReadTokensFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "rocker-compose-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("alice: token1\nbob: token2\n")
+	f.Close()
+
+	tokens, err := ReadTokensFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"token1": "alice", "token2": "bob"}, tokens)
+}
+
+func TestServerRenderVarsAreNotInterpolated(t *testing.T) {
+	os.Setenv("ROCKER_COMPOSE_SERVER_TEST_TOKEN", "server-secret")
+	defer os.Unsetenv("ROCKER_COMPOSE_SERVER_TEST_TOKEN")
+
+	server, cleanup := newTestServer(t, &clientMock{})
+	defer cleanup()
+
+	// vars of API clients must not read the environment of the server
+	w := serverRequest(server, "POST", "/v1/manifests/app/render", `{"vars": {"version": "${ROCKER_COMPOSE_SERVER_TEST_TOKEN}"}}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "server-secret")
+	assert.Contains(t, w.Body.String(), `myapp:${ROCKER_COMPOSE_SERVER_TEST_TOKEN}`)
+}
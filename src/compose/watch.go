@@ -0,0 +1,273 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// DefaultWatchDebounce is how long watch waits for more changes before reconciling
+	DefaultWatchDebounce = 2 * time.Second
+
+	// DefaultWatchPollInterval is how often watch checks files for changes
+	DefaultWatchPollInterval = 2 * time.Second
+
+	// DefaultWatchMaxBackoff is the longest delay between retries of failed reconciles
+	DefaultWatchMaxBackoff = 5 * time.Minute
+)
+
+// watchInitialBackoff is the delay before the first retry of a failed reconcile,
+// it doubles with every next failure up to MaxBackoff
+var watchInitialBackoff = 5 * time.Second
+
+// watchResubscribeDelay is the delay before subscribing to Docker events again
+// after the stream is closed
+var watchResubscribeDelay = 5 * time.Second
+
+// Watcher keeps containers of the manifest in the desired state. It reconciles
+// them like 'run' does whenever a container of the namespace dies or is removed,
+// or the manifest files change.
+type Watcher struct {
+	Compose *Compose
+
+	// Files are checked for changes, usually the manifest, vars files and the lock file
+	Files []string
+
+	// Load reads the manifest again after Files are changed
+	Load func() (*config.Config, error)
+
+	Debounce     time.Duration // DefaultWatchDebounce if zero
+	PollInterval time.Duration // DefaultWatchPollInterval if zero
+	MaxBackoff   time.Duration // DefaultWatchMaxBackoff if zero
+
+	ids map[string]string // ids of containers of the namespace to their names
+}
+
+// Run reconciles containers once and then every time something changes, until
+// the stop channel is closed
+func (w *Watcher) Run(stop <-chan struct{}) error {
+	debounce := durationOrDefault(w.Debounce, DefaultWatchDebounce)
+	maxBackoff := durationOrDefault(w.MaxBackoff, DefaultWatchMaxBackoff)
+
+	poll := time.NewTicker(durationOrDefault(w.PollInterval, DefaultWatchPollInterval))
+	defer poll.Stop()
+
+	files := newFileWatcher(w.Files)
+
+	events, err := w.subscribe()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if events != nil {
+			w.Compose.client.RemoveEventListener(events)
+		}
+	}()
+
+	var (
+		reasons     = []string{"start"}
+		reload      = false
+		backoff     = time.Duration(0)
+		fire        = time.After(0)
+		resubscribe <-chan time.Time
+	)
+
+	trigger := func(reason string) {
+		reasons = append(reasons, reason)
+		// wait for more changes unless waiting for a retry anyway
+		if backoff == 0 {
+			fire = time.After(debounce)
+		}
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+
+		case event, ok := <-events:
+			if !ok {
+				log.Warnf("Docker events stream is closed, subscribing again in %s", watchResubscribeDelay)
+				events = nil
+				resubscribe = time.After(watchResubscribeDelay)
+				break
+			}
+			if event == nil {
+				break
+			}
+			if name, ok := w.ids[event.ID]; ok && (event.Status == "die" || event.Status == "destroy") {
+				trigger(fmt.Sprintf("container %s (%.12s) %s", name, event.ID, event.Status))
+			}
+
+		case <-resubscribe:
+			resubscribe = nil
+			if events, err = w.subscribe(); err != nil {
+				log.Errorf("%s, retrying in %s", err, watchResubscribeDelay)
+				resubscribe = time.After(watchResubscribeDelay)
+				break
+			}
+			// events may be missed while the stream was closed
+			trigger("docker events stream is reopened")
+
+		case <-poll.C:
+			for _, file := range files.changed() {
+				reload = true
+				trigger(fmt.Sprintf("%s changed", file))
+			}
+
+		case <-fire:
+			fire = nil
+			if err := w.reconcile(reasons, reload); err != nil {
+				backoff = nextBackoff(backoff, maxBackoff)
+				log.Errorf("Reconcile failed, retrying in %s, error: %s", backoff, err)
+				reasons = []string{"retry"}
+				fire = time.After(backoff)
+				break
+			}
+			reasons, reload, backoff = nil, false, 0
+		}
+	}
+}
+
+// reconcile runs the diff and applies the plan, reading the manifest first if needed
+func (w *Watcher) reconcile(reasons []string, reload bool) error {
+	log.Infof("Reconciling, triggered by: %s", strings.Join(reasons, ", "))
+
+	if reload {
+		manifest, err := w.Load()
+		if err != nil {
+			return fmt.Errorf("Failed to read the manifest, error: %s", err)
+		}
+		w.Compose.Manifest = manifest
+	}
+
+	recovered := len(w.Compose.client.GetRecoveredContainers())
+
+	if err := w.Compose.RunAction(); err != nil {
+		return err
+	}
+
+	changes := w.Compose.Changes()
+	drifted := w.Compose.changedContainers()
+	for _, container := range w.Compose.client.GetRecoveredContainers()[recovered:] {
+		changes = append(changes, fmt.Sprintf("Starting container '%s' (not running)", container.Name))
+		drifted[container.Name.String()] = struct{}{}
+	}
+	// changes made without the manifest being changed mean containers drifted away
+	if !reload {
+		w.Compose.Metrics.ObserveDrift(len(drifted))
+	}
+	if len(changes) > 0 {
+		log.Infof("Reconciled, changes: %s", strings.Join(changes, "; "))
+	} else {
+		log.Infof("Reconciled, nothing changed")
+	}
+
+	return w.refreshIDs()
+}
+
+// refreshIDs remembers ids of containers of the namespace, events of other containers are ignored
+func (w *Watcher) refreshIDs() error {
+	containers, err := w.Compose.client.GetContainers(false)
+	if err != nil {
+		return fmt.Errorf("GetContainers failed with error, error: %s", err)
+	}
+	w.ids = map[string]string{}
+	for _, container := range containers {
+		if container.Name.Namespace == w.Compose.Manifest.Namespace {
+			w.ids[container.ID] = container.Name.String()
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) subscribe() (chan *docker.APIEvents, error) {
+	events := make(chan *docker.APIEvents, 100)
+	if err := w.Compose.client.AddEventListener(events); err != nil {
+		return nil, fmt.Errorf("Failed to start listening for Docker events, error: %s", err)
+	}
+	return events, nil
+}
+
+// nextBackoff doubles the delay, starting from watchInitialBackoff, up to max
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	if backoff == 0 {
+		backoff = watchInitialBackoff
+	} else {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// fileWatcher detects changes of files by their modification times and sizes
+type fileWatcher struct {
+	files []string
+	stats map[string]fileStat
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func newFileWatcher(files []string) *fileWatcher {
+	fw := &fileWatcher{files: files, stats: map[string]fileStat{}}
+	for _, file := range files {
+		fw.stats[file] = statFile(file)
+	}
+	return fw
+}
+
+// changed returns files changed, created or removed since the last call
+func (fw *fileWatcher) changed() []string {
+	changed := []string{}
+	for _, file := range fw.files {
+		stat := statFile(file)
+		if stat != fw.stats[file] {
+			changed = append(changed, file)
+			fw.stats[file] = stat
+		}
+	}
+	return changed
+}
+
+func statFile(file string) fileStat {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileStat{}
+	}
+	return fileStat{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"compose/config"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFileWatcher(t *testing.T) {
+	f, err := ioutil.TempFile("", "rocker-compose-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	missing := f.Name() + ".missing"
+	fw := newFileWatcher([]string{f.Name(), missing})
+	assert.Empty(t, fw.changed())
+
+	if err := ioutil.WriteFile(f.Name(), []byte("namespace: test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{f.Name()}, fw.changed())
+	assert.Empty(t, fw.changed())
+
+	if err := ioutil.WriteFile(missing, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(missing)
+	assert.Equal(t, []string{missing}, fw.changed())
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoff := nextBackoff(0, time.Minute)
+	assert.Equal(t, watchInitialBackoff, backoff)
+	assert.Equal(t, 2*watchInitialBackoff, nextBackoff(backoff, time.Minute))
+	assert.Equal(t, time.Minute, nextBackoff(time.Minute, time.Minute))
+}
+
+func TestWatcherReloadsChangedManifest(t *testing.T) {
+	f, err := ioutil.TempFile("", "rocker-compose-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	client := &clientMock{}
+	client.On("AddEventListener", mock.Anything).Return(nil)
+	client.On("RemoveEventListener", mock.Anything).Return(nil)
+	client.On("AcquireDeployLock", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(&DeployLock{}, nil)
+	client.On("ReleaseDeployLock", mock.Anything).Return(nil)
+	client.On("GetContainers").Return(nil)
+	client.On("FetchImages", mock.Anything, mock.Anything).Return(nil)
+	client.On("GetRecoveredContainers").Return([]*Container{})
+
+	loaded := make(chan struct{}, 1)
+	watcher := &Watcher{
+		Compose: &Compose{Manifest: &config.Config{Namespace: "test"}, client: client},
+		Files:   []string{f.Name()},
+		Load: func() (*config.Config, error) {
+			loaded <- struct{}{}
+			return &config.Config{Namespace: "test2"}, nil
+		},
+		Debounce:     time.Millisecond,
+		PollInterval: time.Millisecond,
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watcher.Run(stop)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := ioutil.WriteFile(f.Name(), []byte("namespace: test2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-loaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("manifest is not reloaded after the change")
+	}
+
+	close(stop)
+	assert.Nil(t, <-done)
+	assert.Equal(t, "test2", watcher.Compose.Manifest.Namespace)
+	client.AssertCalled(t, "AddEventListener", mock.Anything)
+}
@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Redacted is the placeholder that replaces secret values in the output
+const Redacted = "<redacted>"
+
+// minSecretLength is the length of the shortest value that is considered for
+// redaction; replacing very short strings would garble the output without
+// hiding anything meaningful
+const minSecretLength = 4
+
+var secrets = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+// RegisterSecret remembers the secret value, so it is replaced by Redact and
+// by the RedactHook everywhere it appears in the output
+func RegisterSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	for _, v := range secrets.values {
+		if v == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+
+	// replace longer values first, in case one secret is a part of another
+	sort.Sort(sort.Reverse(byLength(secrets.values)))
+}
+
+// Redact replaces all registered secret values in the given string
+func Redact(str string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+
+	for _, v := range secrets.values {
+		str = strings.Replace(str, v, Redacted, -1)
+	}
+	return str
+}
+
+// RedactHook is a logrus hook that redacts secret values from log messages
+// and string fields
+type RedactHook struct{}
+
+// Levels returns all levels, since secrets should never reach the log
+func (h RedactHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+// Fire redacts the entry before it is formatted
+func (h RedactHook) Fire(entry *log.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for k, v := range entry.Data {
+		if str, ok := v.(string); ok {
+			entry.Data[k] = Redact(str)
+		}
+	}
+	return nil
+}
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Less(i, j int) bool { return len(s[i]) < len(s[j]) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }